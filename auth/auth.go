@@ -0,0 +1,239 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package auth authenticates the clients of the service with API keys and
+// authorizes their requests with scopes.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+)
+
+// Scope is a permission granted to a client.
+type Scope string
+
+const (
+	ScopeIssue  Scope = "tokens:issue"
+	ScopeVerify Scope = "tokens:verify"
+	ScopeRevoke Scope = "tokens:revoke"
+
+	// ScopeAdmin grants every other scope.
+	ScopeAdmin Scope = "admin"
+)
+
+// Scopes lists the known scopes.
+var Scopes = []Scope{ScopeIssue, ScopeVerify, ScopeRevoke, ScopeAdmin}
+
+// ParseScopes converts names into scopes, rejecting unknown ones.
+func ParseScopes(names []string) ([]Scope, error) {
+	const op errors.Op = "auth.ParseScopes"
+
+	scopes := make([]Scope, 0, len(names))
+	for _, name := range names {
+		scope := Scope(strings.TrimSpace(name))
+		if !scope.valid() {
+			return nil, errors.E(op, errors.Invalid, errors.Errorf("unknown scope %q", name))
+		}
+		scopes = append(scopes, scope)
+	}
+
+	return scopes, nil
+}
+
+func (s Scope) valid() bool {
+	for _, scope := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Principal is an authenticated client.
+type Principal struct {
+	// ID identifies the client, such as the ID of its API key or, for a
+	// JWT, its subject prefixed with SubjectPrefix.
+	ID     string
+	Name   string
+	Scopes []Scope
+}
+
+// Allows reports whether the principal was granted scope.
+func (p *Principal) Allows(scope Scope) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize returns a Permission error unless the principal was granted
+// scope.
+func (p *Principal) Authorize(ctx context.Context, scope Scope) error {
+	const op errors.Op = "auth/Principal.Authorize"
+
+	if !p.Allows(scope) {
+		return errors.E(op, ctx, errors.Permission, errors.Errorf("client %s lacks scope %s", p.ID, scope))
+	}
+	return nil
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the principal.
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// FromContext returns the principal carried by ctx, if any.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(contextKey{}).(*Principal)
+	return p, ok
+}
+
+// KeyPrefix starts every API key, so that keys are easy to recognize in
+// configuration files and in leaks.
+const KeyPrefix = "ldg_"
+
+// Key is an API key as stored: the secret part of the key is only kept
+// hashed.
+type Key struct {
+	ID        string
+	Name      string
+	Hash      string
+	Scopes    []Scope
+	CreatedAt time.Time
+
+	// RevokedAt is zero unless the key was revoked.
+	RevokedAt time.Time
+}
+
+// Revoked reports whether the key was revoked.
+func (k *Key) Revoked() bool {
+	return !k.RevokedAt.IsZero()
+}
+
+// Principal returns the client authenticated by the key.
+func (k *Key) Principal() *Principal {
+	return &Principal{ID: k.ID, Name: k.Name, Scopes: k.Scopes}
+}
+
+// KeyStore stores API keys. LookupKey and RevokeKey fail with a NotFound
+// error for unknown keys.
+type KeyStore interface {
+	CreateKey(ctx context.Context, key *Key) error
+	LookupKey(ctx context.Context, id string) (*Key, error)
+	ListKeys(ctx context.Context) ([]*Key, error)
+	RevokeKey(ctx context.Context, id string) error
+}
+
+// NewKey generates an API key. It returns the key to hand to the client,
+// which cannot be recovered later, and the Key to store.
+func NewKey(name string, scopes []Scope) (string, *Key, error) {
+	const op errors.Op = "auth.NewKey"
+
+	if len(scopes) == 0 {
+		return "", nil, errors.E(op, errors.Invalid, "an API key needs at least one scope")
+	}
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	for _, b := range [][]byte{id, secret} {
+		if _, err := rand.Read(b); err != nil {
+			return "", nil, errors.E(op, errors.Internal, err)
+		}
+	}
+
+	key := &Key{
+		ID:        hex.EncodeToString(id),
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	key.Hash = Hash(encoded)
+
+	return KeyPrefix + key.ID + "_" + encoded, key, nil
+}
+
+// Hash returns the stored form of the secret part of an API key. Secrets
+// are random, so a single round of SHA-256 is enough.
+func Hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseKey splits an API key into its ID and its secret.
+func ParseKey(s string) (id, secret string, err error) {
+	const op errors.Op = "auth.ParseKey"
+
+	if !strings.HasPrefix(s, KeyPrefix) {
+		return "", "", errors.E(op, errors.Permission, "malformed API key")
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(s, KeyPrefix), "_", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.E(op, errors.Permission, "malformed API key")
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// Authenticator authenticates clients by their API keys.
+type Authenticator struct {
+	keys KeyStore
+}
+
+func NewAuthenticator(keys KeyStore) *Authenticator {
+	return &Authenticator{keys: keys}
+}
+
+// Authenticate returns the client holding the API key. Unknown, revoked
+// and malformed keys fail with a Permission error.
+func (a *Authenticator) Authenticate(ctx context.Context, apiKey string) (*Principal, error) {
+	const op errors.Op = "auth/Authenticator.Authenticate"
+
+	id, secret, err := ParseKey(apiKey)
+	if err != nil {
+		return nil, errors.E(op, ctx, err)
+	}
+
+	key, err := a.keys.LookupKey(ctx, id)
+	if errors.Is(errors.NotFound, err) {
+		return nil, errors.E(op, ctx, errors.Permission, "invalid API key")
+	}
+	if err != nil {
+		return nil, errors.E(op, ctx, err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(Hash(secret))) != 1 {
+		return nil, errors.E(op, ctx, errors.Permission, "invalid API key")
+	}
+
+	if key.Revoked() {
+		return nil, errors.E(op, ctx, errors.Permission, errors.Errorf("API key %s was revoked", key.ID))
+	}
+
+	return key.Principal(), nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// keyStore is a KeyStore holding a single set of keys.
+type keyStore map[string]*Key
+
+func (s keyStore) CreateKey(ctx context.Context, key *Key) error {
+	s[key.ID] = key
+	return nil
+}
+
+func (s keyStore) LookupKey(ctx context.Context, id string) (*Key, error) {
+	if key, ok := s[id]; ok {
+		return key, nil
+	}
+	return nil, errors.E(errors.NotFound, id)
+}
+
+func (s keyStore) ListKeys(ctx context.Context) ([]*Key, error) {
+	return nil, nil
+}
+
+func (s keyStore) RevokeKey(ctx context.Context, id string) error {
+	s[id].RevokedAt = time.Now()
+	return nil
+}
+
+func TestNewKey(t *testing.T) {
+	apiKey, key, err := NewKey("ci", []Scope{ScopeIssue})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, strings.HasPrefix(apiKey, KeyPrefix+key.ID+"_"))
+	assert.NotContains(t, apiKey, key.Hash)
+
+	id, secret, err := ParseKey(apiKey)
+	assert.NoError(t, err)
+	assert.Equal(t, key.ID, id)
+	assert.Equal(t, key.Hash, Hash(secret))
+
+	_, _, err = NewKey("ci", nil)
+	assert.True(t, errors.Is(errors.Invalid, err))
+}
+
+func TestAuthenticate(t *testing.T) {
+	ctx := context.Background()
+	keys := keyStore{}
+	a := NewAuthenticator(keys)
+
+	apiKey, key, _ := NewKey("ci", []Scope{ScopeIssue})
+	_ = keys.CreateKey(ctx, key)
+
+	p, err := a.Authenticate(ctx, apiKey)
+	if assert.NoError(t, err) {
+		assert.Equal(t, key.ID, p.ID)
+		assert.NoError(t, p.Authorize(ctx, ScopeIssue))
+		assert.True(t, errors.Is(errors.Permission, p.Authorize(ctx, ScopeRevoke)))
+	}
+
+	other, _, _ := NewKey("ci", []Scope{ScopeIssue})
+	for _, bad := range []string{"", "ldg_", "ldg_" + key.ID + "_wrong", other} {
+		_, err := a.Authenticate(ctx, bad)
+		assert.True(t, errors.Is(errors.Permission, err), bad)
+	}
+
+	_ = keys.RevokeKey(ctx, key.ID)
+	_, err = a.Authenticate(ctx, apiKey)
+	assert.True(t, errors.Is(errors.Permission, err))
+}
+
+func TestPrincipal_Allows(t *testing.T) {
+	admin := &Principal{Scopes: []Scope{ScopeAdmin}}
+	for _, scope := range Scopes {
+		assert.True(t, admin.Allows(scope))
+	}
+
+	assert.False(t, (&Principal{}).Allows(ScopeIssue))
+
+	scopes, err := ParseScopes([]string{"tokens:issue", " tokens:verify"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Scope{ScopeIssue, ScopeVerify}, scopes)
+
+	_, err = ParseScopes([]string{"tokens:mint"})
+	assert.True(t, errors.Is(errors.Invalid, err))
+}
@@ -0,0 +1,495 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/log"
+)
+
+const (
+	// DefaultJWKSRefresh is how often keys loaded from a URL are refreshed.
+	DefaultJWKSRefresh = time.Hour
+
+	// DefaultLeeway is the clock skew tolerated on the expiry and
+	// not-before times of a token.
+	DefaultLeeway = time.Minute
+
+	// SubjectPrefix is prepended to the sub claim of a JWT to form the ID
+	// of its principal, so that a subject can never take the quotas and
+	// limits of an API key with the same ID.
+	SubjectPrefix = "jwt:"
+
+	// minJWKSRefresh bounds how often an unknown key ID triggers a refresh.
+	minJWKSRefresh = time.Minute
+)
+
+// JWTConfig configures the validation of bearer JWTs.
+type JWTConfig struct {
+	// JWKSFile or JWKSURL locate the JSON Web Key Set holding the public
+	// keys of the issuer. Exactly one must be set.
+	JWKSFile string
+	JWKSURL  string
+
+	// JWKSRefresh is how often keys are reloaded from JWKSURL. The default
+	// is DefaultJWKSRefresh.
+	JWKSRefresh time.Duration
+
+	// Issuer and Audience must match the iss and aud claims. Both are
+	// required.
+	Issuer   string
+	Audience string
+
+	// Leeway is the clock skew tolerated on exp and nbf. The default is
+	// DefaultLeeway.
+	Leeway time.Duration
+}
+
+// claims are the registered claims checked by JWTVerifier, with the claims
+// commonly used by OIDC providers to carry the client and its scopes.
+type claims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	ExpiresAt *int64   `json:"exp"`
+	NotBefore *int64   `json:"nbf"`
+	ClientID  string   `json:"client_id"`
+	AZP       string   `json:"azp"`
+
+	// Scope is a space-separated list (RFC 8693); Scp is the array used by
+	// some providers.
+	Scope string   `json:"scope"`
+	Scp   []string `json:"scp"`
+}
+
+// audience is the aud claim, either a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) contains(aud string) bool {
+	for _, s := range a {
+		if s == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// JWTVerifier authenticates clients by bearer JWTs signed with RSA or ECDSA
+// keys.
+type JWTVerifier struct {
+	cfg    *JWTConfig
+	client *http.Client
+	now    func() time.Time
+
+	// loadMu serializes refreshes, so that a burst of tokens signed with
+	// an unknown key fetches the key set once.
+	loadMu sync.Mutex
+
+	mu       sync.RWMutex
+	keys     map[string]crypto.PublicKey
+	loadedAt time.Time
+}
+
+// NewJWTVerifier loads the keys of the issuer.
+func NewJWTVerifier(ctx context.Context, cfg *JWTConfig) (*JWTVerifier, error) {
+	const op errors.Op = "auth.NewJWTVerifier"
+
+	if (cfg.JWKSFile == "") == (cfg.JWKSURL == "") {
+		return nil, errors.E(op, errors.Invalid, "exactly one of the JWKS file and URL must be set")
+	}
+
+	if cfg.Issuer == "" || cfg.Audience == "" {
+		return nil, errors.E(op, errors.Invalid, "the JWT issuer and audience must be set")
+	}
+
+	if cfg.JWKSRefresh == 0 {
+		cfg.JWKSRefresh = DefaultJWKSRefresh
+	}
+
+	if cfg.Leeway == 0 {
+		cfg.Leeway = DefaultLeeway
+	}
+
+	v := &JWTVerifier{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		now:    time.Now,
+	}
+
+	if err := v.load(ctx); err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	return v, nil
+}
+
+// load reads the key set and replaces the known keys.
+func (v *JWTVerifier) load(ctx context.Context) error {
+	const op errors.Op = "auth/JWTVerifier.load"
+
+	var (
+		data []byte
+		err  error
+	)
+	if v.cfg.JWKSFile != "" {
+		data, err = ioutil.ReadFile(v.cfg.JWKSFile)
+	} else {
+		data, err = v.fetch(ctx)
+	}
+	if err != nil {
+		return errors.E(op, ctx, errors.IO, err)
+	}
+
+	keys, err := ParseJWKS(data)
+	if err != nil {
+		return errors.E(op, ctx, err)
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.loadedAt = v.now()
+	v.mu.Unlock()
+	return nil
+}
+
+func (v *JWTVerifier) fetch(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, v.cfg.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := v.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("fetching %s: %s", v.cfg.JWKSURL, resp.Status)
+	}
+
+	return ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, 1<<20))
+}
+
+// key returns the key identified by kid, refreshing keys loaded from a URL
+// when they are stale or kid is unknown.
+func (v *JWTVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, bool) {
+	v.mu.RLock()
+	key, ok := v.lookup(kid)
+	loadedAt := v.loadedAt
+	v.mu.RUnlock()
+
+	if !v.stale(ok, loadedAt) {
+		return key, ok
+	}
+
+	v.loadMu.Lock()
+	v.mu.RLock()
+	refreshed := !v.loadedAt.Equal(loadedAt)
+	v.mu.RUnlock()
+	if !refreshed {
+		if err := v.load(ctx); err != nil {
+			// Keep serving the keys we have.
+			log.FromContext(ctx).Warnf("error while refreshing JWKS: %v", err)
+		}
+	}
+	v.loadMu.Unlock()
+
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.lookup(kid)
+}
+
+// stale reports whether keys loaded at loadedAt must be refreshed, given
+// whether the key looked up was found.
+func (v *JWTVerifier) stale(found bool, loadedAt time.Time) bool {
+	if v.cfg.JWKSURL == "" {
+		return false
+	}
+
+	age := v.now().Sub(loadedAt)
+	if found {
+		return age >= v.cfg.JWKSRefresh
+	}
+	return age >= minJWKSRefresh
+}
+
+// lookup must be called with mu held.
+func (v *JWTVerifier) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true
+		}
+	}
+
+	key, ok := v.keys[kid]
+	return key, ok
+}
+
+// Verify checks the signature and the claims of a compact JWT and returns
+// the client it identifies. Invalid tokens fail with a Permission error.
+func (v *JWTVerifier) Verify(ctx context.Context, token string) (*Principal, error) {
+	const op errors.Op = "auth/JWTVerifier.Verify"
+
+	deny := func(reason string, args ...interface{}) error {
+		return errors.E(op, ctx, errors.Permission, errors.Errorf("invalid bearer token: "+reason, args...))
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, deny("malformed")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, deny("malformed header")
+	}
+
+	hash, ok := algorithms[header.Alg]
+	if !ok {
+		return nil, deny("unsupported algorithm %q", header.Alg)
+	}
+
+	key, ok := v.key(ctx, header.Kid)
+	if !ok {
+		return nil, deny("unknown key %q", header.Kid)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, deny("malformed signature")
+	}
+
+	if !verifySignature(header.Alg, hash, key, parts[0]+"."+parts[1], signature) {
+		return nil, deny("bad signature")
+	}
+
+	var c claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, deny("malformed claims")
+	}
+
+	now := v.now()
+	switch {
+	case c.ExpiresAt == nil:
+		return nil, deny("no expiry")
+	case now.After(time.Unix(*c.ExpiresAt, 0).Add(v.cfg.Leeway)):
+		return nil, deny("expired")
+	case c.NotBefore != nil && now.Add(v.cfg.Leeway).Before(time.Unix(*c.NotBefore, 0)):
+		return nil, deny("not valid yet")
+	case c.Issuer != v.cfg.Issuer:
+		return nil, deny("unexpected issuer %q", c.Issuer)
+	case !c.Audience.contains(v.cfg.Audience):
+		return nil, deny("unexpected audience")
+	case c.Subject == "":
+		return nil, deny("no subject")
+	}
+
+	return c.principal(), nil
+}
+
+func (c *claims) principal() *Principal {
+	p := &Principal{ID: SubjectPrefix + c.Subject, Name: c.ClientID}
+	if p.Name == "" {
+		p.Name = c.AZP
+	}
+
+	// Scopes unknown to the ledger are ignored.
+	names := append(strings.Fields(c.Scope), c.Scp...)
+	for _, name := range names {
+		if scope := Scope(name); scope.valid() {
+			p.Scopes = append(p.Scopes, scope)
+		}
+	}
+
+	return p
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// algorithms are the accepted signing algorithms and their hashes.
+// Symmetric algorithms and "none" are never accepted.
+var algorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// algorithmCurves are the curves ECDSA algorithms must be used with
+// (RFC 7518, section 3.4).
+var algorithmCurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+func verifySignature(alg string, hash crypto.Hash, key crypto.PublicKey, signed string, signature []byte) bool {
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if key.Curve != algorithmCurves[alg] || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+
+	return false
+}
+
+// jwk is a JSON Web Key (RFC 7517) holding an RSA or EC public key.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+var curves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// ParseJWKS parses a JSON Web Key Set into public keys by key ID. Keys not
+// meant for signatures and key types other than RSA and EC are skipped.
+func ParseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	const op errors.Op = "auth.ParseJWKS"
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, errors.E(op, errors.Invalid, err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, errors.E(op, errors.Invalid, errors.Errorf("key %q: %v", k.Kid, err))
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.E(op, errors.Invalid, "no signing keys in JWKS")
+	}
+
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.Str("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, errors.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.Str("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.Str("invalid base64url integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
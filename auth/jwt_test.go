@@ -0,0 +1,260 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// signer holds a locally generated key pair.
+type signer struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+func newSigners(t *testing.T) (*signer, *signer) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &signer{kid: "rsa", alg: "RS256", key: rsaKey}, &signer{kid: "ec", alg: "ES256", key: ecKey}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// jwks returns the public keys of the signers as a JSON Web Key Set.
+func jwks(signers ...*signer) []byte {
+	var keys []map[string]string
+	for _, s := range signers {
+		switch pub := s.key.Public().(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, map[string]string{
+				"kty": "RSA", "kid": s.kid, "use": "sig",
+				"n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case *ecdsa.PublicKey:
+			keys = append(keys, map[string]string{
+				"kty": "EC", "kid": s.kid, "crv": "P-256",
+				"x": b64(pub.X.Bytes()), "y": b64(pub.Y.Bytes()),
+			})
+		}
+	}
+	b, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	return b
+}
+
+func (s *signer) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+
+	hash := algorithms[s.alg]
+	digest := hash.New()
+	digest.Write([]byte(signed))
+
+	var sig []byte
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, hash, digest.Sum(nil)); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, ss, err := ecdsa.Sign(rand.Reader, key, digest.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		rb, sb := r.Bytes(), ss.Bytes()
+		copy(sig[32-len(rb):32], rb)
+		copy(sig[64-len(sb):], sb)
+	}
+
+	return signed + "." + b64(sig)
+}
+
+func writeJWKS(t *testing.T, data []byte) (string, func()) {
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestJWTVerifier(t *testing.T) {
+	rsaSigner, ecSigner := newSigners(t)
+	path, cleanup := writeJWKS(t, jwks(rsaSigner, ecSigner))
+	defer cleanup()
+
+	ctx := context.Background()
+	v, err := NewJWTVerifier(ctx, &JWTConfig{JWKSFile: path, Issuer: "https://idp.example.com", Audience: "ledger"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":       "https://idp.example.com",
+			"sub":       "billing",
+			"aud":       []string{"ledger", "other"},
+			"exp":       now.Add(time.Hour).Unix(),
+			"client_id": "billing-service",
+			"scope":     "tokens:issue tokens:verify openid",
+		}
+	}
+
+	for _, s := range []*signer{rsaSigner, ecSigner} {
+		p, err := v.Verify(ctx, s.sign(t, valid()))
+		if assert.NoError(t, err, s.alg) {
+			assert.Equal(t, &Principal{ID: "jwt:billing", Name: "billing-service", Scopes: []Scope{ScopeIssue, ScopeVerify}}, p)
+		}
+	}
+
+	scp := valid()
+	delete(scp, "scope")
+	scp["scp"] = []string{"admin"}
+	scp["aud"] = "ledger"
+	if p, err := v.Verify(ctx, ecSigner.sign(t, scp)); assert.NoError(t, err) {
+		assert.True(t, p.Allows(ScopeRevoke))
+	}
+
+	tests := map[string]func(c map[string]interface{}){
+		"expired":       func(c map[string]interface{}) { c["exp"] = now.Add(-time.Hour).Unix() },
+		"no expiry":     func(c map[string]interface{}) { delete(c, "exp") },
+		"not before":    func(c map[string]interface{}) { c["nbf"] = now.Add(time.Hour).Unix() },
+		"issuer":        func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" },
+		"no issuer":     func(c map[string]interface{}) { delete(c, "iss") },
+		"audience":      func(c map[string]interface{}) { c["aud"] = "other" },
+		"no audience":   func(c map[string]interface{}) { delete(c, "aud") },
+		"no subject":    func(c map[string]interface{}) { delete(c, "sub") },
+		"within leeway": nil,
+	}
+	for name, mutate := range tests {
+		c := valid()
+		if mutate == nil {
+			c["exp"] = now.Add(-30 * time.Second).Unix()
+			_, err := v.Verify(ctx, rsaSigner.sign(t, c))
+			assert.NoError(t, err, name)
+			continue
+		}
+		mutate(c)
+		_, err := v.Verify(ctx, rsaSigner.sign(t, c))
+		assert.True(t, errors.Is(errors.Permission, err), "%s: %v", name, err)
+	}
+
+	// Signatures from unknown keys, tampered tokens, unsigned tokens and
+	// ECDSA algorithms that do not match the curve of the key are
+	// rejected.
+	other, _ := newSigners(t)
+	token := rsaSigner.sign(t, valid())
+	forged := ecSigner.sign(t, valid())
+	unsigned := b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{"sub":"billing"}`)) + "."
+	wrongCurve := (&signer{kid: ecSigner.kid, alg: "ES384", key: ecSigner.key}).sign(t, valid())
+	for _, bad := range []string{other.sign(t, valid()), token[:len(token)-4] + "AAAA", forged[:len(forged)-1], unsigned, wrongCurve, "a.b"} {
+		_, err := v.Verify(ctx, bad)
+		assert.True(t, errors.Is(errors.Permission, err), bad)
+	}
+}
+
+func TestJWTVerifier_refresh(t *testing.T) {
+	first, second := newSigners(t)
+
+	keys := jwks(first)
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		_, _ = w.Write(keys)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	v, err := NewJWTVerifier(ctx, &JWTConfig{JWKSURL: srv.URL, Issuer: "https://idp.example.com", Audience: "ledger"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	v.now = func() time.Time { return now }
+	claims := map[string]interface{}{"iss": "https://idp.example.com", "aud": "ledger", "sub": "billing", "exp": now.Add(time.Hour).Unix()}
+
+	_, err = v.Verify(ctx, first.sign(t, claims))
+	assert.NoError(t, err)
+
+	// The issuer rotates its keys: unknown keys are fetched, at most once a
+	// minute.
+	keys = jwks(second)
+	_, err = v.Verify(ctx, second.sign(t, claims))
+	assert.Error(t, err)
+	assert.Equal(t, 1, fetches)
+
+	now = now.Add(2 * minJWKSRefresh)
+	_, err = v.Verify(ctx, second.sign(t, claims))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, fetches)
+}
+
+func TestParseJWKS(t *testing.T) {
+	_, err := ParseJWKS([]byte(`{"keys":[{"kty":"oct","k":"c2VjcmV0"}]}`))
+	assert.True(t, errors.Is(errors.Invalid, err))
+
+	_, err = ParseJWKS([]byte(`{"keys":[{"kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}]}`))
+	assert.True(t, errors.Is(errors.Invalid, err))
+
+	_, err = NewJWTVerifier(context.Background(), &JWTConfig{})
+	assert.True(t, errors.Is(errors.Invalid, err))
+}
+
+func TestNewJWTVerifier_required(t *testing.T) {
+	path, cleanup := writeJWKS(t, []byte(`{"keys":[]}`))
+	defer cleanup()
+
+	for _, cfg := range []*JWTConfig{
+		{JWKSFile: path, Audience: "ledger"},
+		{JWKSFile: path, Issuer: "https://idp.example.com"},
+	} {
+		_, err := NewJWTVerifier(context.Background(), cfg)
+		assert.True(t, errors.Is(errors.Invalid, err), "%+v: %v", cfg, err)
+	}
+}
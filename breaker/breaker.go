@@ -0,0 +1,308 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package breaker implements a circuit breaker that stops sending load to a
+// struggling dependency and lets calls through again once it has recovered.
+package breaker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/log"
+)
+
+const (
+	DefaultFailureThreshold = 5
+	DefaultOpenTimeout      = 30 * time.Second
+	DefaultHalfOpenRequests = 1
+)
+
+// State is the state of a circuit.
+type State int
+
+const (
+	Closed   State = iota // Calls go through; failures are counted.
+	Open                  // Calls fail fast until the open timeout elapses.
+	HalfOpen              // A limited number of trial calls go through.
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// Config holds the thresholds of a Breaker.
+type Config struct {
+	// FailureThreshold is the number of consecutive failures that opens
+	// the circuit. The default is 5.
+	FailureThreshold int
+
+	// OpenTimeout is how long the circuit stays open before trial calls
+	// are let through. The default is 30s.
+	OpenTimeout time.Duration
+
+	// HalfOpenRequests is the number of trial calls let through while the
+	// circuit is half-open. The circuit closes once all of them succeed.
+	// The default is 1.
+	HalfOpenRequests int
+
+	// IsFailure reports whether an error returned by a call counts as a
+	// failure of the dependency. The default counts everything except
+	// Invalid, Duplicate and NotFound errors. Cancelled calls are never
+	// counted, whatever IsFailure reports.
+	IsFailure func(err error) bool
+}
+
+// Breaker is a circuit breaker. It is safe for concurrent use.
+type Breaker struct {
+	name string
+	cfg  Config
+	now  func() time.Time
+
+	mu        sync.Mutex
+	state     State
+	failures  int
+	successes int
+	trials    int
+	openedAt  time.Time
+
+	// generation changes with the state, so that calls admitted in an
+	// earlier state do not count in the current one.
+	generation uint64
+}
+
+// New returns a closed Breaker. The name is used in logs and errors.
+func New(name string, cfg *Config) *Breaker {
+	var c Config
+	if cfg != nil {
+		c = *cfg
+	}
+
+	if c.FailureThreshold == 0 {
+		c.FailureThreshold = DefaultFailureThreshold
+	}
+
+	if c.OpenTimeout == 0 {
+		c.OpenTimeout = DefaultOpenTimeout
+	}
+
+	if c.HalfOpenRequests == 0 {
+		c.HalfOpenRequests = DefaultHalfOpenRequests
+	}
+
+	if c.IsFailure == nil {
+		c.IsFailure = isFailure
+	}
+
+	return &Breaker{
+		name: name,
+		cfg:  c,
+		now:  time.Now,
+	}
+}
+
+// Name returns the name of the breaker.
+func (b *Breaker) Name() string {
+	return b.name
+}
+
+// State returns the current state of the circuit.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == Open && b.now().Sub(b.openedAt) >= b.cfg.OpenTimeout {
+		return HalfOpen
+	}
+	return b.state
+}
+
+// Err returns the error Do would fail with if the circuit is open, or nil.
+// It does not reserve a trial call.
+func (b *Breaker) Err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != Open {
+		return nil
+	}
+
+	if wait := b.cfg.OpenTimeout - b.now().Sub(b.openedAt); wait > 0 {
+		return b.openError(wait)
+	}
+	return nil
+}
+
+// Do calls fn if the circuit allows it and records the outcome.
+// When the circuit is open, Do returns a Transient error without calling fn.
+// Calls cancelled by the caller say nothing about the dependency: they
+// count neither as failures nor as successes.
+func (b *Breaker) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	generation, err := b.acquire()
+	if err != nil {
+		return err
+	}
+
+	err = fn(ctx)
+	if err != nil && (ctx.Err() == context.Canceled || isCanceled(err)) {
+		b.abandon(generation)
+		return err
+	}
+
+	b.release(generation, err != nil && b.cfg.IsFailure(err), err)
+	return err
+}
+
+// acquire admits a call and returns the generation it was admitted in.
+func (b *Breaker) acquire() (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case Open:
+		wait := b.cfg.OpenTimeout - b.now().Sub(b.openedAt)
+		if wait > 0 {
+			return 0, b.openError(wait)
+		}
+
+		b.setState(HalfOpen)
+		fallthrough
+	case HalfOpen:
+		// The trial calls in flight decide whether the circuit closes.
+		// Should one fail, the circuit stays open for the open timeout.
+		if b.trials >= b.cfg.HalfOpenRequests {
+			return 0, b.openError(b.cfg.OpenTimeout)
+		}
+		b.trials++
+	}
+
+	return b.generation, nil
+}
+
+// release records the outcome of a call admitted in generation. Outcomes
+// of calls admitted before the last change of state are ignored.
+func (b *Breaker) release(generation uint64, failed bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+
+	switch b.state {
+	case Closed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+
+		b.failures++
+		if b.failures >= b.cfg.FailureThreshold {
+			log.Warnf("Circuit breaker %q opened after %d consecutive failures: %v", b.name, b.failures, err)
+			b.trip()
+		}
+	case HalfOpen:
+		b.trials--
+		if failed {
+			log.Warnf("Circuit breaker %q reopened after a failed trial call: %v", b.name, err)
+			b.trip()
+			return
+		}
+
+		b.successes++
+		if b.successes >= b.cfg.HalfOpenRequests {
+			log.Infof("Circuit breaker %q closed", b.name)
+			b.setState(Closed)
+		}
+	}
+}
+
+// abandon frees the trial slot of a call admitted in generation without
+// recording an outcome.
+func (b *Breaker) abandon(generation uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation == b.generation && b.state == HalfOpen {
+		b.trials--
+	}
+}
+
+func (b *Breaker) trip() {
+	b.setState(Open)
+	b.openedAt = b.now()
+}
+
+func (b *Breaker) setState(state State) {
+	b.state = state
+	b.generation++
+	b.failures = 0
+	b.successes = 0
+	b.trials = 0
+}
+
+func (b *Breaker) openError(wait time.Duration) error {
+	const op errors.Op = "breaker.Do"
+	return errors.E(op, errors.Transient, &OpenError{Name: b.name, Wait: wait})
+}
+
+// OpenError is the underlying error returned while a circuit is open.
+type OpenError struct {
+	Name string
+	Wait time.Duration
+}
+
+func (e *OpenError) Error() string {
+	return fmt.Sprintf("circuit breaker %q is open", e.Name)
+}
+
+// RetryAfter returns how long callers should wait before trying again.
+func (e *OpenError) RetryAfter() time.Duration {
+	return e.Wait
+}
+
+// isCanceled reports whether err wraps the context error of a cancelled call.
+func isCanceled(err error) bool {
+	for err != nil {
+		if err == context.Canceled {
+			return true
+		}
+		e, ok := err.(*errors.Error)
+		if !ok {
+			break
+		}
+		err = e.Err
+	}
+	return false
+}
+
+func isFailure(err error) bool {
+	for _, kind := range []errors.Kind{errors.Invalid, errors.Duplicate, errors.NotFound} {
+		if errors.Is(kind, err) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,236 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package breaker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestBreaker(now *time.Time) *Breaker {
+	b := New("test", &Config{
+		FailureThreshold: 2,
+		OpenTimeout:      time.Minute,
+		HalfOpenRequests: 1,
+	})
+	b.now = func() time.Time { return *now }
+	return b
+}
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&now)
+	ctx := context.Background()
+
+	fail := func(context.Context) error { return errors.E(errors.Internal, "boom") }
+	succeed := func(context.Context) error { return nil }
+
+	// Client errors do not count as failures.
+	for i := 0; i < 5; i++ {
+		b.Do(ctx, func(context.Context) error { return errors.E(errors.Duplicate) })
+	}
+	assert.Equal(t, Closed, b.State())
+
+	b.Do(ctx, fail)
+	assert.Equal(t, Closed, b.State())
+	b.Do(ctx, fail)
+	assert.Equal(t, Open, b.State())
+
+	called := false
+	err := b.Do(ctx, func(context.Context) error { called = true; return nil })
+	assert.False(t, called)
+	assert.True(t, errors.Is(errors.Transient, err))
+	assert.Error(t, b.Err())
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, HalfOpen, b.State())
+	assert.NoError(t, b.Err())
+
+	// A failed trial call reopens the circuit.
+	b.Do(ctx, fail)
+	assert.Equal(t, Open, b.State())
+
+	now = now.Add(time.Minute)
+	assert.NoError(t, b.Do(ctx, succeed))
+	assert.Equal(t, Closed, b.State())
+}
+
+func TestBreaker_halfOpenLimit(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&now)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		b.Do(ctx, func(context.Context) error { return errors.E(errors.IO) })
+	}
+	now = now.Add(time.Minute)
+
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- b.Do(ctx, func(context.Context) error {
+			<-release
+			return nil
+		})
+	}()
+
+	// Wait for the trial call to be admitted.
+	for b.State() != HalfOpen || b.trialCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	err := b.Do(ctx, func(context.Context) error { return nil })
+	assert.True(t, errors.Is(errors.Transient, err))
+	if e, ok := err.(*errors.Error); assert.True(t, ok) {
+		if open, ok := e.Err.(*OpenError); assert.True(t, ok) {
+			assert.Equal(t, time.Minute, open.RetryAfter())
+		}
+	}
+
+	close(release)
+	assert.NoError(t, <-done)
+	assert.Equal(t, Closed, b.State())
+}
+
+func TestBreaker_cancelled(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&now)
+
+	// Cancelled calls wrap the context error.
+	for i := 0; i < 5; i++ {
+		b.Do(context.Background(), func(ctx context.Context) error {
+			return errors.E(errors.Op("test"), errors.Internal, context.Canceled)
+		})
+	}
+	assert.Equal(t, Closed, b.State())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 5; i++ {
+		b.Do(ctx, func(context.Context) error { return errors.E(errors.Internal, "interrupted") })
+	}
+	assert.Equal(t, Closed, b.State())
+}
+
+func TestBreaker_cancelledFailures(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&now)
+	ctx := context.Background()
+
+	// A cancelled call does not reset the count of consecutive failures.
+	b.Do(ctx, func(context.Context) error { return errors.E(errors.IO) })
+	b.Do(ctx, func(context.Context) error { return errors.E(errors.Internal, context.Canceled) })
+	b.Do(ctx, func(context.Context) error { return errors.E(errors.IO) })
+	assert.Equal(t, Open, b.State())
+}
+
+func TestBreaker_cancelledTrial(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&now)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		b.Do(ctx, func(context.Context) error { return errors.E(errors.IO) })
+	}
+	now = now.Add(time.Minute)
+
+	// A cancelled trial call neither closes nor reopens the circuit, and
+	// frees its slot for the next trial call.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	b.Do(cancelled, func(ctx context.Context) error { return errors.E(errors.Transient, ctx.Err()) })
+	assert.Equal(t, HalfOpen, b.State())
+	assert.Equal(t, 0, b.trialCount())
+
+	called := false
+	assert.NoError(t, b.Do(ctx, func(context.Context) error { called = true; return nil }))
+	assert.True(t, called)
+	assert.Equal(t, Closed, b.State())
+}
+
+func TestBreaker_staleCall(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&now)
+	ctx := context.Background()
+
+	admitted := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- b.Do(ctx, func(context.Context) error {
+			close(admitted)
+			<-release
+			return nil
+		})
+	}()
+	<-admitted
+
+	for i := 0; i < 2; i++ {
+		b.Do(ctx, func(context.Context) error { return errors.E(errors.IO) })
+	}
+	now = now.Add(time.Minute)
+
+	trial := make(chan struct{})
+	trialDone := make(chan error)
+	go func() {
+		trialDone <- b.Do(ctx, func(context.Context) error {
+			<-trial
+			return errors.E(errors.IO)
+		})
+	}()
+	for b.trialCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The call admitted while closed is not a trial call: it neither
+	// closes the circuit nor frees the trial slot.
+	close(release)
+	assert.NoError(t, <-done)
+	assert.Equal(t, HalfOpen, b.State())
+	assert.Equal(t, 1, b.trialCount())
+
+	close(trial)
+	<-trialDone
+	assert.Equal(t, Open, b.State())
+}
+
+func TestOpenError_RetryAfter(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&now)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		b.Do(ctx, func(context.Context) error { return errors.E(errors.IO) })
+	}
+	now = now.Add(20 * time.Second)
+
+	e, ok := b.Err().(*errors.Error)
+	if assert.True(t, ok) {
+		open, ok := e.Err.(*OpenError)
+		if assert.True(t, ok) {
+			assert.Equal(t, 40*time.Second, open.RetryAfter())
+		}
+	}
+}
+
+func (b *Breaker) trialCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.trials
+}
@@ -0,0 +1,170 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/auth"
+	"github.com/danielnegri/tokenapi-go/log"
+	"github.com/danielnegri/tokenapi-go/storage/postgres"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func commandAPIKey() *cobra.Command {
+	var databaseURL string
+
+	cmd := &cobra.Command{
+		Use:   "apikey",
+		Short: "Manage the API keys of the clients",
+		// The flag is bound here rather than at construction, where it
+		// would take over the --database-url flag of serve.
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			_ = viper.BindPFlag("database_url", cmd.Flags().Lookup("database-url"))
+			log.SetLogger(newLogger())
+		},
+	}
+
+	cmd.PersistentFlags().StringVar(&databaseURL, "database-url", postgres.DefaultURL, "database connection string")
+
+	cmd.AddCommand(commandAPIKeyCreate())
+	cmd.AddCommand(commandAPIKeyList())
+	cmd.AddCommand(commandAPIKeyRevoke())
+
+	return cmd
+}
+
+// withKeyStore connects to the storage holding the API keys and calls fn,
+// exiting on error.
+func withKeyStore(fn func(ctx context.Context, keys auth.KeyStore) error) {
+	db, err := postgres.Connect(newStorageConfig())
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := fn(ctx, db); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		db.Close()
+		os.Exit(1)
+	}
+}
+
+func commandAPIKeyCreate() *cobra.Command {
+	var (
+		name   string
+		scopes []string
+	)
+
+	cmd := &cobra.Command{
+		Use:     "create",
+		Short:   "Create an API key and print it",
+		Example: fmt.Sprintf("%s apikey create --name billing --scopes %s,%s", shortDescription, auth.ScopeIssue, auth.ScopeVerify),
+		Args:    cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			parsed, err := auth.ParseScopes(scopes)
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+
+			apiKey, key, err := auth.NewKey(name, parsed)
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+
+			withKeyStore(func(ctx context.Context, keys auth.KeyStore) error {
+				return keys.CreateKey(ctx, key)
+			})
+
+			fmt.Printf("ID:     %s\n", key.ID)
+			fmt.Printf("Scopes: %s\n", joinScopes(key.Scopes))
+			fmt.Printf("Key:    %s\n", apiKey)
+			fmt.Println("The key cannot be shown again: store it now.")
+		},
+	}
+
+	cmd.Flags().StringVar(&name, "name", "", "name of the client holding the key")
+	cmd.Flags().StringSliceVar(&scopes, "scopes", []string{string(auth.ScopeIssue)}, "comma-separated scopes granted to the key")
+
+	return cmd
+}
+
+func commandAPIKeyList() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List the API keys",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			withKeyStore(func(ctx context.Context, keys auth.KeyStore) error {
+				list, err := keys.ListKeys(ctx)
+				if err != nil {
+					return err
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				_, _ = fmt.Fprintln(w, "ID\tNAME\tSCOPES\tCREATED\tREVOKED")
+				for _, key := range list {
+					revoked := "-"
+					if key.Revoked() {
+						revoked = key.RevokedAt.Format(time.RFC3339)
+					}
+					_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+						key.ID, key.Name, joinScopes(key.Scopes), key.CreatedAt.Format(time.RFC3339), revoked)
+				}
+				return w.Flush()
+			})
+		},
+	}
+}
+
+func commandAPIKeyRevoke() *cobra.Command {
+	return &cobra.Command{
+		Use:     "revoke ID...",
+		Short:   "Revoke API keys",
+		Example: fmt.Sprintf("%s apikey revoke 3f2a9c1e5b7d4f60", shortDescription),
+		Args:    cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			withKeyStore(func(ctx context.Context, keys auth.KeyStore) error {
+				for _, id := range args {
+					if err := keys.RevokeKey(ctx, id); err != nil {
+						return err
+					}
+					fmt.Printf("Revoked %s\n", id)
+				}
+				return nil
+			})
+		},
+	}
+}
+
+func joinScopes(scopes []auth.Scope) string {
+	names := make([]string, len(scopes))
+	for i, scope := range scopes {
+		names[i] = string(scope)
+	}
+	return strings.Join(names, ",")
+}
@@ -15,37 +15,83 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/url"
 	"os"
+	"regexp"
 
 	"github.com/go-pg/pg/v10"
 
+	"github.com/danielnegri/tokenapi-go/auth"
+	"github.com/danielnegri/tokenapi-go/breaker"
+	"github.com/danielnegri/tokenapi-go/ledger"
 	"github.com/danielnegri/tokenapi-go/log"
 	"github.com/danielnegri/tokenapi-go/net"
+	"github.com/danielnegri/tokenapi-go/quota"
+	"github.com/danielnegri/tokenapi-go/retry"
 	"github.com/danielnegri/tokenapi-go/server"
 	"github.com/danielnegri/tokenapi-go/source"
+	"github.com/danielnegri/tokenapi-go/tracing"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
 func newLogger() logrus.FieldLogger {
+	if err := log.SetRedaction(viper.GetString("log_redact")); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
 	return log.New(viper.GetString("log_level"), viper.GetString("log_format"))
 }
 
 func newServerConfig() *server.Config {
 	cfg := &server.Config{}
+	cfg.AuthDisabled = !viper.GetBool("auth")
 	cfg.Concurrency = viper.GetInt("concurrency")
 	cfg.Debug = viper.GetString("log_level") == "debug"
+	cfg.DrainTimeout = viper.GetDuration("drain_timeout")
+	cfg.GRPCPort = viper.GetInt("grpc_port")
+	cfg.HealthCache = viper.GetDuration("health_cache")
+	cfg.HealthTimeout = viper.GetDuration("health_timeout")
 	cfg.HTTPServer = &net.ServerConfig{}
 	cfg.HTTPServer.HTTPPort = viper.GetInt("port")
+	cfg.MetricsPort = viper.GetInt("metrics_port")
+	cfg.ReorderWindow = viper.GetInt("reorder_window")
+
+	if failures := viper.GetInt("breaker_failures"); failures > 0 {
+		cfg.Breaker = &breaker.Config{
+			FailureThreshold: failures,
+			HalfOpenRequests: viper.GetInt("breaker_half_open"),
+			OpenTimeout:      viper.GetDuration("breaker_timeout"),
+		}
+	}
+
+	cfg.StorageRetry = newRetryPolicy("storage")
+
 	return cfg
 }
 
+// newRetryPolicy reads the retry policy registered by addRetryFlags for the
+// given dependency.
+func newRetryPolicy(prefix string) *retry.Policy {
+	return &retry.Policy{
+		MaxAttempts: viper.GetInt(prefix+"_retry") + 1,
+		BaseBackoff: viper.GetDuration(prefix + "_retry_backoff"),
+		MaxBackoff:  viper.GetDuration(prefix + "_retry_max_backoff"),
+		Jitter:      viper.GetFloat64(prefix + "_retry_jitter"),
+		Deadline:    viper.GetDuration(prefix + "_retry_deadline"),
+	}
+}
+
 func newSourceConfig() *source.Config {
 	cfg := &source.Config{}
-	cfg.Retry = viper.GetInt("source_retry")
+	cfg.Retry = newRetryPolicy("source")
+	cfg.Retry.RetryStatus = viper.GetIntSlice("source_retry_status")
 	cfg.Timeout = viper.GetDuration("source_timeout")
+	cfg.Trace = viper.GetBool("source_trace")
 
 	rawurl := viper.GetString("source_url")
 	srcURL, err := url.Parse(rawurl)
@@ -56,6 +102,50 @@ func newSourceConfig() *source.Config {
 
 	cfg.URL = srcURL
 
+	auth := &source.AuthConfig{
+		Header:      viper.GetString("source_auth_header"),
+		TokenEnv:    viper.GetString("source_auth_token_env"),
+		TokenFile:   viper.GetString("source_auth_token_file"),
+		HMACKeyEnv:  viper.GetString("source_hmac_key_env"),
+		HMACKeyFile: viper.GetString("source_hmac_key_file"),
+		CAFile:      viper.GetString("source_tls_ca"),
+		CertFile:    viper.GetString("source_tls_cert"),
+		KeyFile:     viper.GetString("source_tls_key"),
+	}
+
+	if *auth != (source.AuthConfig{Header: auth.Header}) {
+		if err := auth.Validate(); err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		cfg.Auth = auth
+	}
+
+	requests, tokens := viper.GetFloat64("source_rate_requests"), viper.GetFloat64("source_rate_tokens")
+	if requests > 0 || tokens > 0 {
+		cfg.RateLimit = &source.RateLimit{
+			Requests:     requests,
+			RequestBurst: viper.GetInt("source_rate_request_burst"),
+			Tokens:       tokens,
+			TokenBurst:   viper.GetInt("source_rate_token_burst"),
+			MaxWait:      viper.GetDuration("source_rate_wait"),
+		}
+	}
+
+	cfg.Mode = viper.GetString("source_mode")
+	cfg.Fixture = viper.GetString("source_fixture")
+	switch cfg.Mode {
+	case source.ModeLive:
+	case source.ModeRecord, source.ModeReplay:
+		if cfg.Fixture == "" {
+			_, _ = fmt.Fprintf(os.Stderr, "source mode %q requires a fixture file\n", cfg.Mode)
+			os.Exit(2)
+		}
+	default:
+		_, _ = fmt.Fprintf(os.Stderr, "unknown source mode %q\n", cfg.Mode)
+		os.Exit(2)
+	}
+
 	return cfg
 }
 
@@ -69,3 +159,160 @@ func newStorageConfig() *pg.Options {
 
 	return cfg
 }
+
+func newTracingConfig() *tracing.Config {
+	ratio := viper.GetFloat64("tracing_sample_ratio")
+	cfg := &tracing.Config{
+		Exporter:    viper.GetString("tracing_exporter"),
+		Endpoint:    viper.GetString("tracing_endpoint"),
+		Insecure:    viper.GetBool("tracing_insecure"),
+		File:        viper.GetString("tracing_file"),
+		SampleRatio: &ratio,
+	}
+
+	switch cfg.Exporter {
+	case tracing.ExporterNone, tracing.ExporterOTLP:
+	case tracing.ExporterFile:
+		if cfg.File == "" {
+			_, _ = fmt.Fprintln(os.Stderr, "tracing exporter \"file\" requires --tracing-file")
+			os.Exit(2)
+		}
+	default:
+		_, _ = fmt.Fprintf(os.Stderr, "unknown tracing exporter %q\n", cfg.Exporter)
+		os.Exit(2)
+	}
+
+	return cfg
+}
+
+func newJWTConfig() *auth.JWTConfig {
+	cfg := &auth.JWTConfig{
+		JWKSFile:    viper.GetString("jwt_jwks_file"),
+		JWKSURL:     viper.GetString("jwt_jwks_url"),
+		JWKSRefresh: viper.GetDuration("jwt_jwks_refresh"),
+		Issuer:      viper.GetString("jwt_issuer"),
+		Audience:    viper.GetString("jwt_audience"),
+		Leeway:      viper.GetDuration("jwt_leeway"),
+	}
+
+	switch {
+	case cfg.JWKSFile == "" && cfg.JWKSURL == "":
+		return nil
+	case cfg.JWKSFile != "" && cfg.JWKSURL != "":
+		_, _ = fmt.Fprintln(os.Stderr, "--jwt-jwks-file and --jwt-jwks-url are mutually exclusive")
+		os.Exit(2)
+	case cfg.Issuer == "" || cfg.Audience == "":
+		_, _ = fmt.Fprintln(os.Stderr, "--jwt-issuer and --jwt-audience are required with JWT authentication")
+		os.Exit(2)
+	}
+
+	return cfg
+}
+
+// newQuotaConfig reads the quota policies from --quota-file, the default
+// policy being overridden by the --quota-minute, --quota-day and
+// --quota-total flags.
+func newQuotaConfig() *quota.Config {
+	cfg := &quota.Config{}
+	if path := viper.GetString("quota_file"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, cfg)
+		}
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "invalid quota file %s: %v\n", path, err)
+			os.Exit(2)
+		}
+	}
+
+	if v := viper.GetInt64("quota_minute"); v > 0 {
+		cfg.Default.PerMinute = v
+	}
+	if v := viper.GetInt64("quota_day"); v > 0 {
+		cfg.Default.PerDay = v
+	}
+	if v := viper.GetInt64("quota_total"); v > 0 {
+		cfg.Default.Total = v
+	}
+
+	if cfg.Default == (quota.Policy{}) && len(cfg.Clients) == 0 {
+		return nil
+	}
+
+	return cfg
+}
+
+// newLimits reads the batch size limits from --limits-file, the default
+// being overridden by --max-size.
+func newLimits() *server.Limits {
+	limits := &server.Limits{}
+	if path := viper.GetString("limits_file"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, limits)
+		}
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "invalid limits file %s: %v\n", path, err)
+			os.Exit(2)
+		}
+	}
+
+	if max := viper.GetInt("max_size"); max != ledger.MaxBatchSize {
+		limits.MaxSize = max
+	}
+
+	if err := limits.Validate(); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	return limits
+}
+
+func newAdminConfig() *net.AdminConfig {
+	cfg := &net.AdminConfig{
+		Host:   viper.GetString("admin_host"),
+		Port:   viper.GetInt("admin_port"),
+		Socket: viper.GetString("admin_socket"),
+		Config: redactedSettings,
+
+		WriteTimeout: viper.GetDuration("admin_write_timeout"),
+	}
+
+	if cfg.Port == 0 && cfg.Socket == "" {
+		return nil
+	}
+
+	return cfg
+}
+
+// secretKey matches the settings whose values are secrets.
+var secretKey = regexp.MustCompile(`(?i)password|secret`)
+
+// redactedSettings returns every setting with secrets redacted: passwords
+// embedded in URLs, settings named after secrets and anything shaped like
+// a token.
+func redactedSettings() interface{} {
+	settings := viper.AllSettings()
+	for key, value := range settings {
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		if secretKey.MatchString(key) {
+			settings[key] = "[redacted]"
+			continue
+		}
+
+		if u, err := url.Parse(s); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), "redacted")
+				s = u.String()
+			}
+		}
+		settings[key] = log.Redact(s)
+	}
+
+	return settings
+}
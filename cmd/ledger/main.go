@@ -45,6 +45,8 @@ func commandRoot() *cobra.Command {
 	viper.SetEnvPrefix(envPrefix)
 	viper.AutomaticEnv()
 
+	rootCmd.AddCommand(commandAPIKey())
+	rootCmd.AddCommand(commandMockSource())
 	rootCmd.AddCommand(commandServe())
 	rootCmd.AddCommand(version.NewCommand(longDescription))
 
@@ -0,0 +1,91 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/log"
+	"github.com/danielnegri/tokenapi-go/net"
+	"github.com/danielnegri/tokenapi-go/source/mock"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func commandMockSource() *cobra.Command {
+	var (
+		dashRate      float64
+		duplicateRate float64
+		errorRate     float64
+		latency       time.Duration
+		port          int
+		seed          int64
+		truncateRate  float64
+	)
+
+	cmd := cobra.Command{
+		Use:     "mock-source",
+		Short:   "Start a fake Token source for local development and tests",
+		Example: fmt.Sprintf("%s mock-source --port %d --error-rate 0.1", shortDescription, mock.DefaultPort),
+		Run: func(cmd *cobra.Command, args []string) {
+			log.SetLogger(newLogger())
+
+			seed := viper.GetInt64("mock_source_seed")
+			if seed == 0 {
+				seed = time.Now().UnixNano()
+			}
+
+			handler := mock.NewHandler(&mock.Config{
+				DashRate:      viper.GetFloat64("mock_source_dash_rate"),
+				DuplicateRate: viper.GetFloat64("mock_source_duplicate_rate"),
+				ErrorRate:     viper.GetFloat64("mock_source_error_rate"),
+				Latency:       viper.GetDuration("mock_source_latency"),
+				Seed:          seed,
+				TruncateRate:  viper.GetFloat64("mock_source_truncate_rate"),
+			})
+
+			svr := net.NewServer(&net.ServerConfig{HTTPPort: viper.GetInt("mock_source_port")}, handler)
+			if err := svr.Run(); err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	cmd.Flags().Float64Var(&dashRate, "dash-rate", 0, "share of tokens containing a dash")
+	_ = viper.BindPFlag("mock_source_dash_rate", cmd.Flags().Lookup("dash-rate"))
+
+	cmd.Flags().Float64Var(&duplicateRate, "duplicate-rate", 0, "share of tokens repeating an earlier token of the response")
+	_ = viper.BindPFlag("mock_source_duplicate_rate", cmd.Flags().Lookup("duplicate-rate"))
+
+	cmd.Flags().Float64Var(&errorRate, "error-rate", 0, "share of requests answered with 500")
+	_ = viper.BindPFlag("mock_source_error_rate", cmd.Flags().Lookup("error-rate"))
+
+	cmd.Flags().DurationVar(&latency, "latency", 0, "delay added before every response")
+	_ = viper.BindPFlag("mock_source_latency", cmd.Flags().Lookup("latency"))
+
+	cmd.Flags().IntVar(&port, "port", mock.DefaultPort, "HTTP server port")
+	_ = viper.BindPFlag("mock_source_port", cmd.Flags().Lookup("port"))
+
+	cmd.Flags().Int64Var(&seed, "seed", 0, "seed of the generated tokens and injected failures (0 picks a random seed)")
+	_ = viper.BindPFlag("mock_source_seed", cmd.Flags().Lookup("seed"))
+
+	cmd.Flags().Float64Var(&truncateRate, "truncate-rate", 0, "share of responses cut off before the connection is dropped")
+	_ = viper.BindPFlag("mock_source_truncate_rate", cmd.Flags().Lookup("truncate-rate"))
+
+	return &cmd
+}
@@ -18,27 +18,83 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strings"
 	"time"
 
+	"github.com/danielnegri/tokenapi-go/auth"
+	"github.com/danielnegri/tokenapi-go/breaker"
 	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/ledger"
 	"github.com/danielnegri/tokenapi-go/log"
+	"github.com/danielnegri/tokenapi-go/net"
+	"github.com/danielnegri/tokenapi-go/retry"
 	"github.com/danielnegri/tokenapi-go/server"
 	"github.com/danielnegri/tokenapi-go/source"
 	"github.com/danielnegri/tokenapi-go/storage/postgres"
+	"github.com/danielnegri/tokenapi-go/tracing"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 func commandServe() *cobra.Command {
 	var (
-		concurrency   int
-		databaseURL   string
-		logFormat     string
-		logLevel      string
-		port          int
-		sourceRetry   int
-		sourceTimeout time.Duration
-		sourceURL     string
+		adminHost         string
+		adminPort         int
+		adminSocket       string
+		adminWriteTimeout time.Duration
+		authEnabled       bool
+		breakerFailures   int
+		breakerHalfOpen   int
+		breakerTimeout    time.Duration
+		concurrency       int
+		databaseURL       string
+		drainTimeout      time.Duration
+		grpcPort          int
+		healthCache       time.Duration
+		healthTimeout     time.Duration
+		jwtAudience       string
+		jwtIssuer         string
+		jwtJWKSFile       string
+		jwtJWKSRefresh    time.Duration
+		jwtJWKSURL        string
+		jwtLeeway         time.Duration
+		logFormat         string
+		logLevel          string
+		limitsFile        string
+		logRedact         string
+		maxSize           int
+		metricsPort       int
+		port              int
+		quotaDay          int64
+		quotaFile         string
+		quotaMinute       int64
+		quotaTotal        int64
+		reorderWindow     int
+		sourceAuthEnv     string
+		sourceAuthFile    string
+		sourceAuthHdr     string
+		sourceFixture     string
+		sourceHMACEnv     string
+		sourceHMACFile    string
+		sourceMode        string
+		sourceRateBurst   int
+		sourceRateReqs    float64
+		sourceRateTBurst  int
+		sourceRateToks    float64
+		sourceRateWait    time.Duration
+		sourceRetry       int
+		storageRetry      int
+		sourceTimeout     time.Duration
+		sourceTLSCA       string
+		sourceTLSCert     string
+		sourceTLSKey      string
+		sourceTrace       bool
+		sourceURL         string
+		tracingEndpoint   string
+		tracingExporter   string
+		tracingFile       string
+		tracingInsecure   bool
+		tracingRatio      float64
 	)
 
 	cmd := cobra.Command{
@@ -49,6 +105,11 @@ func commandServe() *cobra.Command {
 			serverCfg := newServerConfig()
 			serverCfg.Source = newSourceConfig()
 			serverCfg.Storage = newStorageConfig()
+			serverCfg.Tracing = newTracingConfig()
+			serverCfg.Admin = newAdminConfig()
+			serverCfg.JWT = newJWTConfig()
+			serverCfg.Quota = newQuotaConfig()
+			serverCfg.Limits = newLimits()
 
 			log.SetLogger(newLogger())
 			svr := server.New(serverCfg)
@@ -61,29 +122,207 @@ func commandServe() *cobra.Command {
 		},
 	}
 
+	cmd.Flags().IntVar(&adminPort, "admin-port", 0, "port of the admin server serving pprof, runtime stats, config and log level (0 disables)")
+	_ = viper.BindPFlag("admin_port", cmd.Flags().Lookup("admin-port"))
+
+	cmd.Flags().StringVar(&adminHost, "admin-host", net.DefaultAdminHost, "interface of the admin server; it has no authentication, so keep it off public interfaces")
+	_ = viper.BindPFlag("admin_host", cmd.Flags().Lookup("admin-host"))
+
+	cmd.Flags().DurationVar(&adminWriteTimeout, "admin-write-timeout", net.DefaultAdminWriteTimeout, "write timeout of the admin server, which bounds the length of profiles")
+	_ = viper.BindPFlag("admin_write_timeout", cmd.Flags().Lookup("admin-write-timeout"))
+
+	cmd.Flags().StringVar(&adminSocket, "admin-socket", "", "unix socket of the admin server, used instead of --admin-port")
+	_ = viper.BindPFlag("admin_socket", cmd.Flags().Lookup("admin-socket"))
+
+	cmd.Flags().BoolVar(&authEnabled, "auth", true, "require an API key to issue tokens; see the apikey command")
+	_ = viper.BindPFlag("auth", cmd.Flags().Lookup("auth"))
+
+	cmd.Flags().IntVar(&breakerFailures, "breaker-failures", breaker.DefaultFailureThreshold, "consecutive failures that open a circuit breaker (0 disables)")
+	_ = viper.BindPFlag("breaker_failures", cmd.Flags().Lookup("breaker-failures"))
+
+	cmd.Flags().IntVar(&breakerHalfOpen, "breaker-half-open", breaker.DefaultHalfOpenRequests, "trial calls allowed through a half-open circuit breaker")
+	_ = viper.BindPFlag("breaker_half_open", cmd.Flags().Lookup("breaker-half-open"))
+
+	cmd.Flags().DurationVar(&breakerTimeout, "breaker-timeout", breaker.DefaultOpenTimeout, "time a circuit breaker stays open")
+	_ = viper.BindPFlag("breaker_timeout", cmd.Flags().Lookup("breaker-timeout"))
+
 	cmd.Flags().IntVar(&concurrency, "concurrency", runtime.NumCPU(), "number of concurrent workers")
 	_ = viper.BindPFlag("concurrency", cmd.Flags().Lookup("concurrency"))
 
 	cmd.Flags().StringVar(&databaseURL, "database-url", postgres.DefaultURL, "database connection string")
 	_ = viper.BindPFlag("database_url", cmd.Flags().Lookup("database-url"))
 
+	cmd.Flags().DurationVar(&drainTimeout, "drain-timeout", server.DefaultDrainTimeout, "how long in-flight streams may run on shutdown before being cancelled")
+	_ = viper.BindPFlag("drain_timeout", cmd.Flags().Lookup("drain-timeout"))
+
+	cmd.Flags().IntVar(&grpcPort, "grpc-port", 0, "port serving the gRPC API (0 disables it)")
+	_ = viper.BindPFlag("grpc_port", cmd.Flags().Lookup("grpc-port"))
+
+	cmd.Flags().DurationVar(&healthCache, "health-cache", server.DefaultHealthCache, "how long readiness check results are reused")
+	_ = viper.BindPFlag("health_cache", cmd.Flags().Lookup("health-cache"))
+
+	cmd.Flags().DurationVar(&healthTimeout, "health-timeout", server.DefaultHealthTimeout, "timeout of each readiness dependency check")
+	_ = viper.BindPFlag("health_timeout", cmd.Flags().Lookup("health-timeout"))
+
+	cmd.Flags().StringVar(&jwtAudience, "jwt-audience", "", "audience required in bearer JWTs; must be set with JWT authentication")
+	_ = viper.BindPFlag("jwt_audience", cmd.Flags().Lookup("jwt-audience"))
+
+	cmd.Flags().StringVar(&jwtIssuer, "jwt-issuer", "", "issuer required in bearer JWTs; must be set with JWT authentication")
+	_ = viper.BindPFlag("jwt_issuer", cmd.Flags().Lookup("jwt-issuer"))
+
+	cmd.Flags().StringVar(&jwtJWKSFile, "jwt-jwks-file", "", "JWKS file holding the keys of bearer JWTs; enables JWT authentication")
+	_ = viper.BindPFlag("jwt_jwks_file", cmd.Flags().Lookup("jwt-jwks-file"))
+
+	cmd.Flags().DurationVar(&jwtJWKSRefresh, "jwt-jwks-refresh", auth.DefaultJWKSRefresh, "how often keys are reloaded from --jwt-jwks-url")
+	_ = viper.BindPFlag("jwt_jwks_refresh", cmd.Flags().Lookup("jwt-jwks-refresh"))
+
+	cmd.Flags().StringVar(&jwtJWKSURL, "jwt-jwks-url", "", "JWKS URL holding the keys of bearer JWTs; enables JWT authentication")
+	_ = viper.BindPFlag("jwt_jwks_url", cmd.Flags().Lookup("jwt-jwks-url"))
+
+	cmd.Flags().DurationVar(&jwtLeeway, "jwt-leeway", auth.DefaultLeeway, "clock skew tolerated on the expiry of bearer JWTs")
+	_ = viper.BindPFlag("jwt_leeway", cmd.Flags().Lookup("jwt-leeway"))
+
+	cmd.Flags().StringVar(&limitsFile, "limits-file", "", "JSON file with the batch size limits of routes and clients")
+	_ = viper.BindPFlag("limits_file", cmd.Flags().Lookup("limits-file"))
+
 	cmd.Flags().StringVar(&logFormat, "log-format", log.DefaultFormat, "logger format")
 	_ = viper.BindPFlag("log_format", cmd.Flags().Lookup("log-format"))
 
 	cmd.Flags().StringVar(&logLevel, "log-level", log.DefaultLevel, "logger level")
 	_ = viper.BindPFlag("log_level", cmd.Flags().Lookup("log-level"))
 
+	cmd.Flags().StringVar(&logRedact, "log-redact", log.DefaultRedaction, "how tokens are redacted in logs and errors (hash, mask)")
+	_ = viper.BindPFlag("log_redact", cmd.Flags().Lookup("log-redact"))
+
+	cmd.Flags().IntVar(&maxSize, "max-size", ledger.MaxBatchSize, "largest batch of tokens a client may request")
+	_ = viper.BindPFlag("max_size", cmd.Flags().Lookup("max-size"))
+
+	cmd.Flags().IntVar(&metricsPort, "metrics-port", 0, "port serving Prometheus metrics (default /metrics on the HTTP server port)")
+	_ = viper.BindPFlag("metrics_port", cmd.Flags().Lookup("metrics-port"))
+
 	cmd.Flags().IntVar(&port, "port", server.DefaultPort, "HTTP server port")
 	_ = viper.BindPFlag("port", cmd.Flags().Lookup("port"))
 
+	cmd.Flags().Int64Var(&quotaDay, "quota-day", 0, "tokens a client may issue per UTC day (0 is unlimited)")
+	_ = viper.BindPFlag("quota_day", cmd.Flags().Lookup("quota-day"))
+
+	cmd.Flags().StringVar(&quotaFile, "quota-file", "", "JSON file with the default quota policy and the policies of given clients")
+	_ = viper.BindPFlag("quota_file", cmd.Flags().Lookup("quota-file"))
+
+	cmd.Flags().Int64Var(&quotaMinute, "quota-minute", 0, "tokens a client may issue per minute (0 is unlimited)")
+	_ = viper.BindPFlag("quota_minute", cmd.Flags().Lookup("quota-minute"))
+
+	cmd.Flags().Int64Var(&quotaTotal, "quota-total", 0, "tokens a client may issue in total (0 is unlimited)")
+	_ = viper.BindPFlag("quota_total", cmd.Flags().Lookup("quota-total"))
+
+	cmd.Flags().StringVar(&sourceAuthHdr, "source-auth-header", "", "token source header carrying the credential (default Authorization: Bearer)")
+	_ = viper.BindPFlag("source_auth_header", cmd.Flags().Lookup("source-auth-header"))
+
+	cmd.Flags().IntVar(&reorderWindow, "reorder-window", server.DefaultReorderWindow, "results an ordered request may buffer while waiting for an earlier token")
+	_ = viper.BindPFlag("reorder_window", cmd.Flags().Lookup("reorder-window"))
+
+	cmd.Flags().StringVar(&sourceAuthEnv, "source-auth-token-env", "", "environment variable holding the token source credential")
+	_ = viper.BindPFlag("source_auth_token_env", cmd.Flags().Lookup("source-auth-token-env"))
+
+	cmd.Flags().StringVar(&sourceAuthFile, "source-auth-token-file", "", "file holding the token source credential")
+	_ = viper.BindPFlag("source_auth_token_file", cmd.Flags().Lookup("source-auth-token-file"))
+
+	cmd.Flags().StringVar(&sourceFixture, "source-fixture", "", "token source fixture file to record to or replay from")
+	_ = viper.BindPFlag("source_fixture", cmd.Flags().Lookup("source-fixture"))
+
+	cmd.Flags().StringVar(&sourceHMACEnv, "source-hmac-key-env", "", "environment variable holding the key signing token source requests")
+	_ = viper.BindPFlag("source_hmac_key_env", cmd.Flags().Lookup("source-hmac-key-env"))
+
+	cmd.Flags().StringVar(&sourceHMACFile, "source-hmac-key-file", "", "file holding the key signing token source requests")
+	_ = viper.BindPFlag("source_hmac_key_file", cmd.Flags().Lookup("source-hmac-key-file"))
+
+	cmd.Flags().StringVar(&sourceMode, "source-mode", source.ModeLive, "token source transport mode (live, record, replay)")
+	_ = viper.BindPFlag("source_mode", cmd.Flags().Lookup("source-mode"))
+
+	cmd.Flags().IntVar(&sourceRateBurst, "source-rate-request-burst", 0, "token source requests that may be sent at once (default one second worth)")
+	_ = viper.BindPFlag("source_rate_request_burst", cmd.Flags().Lookup("source-rate-request-burst"))
+
+	cmd.Flags().Float64Var(&sourceRateReqs, "source-rate-requests", 0, "token source requests per second (0 disables)")
+	_ = viper.BindPFlag("source_rate_requests", cmd.Flags().Lookup("source-rate-requests"))
+
+	cmd.Flags().IntVar(&sourceRateTBurst, "source-rate-token-burst", 0, "tokens that may be requested from the token source at once (default one second worth)")
+	_ = viper.BindPFlag("source_rate_token_burst", cmd.Flags().Lookup("source-rate-token-burst"))
+
+	cmd.Flags().Float64Var(&sourceRateToks, "source-rate-tokens", 0, "tokens requested from the token source per second (0 disables)")
+	_ = viper.BindPFlag("source_rate_tokens", cmd.Flags().Lookup("source-rate-tokens"))
+
+	cmd.Flags().DurationVar(&sourceRateWait, "source-rate-wait", source.DefaultRateLimitWait, "time a request may queue for the token source rate limiter")
+	_ = viper.BindPFlag("source_rate_wait", cmd.Flags().Lookup("source-rate-wait"))
+
 	cmd.Flags().IntVar(&sourceRetry, "source-retry", source.DefaultRetry, "token source max retries")
 	_ = viper.BindPFlag("source_retry", cmd.Flags().Lookup("source-retry"))
 
+	cmd.Flags().IntSlice("source-retry-status", retry.DefaultRetryStatus, "token source HTTP status codes that are retried")
+	_ = viper.BindPFlag("source_retry_status", cmd.Flags().Lookup("source-retry-status"))
+
+	addRetryFlags(&cmd, "source", "token source")
+
 	cmd.Flags().DurationVar(&sourceTimeout, "source-timeout", source.DefaultTimeout, "token source timeout")
 	_ = viper.BindPFlag("source_timeout", cmd.Flags().Lookup("source-timeout"))
 
+	cmd.Flags().BoolVar(&sourceTrace, "source-trace", true, "record the latency breakdown of token source requests")
+	_ = viper.BindPFlag("source_trace", cmd.Flags().Lookup("source-trace"))
+
+	cmd.Flags().StringVar(&sourceTLSCA, "source-tls-ca", "", "PEM bundle used to verify the token source")
+	_ = viper.BindPFlag("source_tls_ca", cmd.Flags().Lookup("source-tls-ca"))
+
+	cmd.Flags().StringVar(&sourceTLSCert, "source-tls-cert", "", "PEM client certificate presented to the token source")
+	_ = viper.BindPFlag("source_tls_cert", cmd.Flags().Lookup("source-tls-cert"))
+
+	cmd.Flags().StringVar(&sourceTLSKey, "source-tls-key", "", "PEM key of the client certificate")
+	_ = viper.BindPFlag("source_tls_key", cmd.Flags().Lookup("source-tls-key"))
+
 	cmd.Flags().StringVar(&sourceURL, "source-url", source.DefaultURL, "token source address")
 	_ = viper.BindPFlag("source_url", cmd.Flags().Lookup("source-url"))
 
+	cmd.Flags().IntVar(&storageRetry, "storage-retry", postgres.DefaultRetry, "storage max retries on transient errors")
+	_ = viper.BindPFlag("storage_retry", cmd.Flags().Lookup("storage-retry"))
+
+	addRetryFlags(&cmd, "storage", "storage")
+
+	cmd.Flags().StringVar(&tracingEndpoint, "tracing-endpoint", tracing.DefaultEndpoint, "OTLP collector address")
+	_ = viper.BindPFlag("tracing_endpoint", cmd.Flags().Lookup("tracing-endpoint"))
+
+	cmd.Flags().StringVar(&tracingExporter, "tracing-exporter", tracing.ExporterNone, "span exporter (none, otlp, file)")
+	_ = viper.BindPFlag("tracing_exporter", cmd.Flags().Lookup("tracing-exporter"))
+
+	cmd.Flags().StringVar(&tracingFile, "tracing-file", "", "file the file exporter appends spans to")
+	_ = viper.BindPFlag("tracing_file", cmd.Flags().Lookup("tracing-file"))
+
+	cmd.Flags().BoolVar(&tracingInsecure, "tracing-insecure", false, "connect to the OTLP collector without TLS")
+	_ = viper.BindPFlag("tracing_insecure", cmd.Flags().Lookup("tracing-insecure"))
+
+	cmd.Flags().Float64Var(&tracingRatio, "tracing-sample-ratio", tracing.DefaultSampleRatio, "share of new traces recorded")
+	_ = viper.BindPFlag("tracing_sample_ratio", cmd.Flags().Lookup("tracing-sample-ratio"))
+
 	return &cmd
 }
+
+// addRetryFlags registers the backoff flags of the retry policy used for the
+// given dependency. The number of retries is registered by the caller.
+func addRetryFlags(cmd *cobra.Command, prefix, name string) {
+	flag := func(suffix string) (string, string) {
+		return prefix + "-retry-" + suffix, prefix + "_retry_" + strings.ReplaceAll(suffix, "-", "_")
+	}
+
+	backoff, key := flag("backoff")
+	cmd.Flags().Duration(backoff, retry.DefaultBaseBackoff, name+" initial retry backoff")
+	_ = viper.BindPFlag(key, cmd.Flags().Lookup(backoff))
+
+	deadline, key := flag("deadline")
+	cmd.Flags().Duration(deadline, 0, name+" total time allowed for all attempts (0 disables)")
+	_ = viper.BindPFlag(key, cmd.Flags().Lookup(deadline))
+
+	jitter, key := flag("jitter")
+	cmd.Flags().Float64(jitter, retry.DefaultJitter, name+" fraction of each retry backoff that is randomized")
+	_ = viper.BindPFlag(key, cmd.Flags().Lookup(jitter))
+
+	maxBackoff, key := flag("max-backoff")
+	cmd.Flags().Duration(maxBackoff, retry.DefaultMaxBackoff, name+" maximum retry backoff")
+	_ = viper.BindPFlag(key, cmd.Flags().Lookup(maxBackoff))
+}
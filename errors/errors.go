@@ -16,6 +16,7 @@ package errors
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"runtime"
@@ -42,6 +43,10 @@ type Error struct {
 	// The underlying error that triggered this one, if any.
 	Err error
 
+	// RequestID identifies the request that caused the error. It is taken
+	// from a context.Context passed to E.
+	RequestID string
+
 	// Stack information; used only when the 'debug' build tag is set.
 	stack
 }
@@ -80,6 +85,7 @@ const (
 	Private                // Information withheld.
 	Internal               // Internal error or inconsistency.
 	Transient              // A transient error.
+	Exhausted              // A quota or limit was exhausted.
 )
 
 func (k Kind) String() string {
@@ -102,6 +108,8 @@ func (k Kind) String() string {
 		return "internal error"
 	case Transient:
 		return "transient error"
+	case Exhausted:
+		return "resource exhausted"
 	}
 	return "unknown error kind"
 }
@@ -121,6 +129,8 @@ func E(args ...interface{}) error {
 			e.Err = Str(arg)
 		case Kind:
 			e.Kind = arg
+		case context.Context:
+			e.RequestID = log.RequestID(arg)
 		case *Error:
 			// Make a copy
 			copy := *arg
@@ -146,6 +156,14 @@ func E(args ...interface{}) error {
 		prev.Token = ""
 	}
 
+	// Keep the request ID on the outermost error only.
+	if e.RequestID == "" {
+		e.RequestID = prev.RequestID
+	}
+	if prev.RequestID == e.RequestID {
+		prev.RequestID = ""
+	}
+
 	// The previous error was also one of ours. Suppress duplications
 	// so the message won't contain the same kind twice.
 	if prev.Kind == e.Kind {
@@ -176,7 +194,7 @@ func (e *Error) Error() string {
 	}
 	if e.Token != "" {
 		pad(b, ": ")
-		b.WriteString(string(e.Token))
+		b.WriteString(log.RedactToken(string(e.Token)))
 	}
 	if e.Kind != 0 {
 		pad(b, ": ")
@@ -197,7 +215,13 @@ func (e *Error) Error() string {
 	if b.Len() == 0 {
 		return "no error"
 	}
-	return b.String()
+	if e.RequestID != "" {
+		b.WriteString(" (request ")
+		b.WriteString(e.RequestID)
+		b.WriteString(")")
+	}
+	// Underlying errors, such as database errors, may quote tokens too.
+	return log.Redact(b.String())
 }
 
 // Recreate the errors.New functionality of the standard Go errors package
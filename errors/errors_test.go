@@ -18,11 +18,14 @@
 package errors
 
 import (
+	"context"
 	"os"
 	"os/exec"
+	"strings"
 	"testing"
 
 	"github.com/danielnegri/tokenapi-go/ledger"
+	"github.com/danielnegri/tokenapi-go/log"
 )
 
 func TestDebug(t *testing.T) {
@@ -80,7 +83,8 @@ func TestSeparator(t *testing.T) {
 	// Nested error.
 	e2 := E(Op("Write"), token, Other, e1)
 
-	want := "Write: 3oMUY0bSsieok9GKuSQKpQ: I/O error:: Get: network unreachable"
+	// The token is redacted.
+	want := "Write: " + log.RedactToken(string(token)) + ": I/O error:: Get: network unreachable"
 	got := errorAsString(e2)
 	if got != want {
 		t.Errorf("expected %q; got %q", want, e2)
@@ -98,3 +102,23 @@ func errorAsString(err error) string {
 	}
 	return err.Error()
 }
+
+func TestRequestID(t *testing.T) {
+	ctx := log.WithRequestID(context.Background(), "abc123")
+
+	inner := E(Op("Insert"), ctx, IO, "network unreachable")
+	outer := E(Op("Handle"), inner)
+
+	e := outer.(*Error)
+	if e.RequestID != "abc123" {
+		t.Errorf("expected request ID %q; got %q", "abc123", e.RequestID)
+	}
+	if id := e.Err.(*Error).RequestID; id != "" {
+		t.Errorf("expected request ID only on the outer error; got %q", id)
+	}
+
+	msg := outer.Error()
+	if !strings.HasSuffix(msg, " (request abc123)") || strings.Count(msg, "abc123") != 1 {
+		t.Errorf("expected request ID once at the end of %q", msg)
+	}
+}
@@ -8,10 +8,18 @@ require (
 	github.com/go-pg/pg/v10 v10.0.0-beta.5
 	github.com/go-playground/validator/v10 v10.3.0 // indirect
 	github.com/go-resty/resty/v2 v2.3.0
-	github.com/json-iterator/go v1.1.10 // indirect
+	github.com/golang/protobuf v1.4.2
+	github.com/gorilla/websocket v1.4.2
+	github.com/prometheus/client_golang v1.7.1
+	github.com/prometheus/client_model v0.2.0
 	github.com/sirupsen/logrus v1.6.0
 	github.com/spf13/cobra v1.0.0
 	github.com/spf13/viper v1.7.0
 	github.com/stretchr/testify v1.6.1
+	go.opentelemetry.io/otel v0.7.0
+	go.opentelemetry.io/otel/exporters/otlp v0.7.0
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013
+	google.golang.org/grpc v1.30.0
+	google.golang.org/protobuf v1.25.0
 	gopkg.in/yaml.v2 v2.3.0 // indirect
 )
@@ -14,10 +14,21 @@
 
 package ledger
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 const (
 	Description = "AdhereTech Ledger Service"
+
+	// TokenLength is the number of characters in a token issued by the
+	// Token source.
+	TokenLength = 22
+
+	// MaxBatchSize is the largest number of tokens the Token source issues
+	// in a single request.
+	MaxBatchSize = 455902
 )
 
 type Checker interface {
@@ -29,3 +40,26 @@ type Ledger interface {
 }
 
 type Token string
+
+// Record is an issued token. A zero RevokedAt means the token was not
+// revoked.
+type Record struct {
+	Token     Token
+	IssuedAt  time.Time
+	RevokedAt time.Time
+}
+
+// Revoked reports whether the token was revoked.
+func (r *Record) Revoked() bool {
+	return !r.RevokedAt.IsZero()
+}
+
+// Registry looks up and revokes issued tokens. Unknown tokens are NotFound
+// errors.
+type Registry interface {
+	Lookup(ctx context.Context, token Token) (*Record, error)
+
+	// Revoke revokes token and returns its record. Revoking a revoked
+	// token keeps its first revocation time.
+	Revoke(ctx context.Context, token Token) (*Record, error)
+}
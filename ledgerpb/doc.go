@@ -0,0 +1,19 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ledgerpb holds the gRPC API of the Ledger service, generated
+// from ledger.proto with protoc and protoc-gen-go v1.4.
+package ledgerpb
+
+//go:generate protoc --go_out=plugins=grpc,paths=source_relative:. ledger.proto
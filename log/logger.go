@@ -40,22 +40,9 @@ func (f *utcFormatter) Format(e *logrus.Entry) ([]byte, error) {
 // New creates a new Logger. Configuration should be set by changing level (eg.: panic, fatal, error, warn, info, debug)
 // format (eg.: text, json).
 func New(level string, format string) logrus.FieldLogger {
-	var logLevel logrus.Level
-	switch strings.ToLower(level) {
-	case "panic":
-		logLevel = logrus.PanicLevel
-	case "fatal":
-		logLevel = logrus.FatalLevel
-	case "error":
-		logLevel = logrus.ErrorLevel
-	case "warn":
-		logLevel = logrus.WarnLevel
-	case "info":
-		logLevel = logrus.InfoLevel
-	case "debug":
-		logLevel = logrus.DebugLevel
-	default:
-		panic(fmt.Sprintf("log level is not one of the supported values (%s): %s", strings.Join(logLevels, ", "), level))
+	logLevel, err := parseLevel(level)
+	if err != nil {
+		panic(err.Error())
 	}
 
 	var formatter utcFormatter
@@ -70,7 +57,52 @@ func New(level string, format string) logrus.FieldLogger {
 
 	return &logrus.Logger{
 		Out:       os.Stderr,
-		Formatter: &formatter,
+		Formatter: &redactFormatter{f: &formatter},
 		Level:     logLevel,
 	}
 }
+
+func parseLevel(level string) (logrus.Level, error) {
+	switch strings.ToLower(level) {
+	case "panic":
+		return logrus.PanicLevel, nil
+	case "fatal":
+		return logrus.FatalLevel, nil
+	case "error":
+		return logrus.ErrorLevel, nil
+	case "warn", "warning":
+		return logrus.WarnLevel, nil
+	case "info":
+		return logrus.InfoLevel, nil
+	case "debug":
+		return logrus.DebugLevel, nil
+	}
+
+	return 0, fmt.Errorf("log level is not one of the supported values (%s): %s", strings.Join(logLevels, ", "), level)
+}
+
+// SetLevel changes the level of the global logger at runtime.
+func SetLevel(level string) error {
+	logLevel, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	l, ok := logger.(*logrus.Logger)
+	if !ok {
+		return fmt.Errorf("logger %T does not support changing the level", logger)
+	}
+
+	l.SetLevel(logLevel)
+	return nil
+}
+
+// Level returns the level of the global logger, or an empty string if the
+// logger does not expose it.
+func Level() string {
+	if l, ok := logger.(*logrus.Logger); ok {
+		return l.GetLevel().String()
+	}
+
+	return ""
+}
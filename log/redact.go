@@ -0,0 +1,154 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/danielnegri/tokenapi-go/ledger"
+	"github.com/sirupsen/logrus"
+)
+
+// Redaction modes, selecting how secret tokens are rewritten before they
+// are logged.
+const (
+	// RedactHash replaces a token with a prefix of its SHA-256 digest, so
+	// that log lines about the same token can still be correlated.
+	RedactHash = "hash"
+
+	// RedactMask keeps the first characters of a token and masks the rest.
+	RedactMask = "mask"
+
+	DefaultRedaction = RedactHash
+)
+
+const (
+	redactHashLength = 12
+	redactMaskKeep   = 4
+)
+
+var (
+	redactModes = []string{RedactHash, RedactMask}
+
+	// tokenLike matches runs of base64url characters; runs of exactly
+	// ledger.TokenLength characters are redacted. It also matches the
+	// request ID that errors append as "(request <id>)", which is kept:
+	// clients choose request IDs, and 22-character ones are common.
+	tokenLike = regexp.MustCompile(`\(request [^\s)]+\)|[A-Za-z0-9_-]+`)
+
+	redaction atomic.Value
+)
+
+func init() {
+	redaction.Store(DefaultRedaction)
+}
+
+// SetRedaction selects the redaction mode used by Redact.
+func SetRedaction(mode string) error {
+	switch mode {
+	case RedactHash, RedactMask:
+		redaction.Store(mode)
+		return nil
+	}
+
+	return fmt.Errorf("redaction mode is not one of the supported values (%s): %s", strings.Join(redactModes, ", "), mode)
+}
+
+// RedactToken returns token rewritten according to the redaction mode.
+func RedactToken(token string) string {
+	if redaction.Load().(string) == RedactMask {
+		keep := redactMaskKeep
+		if len(token) < keep {
+			keep = len(token)
+		}
+		return token[:keep] + strings.Repeat("*", len(token)-keep)
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:])[:redactHashLength]
+}
+
+// Redact rewrites every token-shaped word of s with RedactToken, except
+// request IDs. Redact is idempotent.
+func Redact(s string) string {
+	if len(s) < ledger.TokenLength {
+		return s
+	}
+
+	return tokenLike.ReplaceAllStringFunc(s, func(word string) string {
+		if len(word) != ledger.TokenLength || word[0] == '(' {
+			return word
+		}
+		return RedactToken(word)
+	})
+}
+
+// redactFormatter redacts the message and the fields of entries, except
+// the request ID, before handing them to the wrapped formatter.
+type redactFormatter struct {
+	f logrus.Formatter
+}
+
+func (f *redactFormatter) Format(e *logrus.Entry) ([]byte, error) {
+	e.Message = Redact(e.Message)
+
+	// The map may be shared with the entry the logger was derived from, so
+	// it is copied rather than rewritten in place.
+	data := make(logrus.Fields, len(e.Data))
+	for k, v := range e.Data {
+		if k == RequestIDField {
+			data[k] = v
+			continue
+		}
+		data[k] = redactValue(v)
+	}
+	e.Data = data
+
+	return f.f.Format(e)
+}
+
+func redactValue(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+
+	if err, ok := v.(error); ok {
+		return Redact(err.Error())
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return v
+	case reflect.String:
+		return Redact(rv.String())
+	}
+
+	// Values of other kinds are kept unless their text holds a token.
+	s := fmt.Sprintf("%+v", v)
+	if r := Redact(s); r != s {
+		return r
+	}
+	return v
+}
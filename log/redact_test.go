@@ -0,0 +1,82 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const secret = "ijkr2lXOkM1EElPSDQFkeg"
+
+func TestRedact(t *testing.T) {
+	defer SetRedaction(DefaultRedaction)
+
+	line := "OK : " + secret
+	hashed := Redact(line)
+	assert.NotContains(t, hashed, secret)
+	assert.Equal(t, "OK : "+RedactToken(secret), hashed)
+	assert.True(t, strings.HasPrefix(RedactToken(secret), "sha256:"))
+	assert.Equal(t, hashed, Redact(hashed))
+
+	// Adjacent tokens, dashes and quoted SQL values are all caught, while
+	// words of other lengths are left alone.
+	other := "a-b_cdefghijklmnopqrst"
+	query := `INSERT INTO "secret_tokens" ("data") VALUES ('` + secret + `'),('` + other + `') -- request 4bf92f3577b34da6a3ce929d0e0e4736`
+	redacted := Redact(query)
+	assert.NotContains(t, redacted, secret)
+	assert.NotContains(t, redacted, other)
+	assert.Contains(t, redacted, "4bf92f3577b34da6a3ce929d0e0e4736")
+
+	// Request IDs appended to errors are kept, whatever their length.
+	requestID := "Hk3ZbDo9QvmLZ2e0sYf_Jw"
+	assert.Equal(t, "lookup failed: not found (request "+requestID+")",
+		Redact("lookup failed: not found (request "+requestID+")"))
+
+	assert.NoError(t, SetRedaction(RedactMask))
+	assert.Equal(t, "ijkr******************", Redact(secret))
+	assert.Equal(t, Redact(secret), Redact(Redact(secret)))
+
+	assert.Error(t, SetRedaction("none"))
+}
+
+func TestRedactFormatter(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New("debug", "json").(*logrus.Logger)
+	logger.Out = &buf
+
+	type rejection struct{ Value string }
+
+	requestID := "Hk3ZbDo9QvmLZ2e0sYf_Jw"
+	entry := logger.WithField("token", secret).WithField(RequestIDField, requestID)
+	entry.WithError(errors.New("duplicate key "+secret)).
+		WithField("rejected", []rejection{{Value: secret}}).
+		WithField("lines", 3).
+		Debugf("Processed %s", secret)
+
+	out := buf.String()
+	assert.NotContains(t, out, secret)
+	assert.Contains(t, out, RedactToken(secret))
+	assert.Contains(t, out, `"lines":3`)
+	assert.Contains(t, out, `"request_id":"`+requestID+`"`)
+
+	// The fields of the parent entry are left untouched.
+	assert.Equal(t, secret, entry.Data["token"])
+}
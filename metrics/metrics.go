@@ -0,0 +1,138 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics holds the Prometheus collectors of the Ledger service.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "ledger"
+
+// Registry holds every collector of the Ledger service.
+var Registry = prometheus.NewRegistry()
+
+// Outcomes of a token handed to the storage, used as the result label of
+// Tokens.
+const (
+	ResultIssued    = "issued"
+	ResultDuplicate = "duplicate"
+	ResultInvalid   = "invalid"
+	ResultFailed    = "failed"
+
+	// ResultCancelled counts tokens left unstored because the request was
+	// cancelled.
+	ResultCancelled = "cancelled"
+)
+
+// latencyBuckets spans 1ms to about 30s.
+var latencyBuckets = prometheus.ExponentialBuckets(0.001, 2, 16)
+
+var (
+	// TokensRequested counts the tokens clients asked for.
+	TokensRequested = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_requested_total",
+		Help:      "Number of tokens requested by clients.",
+	})
+
+	// Tokens counts tokens by result: issued, duplicate, invalid (rejected
+	// by the source validation or the storage) and failed.
+	Tokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_total",
+		Help:      "Number of tokens processed, by result.",
+	}, []string{"result"})
+
+	// RequestSeconds observes the latency of HTTP requests, including the
+	// time spent streaming the response. gRPC calls are labelled with the
+	// "gRPC" method, their full method name as route and their status code.
+	RequestSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of HTTP requests and gRPC calls.",
+		Buckets:   latencyBuckets,
+	}, []string{"method", "route", "code"})
+
+	// StreamsInFlight is the number of token streams being written.
+	StreamsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "streams_in_flight",
+		Help:      "Number of token streams being written.",
+	})
+
+	// InsertWorkers is the number of insert workers holding a slot of
+	// their stream's WaitGroup.
+	InsertWorkers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "insert_workers",
+		Help:      "Number of busy storage insert workers.",
+	})
+
+	// SourceSeconds observes how long a batch took to come back from the
+	// Token source, including rate limiting and retries.
+	SourceSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "source",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of Token source calls.",
+		Buckets:   latencyBuckets,
+	})
+
+	// StorageInsertSeconds observes the latency of storage inserts,
+	// including retries.
+	StorageInsertSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "storage",
+		Name:      "insert_duration_seconds",
+		Help:      "Duration of storage inserts.",
+		Buckets:   latencyBuckets,
+	})
+
+	// SourcePhaseSeconds observes how long each phase of an upstream call
+	// took: dns, connect, tls, server (time to first byte), response
+	// (reading the body) and total.
+	SourcePhaseSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "source",
+		Name:      "phase_duration_seconds",
+		Help:      "Duration of each phase of a Token source request.",
+		Buckets:   latencyBuckets,
+	}, []string{"phase"})
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		TokensRequested,
+		Tokens,
+		RequestSeconds,
+		StreamsInFlight,
+		InsertWorkers,
+		SourceSeconds,
+		SourcePhaseSeconds,
+		StorageInsertSeconds,
+	)
+}
+
+// Handler returns the HTTP handler exposing Registry.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,28 @@
+/*
+ * Copyright 2020 The Ledger Authors
+ *
+ * Licensed under the AGPL, Version 3.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.gnu.org/licenses/agpl-3.0.en.html
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+-- API keys authenticating the clients. Only the SHA-256 hash of the secret
+-- part of a key is stored.
+create table if not exists api_keys
+(
+    id         text        not null
+        constraint api_keys_pkey
+            primary key,
+    name       text        not null default '',
+    hash       text        not null,
+    scopes     text[]      not null,
+    created_at timestamptz not null default now(),
+    revoked_at timestamptz
+);
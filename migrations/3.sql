@@ -0,0 +1,29 @@
+/*
+ * Copyright 2020 The Ledger Authors
+ *
+ * Licensed under the AGPL, Version 3.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.gnu.org/licenses/agpl-3.0.en.html
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+-- Tokens issued by each client per quota window. The total window starts
+-- at the epoch; minute and day windows of the past are deleted as clients
+-- issue tokens.
+create table if not exists quota_counters
+(
+    client       text        not null,
+    period       text        not null
+        constraint quota_counters_period
+            check (period in ('minute', 'day', 'total')),
+    window_start timestamptz not null,
+    used         bigint      not null default 0,
+    constraint quota_counters_pkey
+        primary key (client, period, window_start)
+);
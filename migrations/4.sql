@@ -0,0 +1,20 @@
+/*
+ * Copyright 2020 The Ledger Authors
+ *
+ * Licensed under the AGPL, Version 3.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     https://www.gnu.org/licenses/agpl-3.0.en.html
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+-- When each token was issued and revoked. Tokens issued before this
+-- migration are dated by it.
+alter table secret_tokens
+    add column if not exists issued_at  timestamptz not null default now(),
+    add column if not exists revoked_at timestamptz;
@@ -0,0 +1,154 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/log"
+)
+
+const (
+	// DefaultAdminHost is the default interface of the admin server, which
+	// only accepts connections from the local host.
+	DefaultAdminHost = "127.0.0.1"
+
+	// DefaultAdminWriteTimeout leaves room for the default 30s CPU
+	// profile and for longer ones.
+	DefaultAdminWriteTimeout = 5 * time.Minute
+)
+
+// AdminConfig configures the admin server, which must never be exposed on
+// the public API port.
+type AdminConfig struct {
+	// Host and Port are the TCP address of the admin server. The default
+	// host is DefaultAdminHost. Socket, when set, is the path of a unix
+	// socket used instead.
+	Host   string
+	Port   int
+	Socket string
+
+	// WriteTimeout bounds each response, profiles included: pprof rejects
+	// profiles longer than it. It is independent of the timeouts of the
+	// API. The default is DefaultAdminWriteTimeout.
+	WriteTimeout time.Duration
+
+	// Config returns the running configuration, with secrets redacted,
+	// served under /admin/config. Nil disables the endpoint.
+	Config func() interface{}
+}
+
+// Addr returns the TCP address of the admin server.
+func (c *AdminConfig) Addr() string {
+	host := c.Host
+	if host == "" {
+		host = DefaultAdminHost
+	}
+	return net.JoinHostPort(host, strconv.Itoa(c.Port))
+}
+
+var publishOnce sync.Once
+
+// publishRuntime adds runtime stats to the expvar variables, next to the
+// memstats and cmdline published by the expvar package.
+func publishRuntime() {
+	start := time.Now()
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("uptime_seconds", expvar.Func(func() interface{} {
+		return int64(time.Since(start).Seconds())
+	}))
+	expvar.Publish("go_version", expvar.Func(func() interface{} {
+		return runtime.Version()
+	}))
+}
+
+// NewAdminHandler returns the handler of the admin server. It serves:
+//
+//	/debug/pprof/        net/http/pprof profiles
+//	/debug/vars          expvar runtime stats
+//	/admin/config        the running configuration
+//	/admin/log-level     GET the log level, PUT {"level": "debug"} to change it
+func NewAdminHandler(cfg *AdminConfig) http.Handler {
+	publishOnce.Do(publishRuntime)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/admin/log-level", handleLogLevel)
+
+	if cfg != nil && cfg.Config != nil {
+		mux.HandleFunc("/admin/config", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				writeJSON(w, http.StatusMethodNotAllowed, adminError{Message: "method not allowed"})
+				return
+			}
+			writeJSON(w, http.StatusOK, cfg.Config())
+		})
+	}
+
+	return mux
+}
+
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+type adminError struct {
+	Message string `json:"message"`
+}
+
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req logLevel
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{Message: "invalid request body: " + err.Error()})
+			return
+		}
+
+		if err := log.SetLevel(req.Level); err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{Message: err.Error()})
+			return
+		}
+		log.Infof("Log level changed to %s", req.Level)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		writeJSON(w, http.StatusMethodNotAllowed, adminError{Message: "method not allowed"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, logLevel{Level: log.Level()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
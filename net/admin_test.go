@@ -0,0 +1,136 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func serve(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+func TestAdminHandler_logLevel(t *testing.T) {
+	defer log.SetLevel(log.Level())
+
+	h := NewAdminHandler(&AdminConfig{})
+
+	w := serve(h, http.MethodPut, "/admin/log-level", `{"level":"debug"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"level":"debug"}`, w.Body.String())
+	assert.Equal(t, "debug", log.Level())
+
+	w = serve(h, http.MethodGet, "/admin/log-level", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"level":"debug"}`, w.Body.String())
+
+	w = serve(h, http.MethodPut, "/admin/log-level", `{"level":"verbose"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "debug", log.Level())
+
+	w = serve(h, http.MethodPost, "/admin/log-level", `{"level":"info"}`)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestAdminHandler(t *testing.T) {
+	h := NewAdminHandler(&AdminConfig{
+		Config: func() interface{} { return map[string]string{"database_url": "postgres://ledger:redacted@db/ledger"} },
+	})
+
+	w := serve(h, http.MethodGet, "/debug/vars", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"goroutines"`)
+	assert.Contains(t, w.Body.String(), `"memstats"`)
+
+	w = serve(h, http.MethodGet, "/debug/pprof/", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "goroutine")
+
+	w = serve(h, http.MethodGet, "/admin/config", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"database_url":"postgres://ledger:redacted@db/ledger"}`, w.Body.String())
+
+	// Without a config provider the endpoint is not served.
+	w = serve(NewAdminHandler(nil), http.MethodGet, "/admin/config", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAdminConfig_Addr(t *testing.T) {
+	assert.Equal(t, "127.0.0.1:6060", (&AdminConfig{Port: 6060}).Addr())
+	assert.Equal(t, "[::1]:6060", (&AdminConfig{Host: "::1", Port: 6060}).Addr())
+}
+
+func TestHandleAdmin_unix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A stale socket file is replaced.
+	path := filepath.Join(dir, "admin.sock")
+	assert.NoError(t, ioutil.WriteFile(path, nil, 0644))
+
+	s := NewServer(&ServerConfig{}, http.NotFoundHandler())
+	s.HandleAdmin(&AdminConfig{Socket: path})
+	l := s.extra[0]
+
+	// The default 30s CPU profile fits in the write timeout.
+	if srv, ok := l.svc.(*http.Server); assert.True(t, ok) {
+		assert.Equal(t, DefaultAdminWriteTimeout, srv.WriteTimeout)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- l.listenAndServe() }()
+	defer func() {
+		assert.NoError(t, l.svc.Shutdown(context.Background()))
+		assert.Equal(t, http.ErrServerClosed, <-errc)
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+
+	var resp *http.Response
+	assert.Eventually(t, func() bool {
+		resp, err = client.Get("http://admin/admin/log-level")
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	if assert.NotNil(t, resp) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	if info, err := os.Stat(path); assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+}
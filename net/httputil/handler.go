@@ -15,16 +15,27 @@
 package httputil
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"math"
 	"net/http"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/ledger"
+	"github.com/danielnegri/tokenapi-go/log"
 	"github.com/danielnegri/tokenapi-go/version"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/propagation"
+	"go.opentelemetry.io/otel/api/standard"
+	"go.opentelemetry.io/otel/api/trace"
 )
 
 func RootHandler(msg string) gin.HandlerFunc {
@@ -47,6 +58,62 @@ func NotFoundHandler(c *gin.Context) {
 	Abort(c, http.StatusNotFound, http.StatusText(http.StatusNotFound))
 }
 
+// RequestIDHeader is the header carrying the request ID.
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds the length of request IDs accepted from clients.
+const maxRequestIDLength = 128
+
+// RequestIDHandler returns a gin.HandlerFunc (middleware) that identifies
+// each request. It accepts the ID sent by the client in X-Request-Id when
+// it is short and printable, or generates one otherwise, and echoes it in
+// the response. The ID and a logger carrying it are stored in the request
+// context; see log.FromContext.
+func RequestIDHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := RequestIDOrNew(c.GetHeader(RequestIDHeader))
+		c.Header(RequestIDHeader, id)
+		c.Request = c.Request.WithContext(log.WithRequestID(c.Request.Context(), id))
+		c.Next()
+	}
+}
+
+// RequestIDOrNew returns id if it is a valid request ID, received from a
+// client, and a new request ID otherwise.
+func RequestIDOrNew(id string) string {
+	if !validRequestID(id) {
+		return newRequestID()
+	}
+	return id
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// ClientKey is the gin context key, and the log field, holding the ID of the
+// authenticated client.
+const ClientKey = "client"
+
 // LoggerHandler returns a gin.HandlerFunc (middleware) that logs requests using logrus.
 //
 // Requests with errors are logged using logrus.Error().
@@ -76,10 +143,13 @@ func LoggerHandler(logger logrus.FieldLogger, timeFormat string, utc bool) gin.H
 			"content_type": c.ContentType(),
 			"remote-addr":  c.ClientIP(),
 			"user-agent":   c.Request.UserAgent(),
-			"x-request-id": c.GetHeader("X-Request-Id"),
+			"request_id":   log.RequestID(c.Request.Context()),
 			"latency":      latency,
 			"time":         end.Format(timeFormat),
 		})
+		if client, ok := c.Get(ClientKey); ok {
+			entry = entry.WithField(ClientKey, client)
+		}
 
 		if len(c.Errors) > 0 {
 			// Append error field if this is an erroneous request.
@@ -94,8 +164,15 @@ var newLine = regexp.MustCompile(`\r?\n?\t`)
 
 func AbortWithError(ctx *gin.Context, err error) {
 	code := http.StatusInternalServerError
-	msg := newLine.ReplaceAllString(err.Error(), " ")
 	e, ok := err.(*errors.Error)
+	if ok && e.RequestID != "" {
+		// The request ID has a field of its own in the response.
+		copy := *e
+		copy.RequestID = ""
+		err = &copy
+	}
+
+	msg := newLine.ReplaceAllString(err.Error(), " ")
 	if ok {
 		if index := strings.Index(msg, ":"); len(msg) > index+1 {
 			msg = strings.TrimSpace(msg[index+1:])
@@ -110,11 +187,91 @@ func AbortWithError(ctx *gin.Context, err error) {
 			code = http.StatusNotFound
 		case errors.Permission:
 			code = http.StatusForbidden
+		case errors.Transient:
+			code = http.StatusServiceUnavailable
+		case errors.Exhausted:
+			code = http.StatusTooManyRequests
 		}
 	}
 
+	if wait, ok := RetryAfter(err); ok {
+		ctx.Header("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+	}
+
 	ctx.AbortWithStatusJSON(code, &ErrorResponse{
-		Code:    code,
-		Message: msg,
+		Code:      code,
+		Message:   msg,
+		RequestID: log.RequestID(ctx.Request.Context()),
 	})
 }
+
+// RetryAfter reports how long a client should wait before retrying a request
+// that failed with err. It walks the chain of *errors.Error values looking for
+// an underlying error with a RetryAfter method returning a positive wait.
+func RetryAfter(err error) (time.Duration, bool) {
+	for err != nil {
+		if r, ok := err.(interface{ RetryAfter() time.Duration }); ok {
+			wait := r.RetryAfter()
+			return wait, wait > 0
+		}
+
+		e, ok := err.(*errors.Error)
+		if !ok {
+			break
+		}
+		err = e.Err
+	}
+
+	return 0, false
+}
+
+// retryAfterSeconds rounds wait up to whole seconds, as required by the
+// Retry-After header, waiting at least one second.
+func retryAfterSeconds(wait time.Duration) int {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// MetricsHandler returns a gin.HandlerFunc (middleware) that observes the
+// latency of requests in h, labelled by method, route and status code.
+// Requests matching no route are labelled with an empty route.
+func MetricsHandler(h *prometheus.HistogramVec) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		code := strconv.Itoa(c.Writer.Status())
+		h.WithLabelValues(c.Request.Method, c.FullPath(), code).Observe(time.Since(start).Seconds())
+	}
+}
+
+// TracingHandler returns a gin.HandlerFunc (middleware) that starts a server
+// span for each request, continuing the trace found in the W3C trace context
+// headers. The span is stored in the request context, so handlers must pass
+// c.Request.Context() on for their own spans to join the trace.
+func TracingHandler(tracer trace.Tracer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.FullPath()
+		name := route
+		if name == "" {
+			name = "HTTP " + c.Request.Method
+		}
+
+		ctx := propagation.ExtractHTTP(c.Request.Context(), global.Propagators(), c.Request.Header)
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(standard.HTTPServerAttributesFromHTTPRequest(ledger.Description, route, c.Request)...),
+		)
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(standard.HTTPAttributesFromHTTPStatusCode(status)...)
+		span.SetStatus(standard.SpanStatusFromHTTPStatusCode(status))
+	}
+}
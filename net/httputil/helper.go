@@ -17,12 +17,14 @@ package httputil
 import (
 	"fmt"
 
+	"github.com/danielnegri/tokenapi-go/log"
 	"github.com/gin-gonic/gin"
 )
 
 type ErrorResponse struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+	Code      int    `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
 }
 
 func (er *ErrorResponse) Error() string {
@@ -34,7 +36,8 @@ func (er *ErrorResponse) Error() string {
 // It also sets the Content-Type as "application/json".
 func Abort(c *gin.Context, code int, message string) {
 	c.AbortWithStatusJSON(code, &ErrorResponse{
-		Code:    code,
-		Message: message,
+		Code:      code,
+		Message:   message,
+		RequestID: log.RequestID(c.Request.Context()),
 	})
 }
@@ -17,6 +17,7 @@ package net
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -61,7 +62,21 @@ type server struct {
 	cfg *ServerConfig
 
 	httpServer *http.Server
-	Shutdown   func()
+
+	// Shutdown is called first when the server stops, while the listeners
+	// still answer, so that the service drains its work. Close is called
+	// once the listeners are shut down, to release what their handlers
+	// use.
+	Shutdown func()
+	Close    func()
+
+	// extra are the servers added with Handle, HandleAdmin and
+	// HandleService.
+	extra []*listener
+
+	// errs receives the error of each listener that stops serving before
+	// Shutdown, so that Run stops the server and returns it.
+	errs chan error
 
 	// Exit chan for graceful Shutdown
 	Exit chan chan error
@@ -112,37 +127,132 @@ func NewServer(cfg *ServerConfig, handler http.Handler) *server {
 	}
 }
 
-func (s *server) start() error {
-	go func() {
-		log.Infof("Listening and serving HTTP on %s", s.httpServer.Addr)
-		err := s.httpServer.ListenAndServe()
-		if err != nil && err != http.ErrServerClosed {
-			log.Errorf("HTTP Server error - initiating shutting down: %v", err)
-			s.stop()
-			return
+// Service is a server run next to the main HTTP server, such as a gRPC
+// server, sharing its lifecycle.
+type Service interface {
+	// Serve serves the connections accepted on ln until Shutdown.
+	Serve(ln net.Listener) error
+
+	// Shutdown stops the service gracefully, or forcibly once ctx is done.
+	Shutdown(ctx context.Context) error
+}
+
+var _ Service = (*http.Server)(nil)
+
+// listener is a server served next to the main one.
+type listener struct {
+	// name is the protocol of the server, for the logs.
+	name    string
+	addr    string
+	network string
+	svc     Service
+}
+
+// Handle serves handler on port, next to the main HTTP server. It shares
+// the timeouts and the lifecycle of the main server and must be called
+// before Run.
+func (s *server) Handle(port int, handler http.Handler) {
+	cfg := *s.cfg
+	cfg.HTTPPort = port
+	srv := NewHTTPServer(cfg, handler)
+	s.extra = append(s.extra, &listener{name: "HTTP", addr: srv.Addr, network: "tcp", svc: srv})
+}
+
+// HandleAdmin serves the admin server configured by cfg on its unix socket
+// or TCP address, next to the main HTTP server. It shares the lifecycle of
+// the main server but has a write timeout of its own. It must be called
+// before Run.
+func (s *server) HandleAdmin(cfg *AdminConfig) {
+	if cfg.WriteTimeout == 0 {
+		cfg.WriteTimeout = DefaultAdminWriteTimeout
+	}
+
+	srvCfg := *s.cfg
+	srvCfg.WriteTimeout = cfg.WriteTimeout
+	srv := NewHTTPServer(srvCfg, NewAdminHandler(cfg))
+	l := &listener{name: "admin HTTP", addr: cfg.Addr(), network: "tcp", svc: srv}
+	if cfg.Socket != "" {
+		l.addr, l.network = cfg.Socket, "unix"
+	}
+	srv.Addr = l.addr
+	s.extra = append(s.extra, l)
+}
+
+// HandleService serves svc, speaking the protocol name, on port next to the
+// main HTTP server. It is shut down with the main server and must be
+// called before Run.
+func (s *server) HandleService(port int, name string, svc Service) {
+	s.extra = append(s.extra, &listener{name: name, addr: fmt.Sprintf(":%d", port), network: "tcp", svc: svc})
+}
+
+func (l *listener) listenAndServe() error {
+	if l.network == "unix" {
+		if err := os.Remove(l.addr); err != nil && !os.IsNotExist(err) {
+			return err
 		}
-	}()
+	}
+
+	ln, err := net.Listen(l.network, l.addr)
+	if err != nil {
+		return err
+	}
+
+	if l.network == "unix" {
+		if err := os.Chmod(l.addr, 0600); err != nil {
+			_ = ln.Close()
+			return err
+		}
+	}
+
+	return l.svc.Serve(ln)
+}
+
+func (s *server) start() error {
+	main := &listener{name: "HTTP", addr: s.httpServer.Addr, network: "tcp", svc: s.httpServer}
+	listeners := append([]*listener{main}, s.extra...)
+	s.errs = make(chan error, len(listeners))
+	for _, l := range listeners {
+		l := l
+		go func() {
+			log.Infof("Listening and serving %s on %s", l.name, l.addr)
+			err := l.listenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				s.errs <- fmt.Errorf("%s Server on %s: %v", l.name, l.addr, err)
+			}
+		}()
+	}
 
 	go func() {
 		exit := <-s.Exit
 
+		// Stop service. It drains its work while the listeners still
+		// answer, so that readiness probes report it.
+		if s.Shutdown != nil {
+			s.Shutdown()
+		}
+
 		// Stop listener with timeout
 		ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
 		defer cancel()
 
-		// Stop service
-		if s.Shutdown != nil {
-			s.Shutdown()
+		for _, l := range s.extra {
+			log.Infof("Stopping %s Server on %s", l.name, l.addr)
+			if err := l.svc.Shutdown(ctx); err != nil {
+				log.Errorf("error while stopping %s Server on %s: %v", l.name, l.addr, err)
+			}
 		}
 
 		// Stop HTTP Server
+		var err error
 		if s.httpServer != nil {
 			log.Infof("Stopping HTTP Server on %s", s.httpServer.Addr)
-			exit <- s.httpServer.Shutdown(ctx)
-			return
+			err = s.httpServer.Shutdown(ctx)
 		}
 
-		exit <- nil
+		if s.Close != nil {
+			s.Close()
+		}
+		exit <- err
 	}()
 
 	return nil
@@ -156,7 +266,9 @@ func (s *server) stop() error {
 
 // Run will create a new Server and register the given
 // Service and start up the Server(s).
-// This will block until the Server shuts down.
+// This will block until the Server shuts down, on a signal or when one of
+// its listeners fails, in which case the error of the listener is
+// returned.
 func (s *server) Run() error {
 	if err := s.start(); err != nil {
 		return err
@@ -164,8 +276,19 @@ func (s *server) Run() error {
 
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGKILL)
-	log.Info("Received signal ", <-ch)
-	return s.stop()
+	defer signal.Stop(ch)
+
+	select {
+	case sig := <-ch:
+		log.Info("Received signal ", sig)
+		return s.stop()
+	case err := <-s.errs:
+		log.Errorf("%v - initiating shutting down", err)
+		if stopErr := s.stop(); stopErr != nil {
+			log.Errorf("error while stopping Server: %v", stopErr)
+		}
+		return err
+	}
 }
 
 func NewHTTPServer(cfg ServerConfig, handler http.Handler) *http.Server {
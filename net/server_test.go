@@ -0,0 +1,88 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestRun_listenerError(t *testing.T) {
+	// The port of the extra server is taken.
+	taken, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	stopped := false
+	s := NewServer(&ServerConfig{HTTPPort: freePort(t)}, http.NotFoundHandler())
+	s.Shutdown = func() { stopped = true }
+	s.Handle(taken.Addr().(*net.TCPAddr).Port, http.NotFoundHandler())
+
+	errc := make(chan error, 1)
+	go func() { errc <- s.Run() }()
+
+	select {
+	case err := <-errc:
+		assert.Error(t, err)
+		assert.True(t, stopped)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return when a listener failed")
+	}
+}
+
+func TestStop_order(t *testing.T) {
+	port := freePort(t)
+	s := NewServer(&ServerConfig{HTTPPort: port}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/", port)
+	get := func() error {
+		resp, err := (&http.Client{Transport: &http.Transport{DisableKeepAlives: true}}).Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	// The service drains while the listeners answer, and releases its
+	// resources once they are shut down.
+	var drained, closed error
+	s.Shutdown = func() { drained = get() }
+	s.Close = func() { closed = get() }
+
+	assert.NoError(t, s.start())
+	assert.Eventually(t, func() bool { return get() == nil }, time.Second, 10*time.Millisecond)
+	assert.NoError(t, s.stop())
+
+	assert.NoError(t, drained)
+	assert.Error(t, closed)
+}
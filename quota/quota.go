@@ -0,0 +1,283 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package quota limits how many tokens each client may issue per minute,
+// per day and in total. Counters are kept by a Store, shared by every
+// replica of the service.
+package quota
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+)
+
+// Period is the length of a quota window.
+type Period string
+
+const (
+	Minute Period = "minute"
+	Day    Period = "day"
+
+	// Total is a single window covering the lifetime of the client.
+	Total Period = "total"
+)
+
+// Periods lists the periods in the order they are checked.
+var Periods = []Period{Minute, Day, Total}
+
+// Window is the window of period starting at Start.
+type Window struct {
+	Period Period
+	Start  time.Time
+}
+
+// End returns when the window closes, or the zero time for Total.
+func (w Window) End() time.Time {
+	switch w.Period {
+	case Minute:
+		return w.Start.Add(time.Minute)
+	case Day:
+		return w.Start.AddDate(0, 0, 1)
+	}
+	return time.Time{}
+}
+
+// windowAt returns the window of period containing t. Windows are aligned
+// on UTC minutes and days.
+func windowAt(period Period, t time.Time) Window {
+	t = t.UTC()
+	switch period {
+	case Minute:
+		return Window{Period: period, Start: t.Truncate(time.Minute)}
+	case Day:
+		return Window{Period: period, Start: time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)}
+	}
+	return Window{Period: Total, Start: time.Unix(0, 0).UTC()}
+}
+
+// Limit caps the number of tokens issued in a window.
+type Limit struct {
+	Window
+	Max int64
+}
+
+// Counter is the number of tokens a client issued in a window.
+type Counter struct {
+	Client string
+	Window
+	Used int64
+}
+
+// Store keeps the counters.
+type Store interface {
+	// Consume adds n to the counters of client in the windows of limits
+	// unless that would take one of them over its maximum, in which case
+	// no counter changes and the error wraps an *ExceededError. Counters
+	// of earlier windows may be discarded.
+	Consume(ctx context.Context, client string, n int64, limits []Limit) error
+
+	// Release subtracts n from the counters of client in windows, without
+	// taking them below zero. Counters of discarded windows are left
+	// alone.
+	Release(ctx context.Context, client string, n int64, windows []Window) error
+
+	// Counters returns the counters of every client in windows.
+	Counters(ctx context.Context, windows []Window) ([]Counter, error)
+}
+
+// ExceededError is the underlying error of a request over quota.
+type ExceededError struct {
+	Limit Limit
+	Used  int64
+
+	// Wait is how long until the window closes, zero for Total.
+	Wait time.Duration
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("%s quota of %d tokens exceeded (%d used)", e.Limit.Period, e.Limit.Max, e.Used)
+}
+
+// RetryAfter returns how long callers should wait before trying again, or
+// zero when waiting does not help, for the Total quota.
+func (e *ExceededError) RetryAfter() time.Duration {
+	return e.Wait
+}
+
+// Policy caps the tokens a client may issue. Zero fields are unlimited.
+type Policy struct {
+	PerMinute int64 `json:"per_minute,omitempty"`
+	PerDay    int64 `json:"per_day,omitempty"`
+	Total     int64 `json:"total,omitempty"`
+}
+
+func (p Policy) max(period Period) int64 {
+	switch period {
+	case Minute:
+		return p.PerMinute
+	case Day:
+		return p.PerDay
+	}
+	return p.Total
+}
+
+// Config holds the policies of the clients.
+type Config struct {
+	// Default applies to clients without a policy of their own.
+	Default Policy `json:"default"`
+
+	// Clients holds the policies by client ID.
+	Clients map[string]Policy `json:"clients,omitempty"`
+}
+
+// Policy returns the policy of client.
+func (c *Config) Policy(client string) Policy {
+	if p, ok := c.Clients[client]; ok {
+		return p
+	}
+	return c.Default
+}
+
+// Limiter enforces the quotas of the clients.
+type Limiter struct {
+	cfg   *Config
+	store Store
+	now   func() time.Time
+}
+
+func New(cfg *Config, store Store) *Limiter {
+	return &Limiter{cfg: cfg, store: store, now: time.Now}
+}
+
+// Reservation is the charge of a request, made by Allow. The tokens the
+// request did not issue are given back with Refund.
+type Reservation struct {
+	client  string
+	n       int64
+	windows []Window
+}
+
+// Allow charges n tokens to client. Requests over quota fail with an
+// Exhausted error wrapping an *ExceededError. The Reservation is nil when
+// no quota applies to client.
+func (l *Limiter) Allow(ctx context.Context, client string, n int64) (*Reservation, error) {
+	const op errors.Op = "quota/Limiter.Allow"
+
+	policy := l.cfg.Policy(client)
+	now := l.now()
+
+	var limits []Limit
+	for _, period := range Periods {
+		if max := policy.max(period); max > 0 {
+			limits = append(limits, Limit{Window: windowAt(period, now), Max: max})
+		}
+	}
+
+	if len(limits) == 0 {
+		return nil, nil
+	}
+
+	err := l.store.Consume(ctx, client, n, limits)
+	if exceeded, ok := exceededError(err); ok {
+		if end := exceeded.Limit.End(); !end.IsZero() {
+			exceeded.Wait = end.Sub(now)
+		}
+		return nil, errors.E(op, ctx, errors.Exhausted, exceeded)
+	}
+	if err != nil {
+		return nil, errors.E(op, ctx, err)
+	}
+
+	r := &Reservation{client: client, n: n, windows: make([]Window, len(limits))}
+	for i, limit := range limits {
+		r.windows[i] = limit.Window
+	}
+	return r, nil
+}
+
+// Refund gives back n of the tokens charged by r, to the windows they were
+// charged to. A nil Reservation has nothing to refund.
+func (l *Limiter) Refund(ctx context.Context, r *Reservation, n int64) error {
+	const op errors.Op = "quota/Limiter.Refund"
+
+	if r == nil || n <= 0 {
+		return nil
+	}
+	if n > r.n {
+		n = r.n
+	}
+
+	if err := l.store.Release(ctx, r.client, n, r.windows); err != nil {
+		return errors.E(op, ctx, err)
+	}
+	r.n -= n
+	return nil
+}
+
+func exceededError(err error) (*ExceededError, bool) {
+	for err != nil {
+		if exceeded, ok := err.(*ExceededError); ok {
+			return exceeded, true
+		}
+
+		e, ok := err.(*errors.Error)
+		if !ok {
+			break
+		}
+		err = e.Err
+	}
+
+	return nil, false
+}
+
+// Usage is the usage of a client in the current windows.
+type Usage struct {
+	Client string           `json:"client"`
+	Policy Policy           `json:"policy"`
+	Used   map[Period]int64 `json:"used"`
+}
+
+// Usage returns the usage of every client with a counter in the current
+// windows, ordered by the store.
+func (l *Limiter) Usage(ctx context.Context) ([]Usage, error) {
+	const op errors.Op = "quota/Limiter.Usage"
+
+	now := l.now()
+	windows := make([]Window, len(Periods))
+	for i, period := range Periods {
+		windows[i] = windowAt(period, now)
+	}
+
+	counters, err := l.store.Counters(ctx, windows)
+	if err != nil {
+		return nil, errors.E(op, ctx, err)
+	}
+
+	var usage []Usage
+	index := make(map[string]int)
+	for _, c := range counters {
+		i, ok := index[c.Client]
+		if !ok {
+			i = len(usage)
+			index[c.Client] = i
+			usage = append(usage, Usage{Client: c.Client, Policy: l.cfg.Policy(c.Client), Used: make(map[Period]int64)})
+		}
+		usage[i].Used[c.Period] = c.Used
+	}
+
+	return usage, nil
+}
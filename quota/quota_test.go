@@ -0,0 +1,161 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// store keeps every counter in a map.
+type store map[Counter]int64
+
+func (s store) Consume(ctx context.Context, client string, n int64, limits []Limit) error {
+	for _, l := range limits {
+		used := s[Counter{Client: client, Window: l.Window}]
+		if used+n > l.Max {
+			return errors.E(errors.Exhausted, &ExceededError{Limit: l, Used: used})
+		}
+	}
+	for _, l := range limits {
+		s[Counter{Client: client, Window: l.Window}] += n
+	}
+	return nil
+}
+
+func (s store) Release(ctx context.Context, client string, n int64, windows []Window) error {
+	for _, w := range windows {
+		c := Counter{Client: client, Window: w}
+		if used, ok := s[c]; ok {
+			s[c] = used - n
+			if s[c] < 0 {
+				s[c] = 0
+			}
+		}
+	}
+	return nil
+}
+
+func (s store) Counters(ctx context.Context, windows []Window) ([]Counter, error) {
+	var counters []Counter
+	for c, used := range s {
+		for _, w := range windows {
+			if c.Window == w {
+				c.Used = used
+				counters = append(counters, c)
+			}
+		}
+	}
+	return counters, nil
+}
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	l := New(&Config{
+		Default: Policy{PerMinute: 10, PerDay: 15},
+		Clients: map[string]Policy{"batch": {Total: 5}},
+	}, store{})
+
+	now := time.Date(2020, 7, 1, 23, 59, 20, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	_, err := l.Allow(ctx, "web", 6)
+	assert.NoError(t, err)
+	_, err = l.Allow(ctx, "web", 5)
+	assert.True(t, errors.Is(errors.Exhausted, err))
+	exceeded, ok := exceededError(err)
+	if assert.True(t, ok) {
+		assert.Equal(t, Minute, exceeded.Limit.Period)
+		assert.Equal(t, int64(6), exceeded.Used)
+		assert.Equal(t, 40*time.Second, exceeded.RetryAfter())
+	}
+
+	// A rejected request is not charged.
+	_, err = l.Allow(ctx, "web", 4)
+	assert.NoError(t, err)
+
+	// The next minute is a new day, too.
+	now = now.Add(time.Minute)
+	_, err = l.Allow(ctx, "web", 10)
+	assert.NoError(t, err)
+
+	now = now.Add(time.Minute)
+	_, err = l.Allow(ctx, "web", 10)
+	if exceeded, ok := exceededError(err); assert.True(t, ok) {
+		assert.Equal(t, Day, exceeded.Limit.Period)
+		assert.Equal(t, 24*time.Hour-80*time.Second, exceeded.RetryAfter())
+	}
+
+	_, err = l.Allow(ctx, "batch", 5)
+	assert.NoError(t, err)
+	_, err = l.Allow(ctx, "batch", 1)
+	if exceeded, ok := exceededError(err); assert.True(t, ok) {
+		assert.Equal(t, Total, exceeded.Limit.Period)
+		assert.Zero(t, exceeded.RetryAfter())
+	}
+
+	usage, err := l.Usage(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, usage, 2)
+	for _, u := range usage {
+		switch u.Client {
+		case "web":
+			assert.Equal(t, map[Period]int64{Day: 10}, u.Used)
+		case "batch":
+			assert.Equal(t, map[Period]int64{Total: 5}, u.Used)
+			assert.Equal(t, Policy{Total: 5}, u.Policy)
+		}
+	}
+}
+
+func TestLimiter_unlimited(t *testing.T) {
+	s := store{}
+	l := New(&Config{}, s)
+	r, err := l.Allow(context.Background(), "web", 1<<40)
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+	assert.Empty(t, s)
+}
+
+func TestLimiter_Refund(t *testing.T) {
+	ctx := context.Background()
+	s := store{}
+	l := New(&Config{Default: Policy{PerMinute: 10, Total: 100}}, s)
+
+	now := time.Date(2020, 7, 1, 23, 59, 20, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	r, err := l.Allow(ctx, "web", 10)
+	assert.NoError(t, err)
+
+	// Tokens are refunded to the windows they were charged to, even once
+	// another window started.
+	now = now.Add(time.Minute)
+	_, err = l.Allow(ctx, "web", 5)
+	assert.NoError(t, err)
+
+	assert.NoError(t, l.Refund(ctx, r, 4))
+	assert.NoError(t, l.Refund(ctx, r, 20))
+	assert.NoError(t, l.Refund(ctx, nil, 20))
+
+	minute := Window{Period: Minute, Start: time.Date(2020, 7, 1, 23, 59, 0, 0, time.UTC)}
+	assert.Equal(t, int64(0), s[Counter{Client: "web", Window: minute}])
+	assert.Equal(t, int64(5), s[Counter{Client: "web", Window: windowAt(Minute, now)}])
+	assert.Equal(t, int64(5), s[Counter{Client: "web", Window: windowAt(Total, now)}])
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package retry implements retry policies with capped exponential backoff
+// and jitter, shared by the Token source client and the storage.
+package retry
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultBaseBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff  = 2 * time.Second
+	DefaultJitter      = 0.5
+)
+
+// DefaultRetryStatus lists the HTTP status codes retried when a Policy does
+// not set its own: rate limiting and gateway failures. Other 4xx and 5xx
+// responses are not expected to succeed on a second attempt.
+var DefaultRetryStatus = []int{
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// Policy describes when and how an operation is retried.
+type Policy struct {
+	// MaxAttempts is the maximum number of attempts, including the first.
+	// Zero or one disables retries.
+	MaxAttempts int
+
+	// BaseBackoff is the wait after the first failed attempt. It doubles on
+	// every following attempt up to MaxBackoff. The defaults are 100ms
+	// and 2s.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	// Jitter is the fraction of each backoff, between 0 and 1, that is
+	// randomized so that clients retrying together spread out.
+	Jitter float64
+
+	// RetryStatus lists the HTTP status codes that are retried.
+	// The default is DefaultRetryStatus.
+	RetryStatus []int
+
+	// Deadline bounds the total time spent on all attempts, including
+	// backoff. Zero means no deadline other than the caller's context.
+	Deadline time.Duration
+}
+
+var (
+	randMu sync.Mutex
+	random = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Attempts returns the maximum number of attempts, at least one.
+func (p *Policy) Attempts() int {
+	if p == nil || p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// Backoff returns how long to wait after the given failed attempt.
+// Attempts are numbered from 1.
+func (p *Policy) Backoff(attempt int) time.Duration {
+	base, max, jitter := DefaultBaseBackoff, DefaultMaxBackoff, 0.0
+	if p != nil {
+		if p.BaseBackoff > 0 {
+			base = p.BaseBackoff
+		}
+		if p.MaxBackoff > 0 {
+			max = p.MaxBackoff
+		}
+		jitter = math.Min(math.Max(p.Jitter, 0), 1)
+	}
+
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	backoff := math.Min(float64(max), float64(base)*math.Exp2(float64(attempt-1)))
+	if jitter > 0 {
+		randMu.Lock()
+		r := random.Float64()
+		randMu.Unlock()
+		backoff -= backoff * jitter * r
+	}
+
+	return time.Duration(backoff)
+}
+
+// RetryStatusCode reports whether a response with the given HTTP status
+// code should be retried.
+func (p *Policy) RetryStatusCode(code int) bool {
+	codes := DefaultRetryStatus
+	if p != nil && p.RetryStatus != nil {
+		codes = p.RetryStatus
+	}
+
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Do calls fn until it succeeds, returns an error for which retryable is
+// false, or the policy runs out of attempts or time. It returns the error
+// of the last attempt.
+func (p *Policy) Do(ctx context.Context, fn func(ctx context.Context) error, retryable func(err error) bool) error {
+	if p != nil && p.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Deadline)
+		defer cancel()
+	}
+
+	attempts := p.Attempts()
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || attempt >= attempts || !retryable(err) {
+			return err
+		}
+
+		timer := time.NewTimer(p.Backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicy_Backoff(t *testing.T) {
+	p := &Policy{BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	assert.Equal(t, 100*time.Millisecond, p.Backoff(1))
+	assert.Equal(t, 200*time.Millisecond, p.Backoff(2))
+	assert.Equal(t, 800*time.Millisecond, p.Backoff(4))
+	assert.Equal(t, time.Second, p.Backoff(10))
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		backoff := p.Backoff(2)
+		assert.True(t, backoff > 100*time.Millisecond && backoff <= 200*time.Millisecond, backoff)
+	}
+}
+
+func TestPolicy_RetryStatusCode(t *testing.T) {
+	var p *Policy
+	assert.True(t, p.RetryStatusCode(503))
+	assert.False(t, p.RetryStatusCode(400))
+
+	p = &Policy{RetryStatus: []int{500}}
+	assert.True(t, p.RetryStatusCode(500))
+	assert.False(t, p.RetryStatusCode(503))
+}
+
+func TestPolicy_Do(t *testing.T) {
+	transient := func(err error) bool { return errors.Is(errors.Transient, err) }
+	p := &Policy{MaxAttempts: 3, BaseBackoff: time.Millisecond}
+
+	calls := 0
+	err := p.Do(context.Background(), func(context.Context) error {
+		calls++
+		if calls < 3 {
+			return errors.E(errors.Transient)
+		}
+		return nil
+	}, transient)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = p.Do(context.Background(), func(context.Context) error {
+		calls++
+		return errors.E(errors.Transient)
+	}, transient)
+	assert.True(t, errors.Is(errors.Transient, err))
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = p.Do(context.Background(), func(context.Context) error {
+		calls++
+		return errors.E(errors.Invalid)
+	}, transient)
+	assert.True(t, errors.Is(errors.Invalid, err))
+	assert.Equal(t, 1, calls)
+}
+
+func TestPolicy_Deadline(t *testing.T) {
+	p := &Policy{MaxAttempts: 100, BaseBackoff: 20 * time.Millisecond, Deadline: 50 * time.Millisecond}
+
+	calls := 0
+	start := time.Now()
+	err := p.Do(context.Background(), func(context.Context) error {
+		calls++
+		return errors.E(errors.Transient)
+	}, func(error) bool { return true })
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.True(t, calls < 100)
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/danielnegri/tokenapi-go/auth"
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/log"
+	"github.com/danielnegri/tokenapi-go/net/httputil"
+	"github.com/gin-gonic/gin"
+)
+
+// APIKeyHeader is the header carrying the API key of a client that does not
+// send it as a bearer token.
+const APIKeyHeader = "X-Api-Key"
+
+// AccessTokenParam is the query parameter carrying the credentials of GET
+// requests made by clients that cannot set headers, such as browsers
+// opening an EventSource or a WebSocket.
+const AccessTokenParam = "access_token"
+
+// credentials returns the API key or the JWT sent with the request, if any.
+func credentials(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); len(h) > len("Bearer ") && strings.EqualFold(h[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(h[len("Bearer "):])
+	}
+
+	return strings.TrimSpace(r.Header.Get(APIKeyHeader))
+}
+
+// accessTokenHandler moves the credentials sent in the AccessTokenParam
+// query parameter of GET requests to the Authorization header. It runs
+// before the request is logged or traced, and strips the parameter from
+// every request, so that credentials never show in either.
+func accessTokenHandler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		r := ctx.Request
+		q := r.URL.Query()
+		if _, ok := q[AccessTokenParam]; !ok {
+			ctx.Next()
+			return
+		}
+
+		token := strings.TrimSpace(q.Get(AccessTokenParam))
+		q.Del(AccessTokenParam)
+		r.URL.RawQuery = q.Encode()
+		r.RequestURI = r.URL.RequestURI()
+
+		if r.Method == http.MethodGet && token != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		ctx.Next()
+	}
+}
+
+// authorize returns a middleware that authenticates the client and aborts
+// the request unless the client was granted scope; an empty scope only
+// requires authentication. Requests without credentials are answered with
+// 401 and denied requests with 403.
+func (s *service) authorize(scope auth.Scope) gin.HandlerFunc {
+	const op errors.Op = "server/service.authorize"
+
+	return func(ctx *gin.Context) {
+		if s.cfg.AuthDisabled {
+			ctx.Next()
+			return
+		}
+
+		reqCtx := ctx.Request.Context()
+		logger := log.FromContext(reqCtx)
+
+		credential := credentials(ctx.Request)
+		if credential == "" {
+			ctx.Header("WWW-Authenticate", `Bearer realm="ledger"`)
+			httputil.Abort(ctx, http.StatusUnauthorized, "missing credentials")
+			return
+		}
+
+		principal, err := s.authenticate(reqCtx, credential)
+		if err == nil && scope != "" {
+			err = principal.Authorize(reqCtx, scope)
+		}
+		if err != nil {
+			err = errors.E(op, reqCtx, err)
+			logger.Warn(err)
+			httputil.AbortWithError(ctx, err)
+			return
+		}
+
+		// The client is recorded in the access log for audit.
+		ctx.Set(httputil.ClientKey, principal.ID)
+		reqCtx = auth.NewContext(reqCtx, principal)
+		reqCtx = log.NewContext(reqCtx, logger.WithField(httputil.ClientKey, principal.ID))
+		ctx.Request = ctx.Request.WithContext(reqCtx)
+		ctx.Next()
+	}
+}
+
+// authenticate identifies the client by its API key or, when JWTs are
+// accepted, by any other bearer token.
+func (s *service) authenticate(ctx context.Context, credential string) (*auth.Principal, error) {
+	const op errors.Op = "server/service.authenticate"
+
+	if s.jwt != nil && !strings.HasPrefix(credential, auth.KeyPrefix) {
+		return s.jwt.Verify(ctx, credential)
+	}
+
+	if s.keys == nil {
+		return nil, errors.E(op, ctx, errors.Transient, "API keys are not available")
+	}
+
+	return auth.NewAuthenticator(s.keys).Authenticate(ctx, credential)
+}
@@ -0,0 +1,197 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/danielnegri/tokenapi-go/auth"
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/quota"
+	"github.com/danielnegri/tokenapi-go/source"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorize(t *testing.T) {
+	s, storage := newTestService(source.NewSeeded(nil), 1)
+	s.cfg.AuthDisabled = false
+	h := s.newHandler()
+
+	newKey := func(scopes ...auth.Scope) string {
+		apiKey, key, err := auth.NewKey("test", scopes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.CreateKey(context.Background(), key); err != nil {
+			t.Fatal(err)
+		}
+		return apiKey
+	}
+
+	issuer := newKey(auth.ScopeIssue)
+	admin := newKey(auth.ScopeAdmin)
+	verifier := newKey(auth.ScopeVerify)
+	revoked := newKey(auth.ScopeIssue)
+	id, _, _ := auth.ParseKey(revoked)
+	assert.NoError(t, storage.RevokeKey(context.Background(), id))
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		code   int
+	}{
+		{"missing", "", "", http.StatusUnauthorized},
+		{"bearer", "Authorization", "Bearer " + issuer, http.StatusOK},
+		{"header", APIKeyHeader, issuer, http.StatusOK},
+		{"admin", "Authorization", "bearer " + admin, http.StatusOK},
+		{"scope", "Authorization", "Bearer " + verifier, http.StatusForbidden},
+		{"revoked", "Authorization", "Bearer " + revoked, http.StatusForbidden},
+		{"wrong secret", "Authorization", "Bearer " + issuer + "x", http.StatusForbidden},
+		{"malformed", "Authorization", "Bearer secret", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("%s/tokens?size=1", Prefix), nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			h.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.code, w.Code, w.Body.String())
+			if tt.code == http.StatusUnauthorized {
+				assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+
+	// Health checks stay open.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health/live", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestQuota(t *testing.T) {
+	s, storage := newTestService(source.NewSeeded(nil), 1)
+	s.cfg.AuthDisabled = false
+	s.quota = quota.New(&quota.Config{Default: quota.Policy{PerMinute: 10}}, storage)
+	h := s.newHandler()
+
+	issue := func(apiKey string, size int) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("%s/tokens?size=%d", Prefix, size), nil)
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	newKey := func(scopes ...auth.Scope) string {
+		apiKey, key, _ := auth.NewKey("test", scopes)
+		_ = storage.CreateKey(context.Background(), key)
+		return apiKey
+	}
+	web, batch, admin := newKey(auth.ScopeIssue), newKey(auth.ScopeIssue), newKey(auth.ScopeAdmin)
+
+	assert.Equal(t, http.StatusOK, issue(web, 8).Code)
+	w := issue(web, 3)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), "minute quota of 10 tokens exceeded")
+
+	// Quotas are per client.
+	assert.Equal(t, http.StatusOK, issue(batch, 3).Code)
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, Prefix+"/admin/usage", nil)
+	req.Header.Set("Authorization", "Bearer "+web)
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = httptest.NewRecorder()
+	req.Header.Set("Authorization", "Bearer "+admin)
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var body struct {
+		Usage []quota.Usage `json:"usage"`
+	}
+	if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body)) && assert.Len(t, body.Usage, 2) {
+		used := map[int64]bool{}
+		for _, u := range body.Usage {
+			used[u.Used[quota.Minute]] = true
+		}
+		assert.Equal(t, map[int64]bool{8: true, 3: true}, used)
+	}
+}
+
+// failingSource is a Source whose Generate fails.
+type failingSource struct {
+	source.Source
+}
+
+func (failingSource) Generate(ctx context.Context, n int) (*source.Batch, error) {
+	return nil, errors.E(errors.Internal, "source unavailable")
+}
+
+func TestQuota_refund(t *testing.T) {
+	s, storage := newTestService(source.NewSeeded(nil), 1)
+	s.cfg.AuthDisabled = false
+	s.quota = quota.New(&quota.Config{Default: quota.Policy{PerMinute: 100}}, storage)
+	h := s.newHandler()
+
+	apiKey, key, _ := auth.NewKey("test", []auth.Scope{auth.ScopeIssue})
+	_ = storage.CreateKey(context.Background(), key)
+
+	issue := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, Prefix+"/tokens?size=8", nil)
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		h.ServeHTTP(w, req)
+		return w
+	}
+	used := func() int64 {
+		usage, err := s.quota.Usage(context.Background())
+		if assert.NoError(t, err) && assert.Len(t, usage, 1) {
+			return usage[0].Used[quota.Minute]
+		}
+		return -1
+	}
+
+	// The first tokens of the sequence are already stored: duplicates are
+	// not charged.
+	batch, err := source.NewSeeded(nil).Generate(context.Background(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range batch.Tokens {
+		assert.NoError(t, storage.Insert(context.Background(), token))
+	}
+
+	assert.Equal(t, http.StatusOK, issue().Code)
+	assert.Equal(t, int64(5), used())
+
+	// Failed requests are not charged.
+	s.source = failingSource{}
+	assert.Equal(t, http.StatusInternalServerError, issue().Code)
+	assert.Equal(t, int64(5), used())
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/ledger"
+	"github.com/danielnegri/tokenapi-go/metrics"
+	"github.com/danielnegri/tokenapi-go/source"
+	"github.com/danielnegri/tokenapi-go/storage/memory"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingStorage stores the first n tokens, then blocks every insert until
+// its context is done.
+type blockingStorage struct {
+	*memory.Memory
+	n       int32
+	calls   int32
+	once    sync.Once
+	blocked chan struct{}
+}
+
+func newBlockingStorage(n int32) *blockingStorage {
+	return &blockingStorage{Memory: memory.New(), n: n, blocked: make(chan struct{})}
+}
+
+func (s *blockingStorage) Insert(ctx context.Context, token ledger.Token) error {
+	if atomic.AddInt32(&s.calls, 1) > s.n {
+		s.once.Do(func() { close(s.blocked) })
+		<-ctx.Done()
+		return errors.E(errors.Transient, ctx.Err())
+	}
+	return s.Memory.Insert(ctx, token)
+}
+
+// cancelInsert streams 100 tokens into storage, calls cancel once storage
+// blocks and waits for the handler to return.
+func cancelInsert(t *testing.T, s *service, storage *blockingStorage, req *http.Request, cancel func()) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		s.newHandler().ServeHTTP(w, req)
+		close(done)
+	}()
+
+	<-storage.blocked
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler did not return after cancel")
+	}
+	return w
+}
+
+// assertNoLeak checks that the number of goroutines gets back to before.
+// It polls by hand: assert.Eventually runs its condition in a goroutine.
+func assertNoLeak(t *testing.T, before int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), before, "goroutines leaked")
+}
+
+func TestHandleInsert_clientDisconnect(t *testing.T) {
+	before := runtime.NumGoroutine()
+	cancelled := testutil.ToFloat64(metrics.Tokens.WithLabelValues(metrics.ResultCancelled))
+
+	storage := newBlockingStorage(5)
+	s := &service{cfg: &Config{AuthDisabled: true, Concurrency: 4}, source: source.NewSeeded(nil), storage: storage}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("%s/tokens?size=100", Prefix), nil).WithContext(ctx)
+	w := cancelInsert(t, s, storage, req, cancel)
+
+	assert.Equal(t, 5, storage.Len())
+	assert.Equal(t, cancelled+95, testutil.ToFloat64(metrics.Tokens.WithLabelValues(metrics.ResultCancelled)))
+	assert.True(t, strings.Count(w.Body.String(), "OK : ") <= 5)
+	assertNoLeak(t, before)
+}
+
+func TestHandleInsert_shutdown(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	storage := newBlockingStorage(10)
+	cfg := &Config{AuthDisabled: true, Concurrency: 2, DrainTimeout: 10 * time.Millisecond}
+	s := &service{cfg: cfg, source: source.NewSeeded(nil), storage: storage}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("%s/tokens?size=100", Prefix), nil)
+	w := cancelInsert(t, s, storage, req, s.Shutdown)
+
+	assert.Equal(t, 10, storage.Len())
+	assert.True(t, strings.HasSuffix(w.Body.String(), "END: cancelled, 10 of 100 tokens committed\n"), w.Body.String())
+	assertNoLeak(t, before)
+}
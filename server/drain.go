@@ -0,0 +1,132 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/log"
+)
+
+const (
+	// DefaultDrainTimeout is how long Shutdown lets in-flight streams
+	// finish before cancelling them.
+	DefaultDrainTimeout = 30 * time.Second
+
+	// drainGrace is how long cancelled streams are given to write their
+	// status and return.
+	drainGrace = 5 * time.Second
+)
+
+// streams tracks the streams in flight so that Shutdown can wait for them.
+// The zero value is ready to use.
+type streams struct {
+	mu       sync.Mutex
+	draining bool
+	active   int
+	idle     chan struct{}
+}
+
+// start registers a new stream. It returns false once the streams are
+// draining, in which case the stream must not start.
+func (s *streams) start() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.draining {
+		return false
+	}
+	s.active++
+	return true
+}
+
+// done unregisters a stream registered by start.
+func (s *streams) done() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.active--
+	if s.active == 0 && s.idle != nil {
+		close(s.idle)
+		s.idle = nil
+	}
+}
+
+// drain refuses new streams and returns a channel closed once no stream is
+// in flight.
+func (s *streams) drain() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.draining = true
+	idle := make(chan struct{})
+	if s.active == 0 {
+		close(idle)
+		return idle
+	}
+
+	if s.idle != nil {
+		return s.idle
+	}
+	s.idle = idle
+	return idle
+}
+
+// isDraining reports whether drain was called.
+func (s *streams) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// inFlight returns the number of streams in flight.
+func (s *streams) inFlight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active
+}
+
+// drain stops accepting new streams and waits for those in flight to
+// finish. Streams still running after the drain timeout are cancelled and
+// given drainGrace to return.
+func (s *service) drain() {
+	timeout := DefaultDrainTimeout
+	if s.cfg != nil && s.cfg.DrainTimeout > 0 {
+		timeout = s.cfg.DrainTimeout
+	}
+
+	idle := s.streams.drain()
+	if n := s.streams.inFlight(); n > 0 {
+		log.Infof("Draining %d streams in flight, for up to %v", n, timeout)
+	}
+
+	select {
+	case <-idle:
+		return
+	case <-time.After(timeout):
+	}
+
+	log.Warnf("Drain timeout of %v reached: cancelling %d streams", timeout, s.streams.inFlight())
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	select {
+	case <-idle:
+	case <-time.After(drainGrace):
+		log.Errorf("%d streams still in flight after cancellation", s.streams.inFlight())
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/ledger"
+	"github.com/danielnegri/tokenapi-go/source"
+	"github.com/danielnegri/tokenapi-go/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+// gateStorage blocks every insert after the first n until release is
+// closed.
+type gateStorage struct {
+	*memory.Memory
+	n       int32
+	calls   int32
+	once    sync.Once
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (s *gateStorage) Insert(ctx context.Context, token ledger.Token) error {
+	if atomic.AddInt32(&s.calls, 1) > s.n {
+		s.once.Do(func() { close(s.blocked) })
+		<-s.release
+	}
+	return s.Memory.Insert(ctx, token)
+}
+
+func TestShutdown_drain(t *testing.T) {
+	storage := &gateStorage{Memory: memory.New(), n: 5, blocked: make(chan struct{}), release: make(chan struct{})}
+	s, _ := newTestService(source.NewSeeded(nil), 2)
+	s.storage = storage
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	h := s.newHandler()
+
+	w := httptest.NewRecorder()
+	served := make(chan struct{})
+	go func() {
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, fmt.Sprintf("%s/tokens?size=20", Prefix), nil))
+		close(served)
+	}()
+	<-storage.blocked
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Shutdown()
+		close(stopped)
+	}()
+	for !s.streams.isDraining() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// New work is refused and the readiness probe reports the drain.
+	refused := httptest.NewRecorder()
+	h.ServeHTTP(refused, httptest.NewRequest(http.MethodPost, fmt.Sprintf("%s/tokens?size=1", Prefix), nil))
+	assert.Equal(t, http.StatusServiceUnavailable, refused.Code)
+
+	code, body := ready(t, h)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, StatusDraining, body.Status)
+
+	select {
+	case <-stopped:
+		t.Fatal("Shutdown returned before the stream was drained")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(storage.release)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return once the stream was drained")
+	}
+	<-served
+
+	assert.Equal(t, 20, storage.Len())
+	assert.Equal(t, 20, strings.Count(w.Body.String(), "OK : "))
+	assert.True(t, strings.HasSuffix(w.Body.String(), "END: complete, 20 of 20 tokens committed\n"), w.Body.String())
+}
+
+func TestStreams_drain(t *testing.T) {
+	// Draining without streams in flight returns at once.
+	var empty streams
+	select {
+	case <-empty.drain():
+	default:
+		t.Fatal("drain blocked without streams in flight")
+	}
+	assert.False(t, empty.start())
+
+	var s streams
+	assert.True(t, s.start())
+	assert.True(t, s.start())
+	idle := s.drain()
+	assert.False(t, s.start())
+
+	s.done()
+	select {
+	case <-idle:
+		t.Fatal("drained with a stream in flight")
+	default:
+	}
+
+	s.done()
+	<-idle
+}
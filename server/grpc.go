@@ -0,0 +1,467 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/auth"
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/ledger"
+	"github.com/danielnegri/tokenapi-go/ledgerpb"
+	"github.com/danielnegri/tokenapi-go/log"
+	"github.com/danielnegri/tokenapi-go/metrics"
+	"github.com/danielnegri/tokenapi-go/net/httputil"
+	"github.com/danielnegri/tokenapi-go/source"
+	"github.com/danielnegri/tokenapi-go/tracing"
+	"github.com/golang/protobuf/ptypes"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/propagation"
+	"go.opentelemetry.io/otel/api/standard"
+	"go.opentelemetry.io/otel/api/trace"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	grpcService     = "ledger.v1.Ledger"
+	grpcIssueMethod = "/" + grpcService + "/Issue"
+
+	// grpcMethodLabel is the method label of gRPC calls in the request
+	// metrics, where HTTP requests are labelled by their HTTP method.
+	grpcMethodLabel = "gRPC"
+)
+
+// grpcScopes are the scopes required by the methods of the gRPC API. Other
+// methods, of the health and reflection services, need no credentials.
+var grpcScopes = map[string]auth.Scope{
+	grpcIssueMethod:               auth.ScopeIssue,
+	"/" + grpcService + "/Verify": auth.ScopeVerify,
+	"/" + grpcService + "/Lookup": auth.ScopeVerify,
+	"/" + grpcService + "/Revoke": auth.ScopeRevoke,
+}
+
+// newGRPCServer returns a gRPC server serving the Ledger API, the standard
+// health service and server reflection. Calls are traced and measured as
+// HTTP requests are, and panics are recovered inside, so that they are
+// recorded as Internal errors.
+func (s *service) newGRPCServer() *grpc.Server {
+	tracer := tracing.Tracer()
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(instrumentUnary(tracer), recoverUnary, s.unaryInterceptor),
+		grpc.ChainStreamInterceptor(instrumentStream(tracer), recoverStream, s.streamInterceptor),
+	)
+	ledgerpb.RegisterLedgerServer(srv, &grpcLedger{svc: s})
+
+	s.grpcHealth = health.NewServer()
+	s.grpcHealth.SetServingStatus(grpcService, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(srv, s.grpcHealth)
+
+	reflection.Register(srv)
+	return srv
+}
+
+// grpcServer runs a gRPC server with the lifecycle of the net server.
+type grpcServer struct {
+	*grpc.Server
+}
+
+// Shutdown waits for the calls in flight to finish, or cancels them once
+// ctx is done.
+func (g grpcServer) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		g.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		g.Stop()
+		return ctx.Err()
+	}
+}
+
+// instrumentUnary returns an interceptor that traces unary calls and
+// observes their latency, as httputil.TracingHandler and
+// httputil.MetricsHandler do for HTTP requests.
+func instrumentUnary(tracer trace.Tracer) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, end := startCall(ctx, tracer, info.FullMethod)
+		resp, err := handler(ctx, req)
+		end(err)
+		return resp, err
+	}
+}
+
+// instrumentStream returns an interceptor that traces streaming calls and
+// observes their latency, including the time spent streaming.
+func instrumentStream(tracer trace.Tracer) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, end := startCall(ss.Context(), tracer, info.FullMethod)
+		err := handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+		end(err)
+		return err
+	}
+}
+
+// startCall starts a server span for a call to method, continuing the trace
+// found in the metadata. The returned function ends the span with the status
+// of err and observes the latency of the call.
+func startCall(ctx context.Context, tracer trace.Tracer, method string) (context.Context, func(err error)) {
+	start := time.Now()
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = propagation.ExtractHTTP(ctx, global.Propagators(), metadataSupplier(md))
+	ctx, span := tracer.Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			kv.String("rpc.system", "grpc"),
+			standard.RPCServiceKey.String(grpcService),
+			kv.String("rpc.method", method[strings.LastIndex(method, "/")+1:]),
+		),
+	)
+
+	return ctx, func(err error) {
+		st := status.Convert(err)
+		span.SetAttributes(kv.String("rpc.grpc.status_code", st.Code().String()))
+		span.SetStatus(st.Code(), st.Message())
+		span.End()
+
+		metrics.RequestSeconds.WithLabelValues(grpcMethodLabel, method, st.Code().String()).Observe(time.Since(start).Seconds())
+	}
+}
+
+// metadataSupplier reads and writes the trace context headers in gRPC
+// metadata.
+type metadataSupplier metadata.MD
+
+func (m metadataSupplier) Get(key string) string {
+	return first(metadata.MD(m), strings.ToLower(key))
+}
+
+func (m metadataSupplier) Set(key, value string) {
+	metadata.MD(m).Set(key, value)
+}
+
+// recoverUnary recovers from panics in unary calls, as gin.Recovery does for
+// HTTP requests, and fails the call with an Internal error.
+func recoverUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer recoverCall(ctx, info.FullMethod, &err)
+	return handler(ctx, req)
+}
+
+// recoverStream recovers from panics in streaming calls and fails the call
+// with an Internal error.
+func recoverStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer recoverCall(ss.Context(), info.FullMethod, &err)
+	return handler(srv, ss)
+}
+
+// recoverCall logs the panic of a call to method, if any, with its stack and
+// sets err to an Internal error. It must be deferred.
+func recoverCall(ctx context.Context, method string, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	log.FromContext(ctx).WithField("method", method).Errorf("panic recovered: %v\n%s", r, debug.Stack())
+	*err = status.Error(codes.Internal, errors.Internal.String())
+}
+
+func (s *service) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.grpcContext(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := handler(ctx, req)
+	return resp, grpcError(ctx, err)
+}
+
+func (s *service) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.grpcContext(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+
+	return grpcError(ctx, handler(srv, &serverStream{ServerStream: ss, ctx: ctx}))
+}
+
+// serverStream overrides the context of a grpc.ServerStream.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// grpcContext prepares the context of a call, as the HTTP middlewares do
+// for requests: it carries a request ID, a logger and the principal of the
+// client, authorized for the scope of method.
+func (s *service) grpcContext(ctx context.Context, method string) (context.Context, error) {
+	const op errors.Op = "server/service.grpcContext"
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	id := httputil.RequestIDOrNew(first(md, strings.ToLower(httputil.RequestIDHeader)))
+	_ = grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(httputil.RequestIDHeader), id))
+
+	ctx = log.WithRequestID(ctx, id)
+	logger := log.FromContext(ctx).WithField("method", method)
+	ctx = log.NewContext(ctx, logger)
+
+	scope, ok := grpcScopes[method]
+	if !ok || s.cfg.AuthDisabled {
+		return ctx, nil
+	}
+
+	credential := grpcCredentials(md)
+	if credential == "" {
+		return nil, status.Error(codes.Unauthenticated, "missing credentials")
+	}
+
+	principal, err := s.authenticate(ctx, credential)
+	if err == nil {
+		err = principal.Authorize(ctx, scope)
+	}
+	if err != nil {
+		err = errors.E(op, ctx, err)
+		logger.Warn(err)
+		return nil, grpcError(ctx, err)
+	}
+
+	ctx = auth.NewContext(ctx, principal)
+	return log.NewContext(ctx, logger.WithField(httputil.ClientKey, principal.ID)), nil
+}
+
+// grpcCredentials returns the API key or the JWT sent in the metadata of a
+// call, as a bearer token in authorization or in x-api-key.
+func grpcCredentials(md metadata.MD) string {
+	if h := first(md, "authorization"); len(h) > len("Bearer ") && strings.EqualFold(h[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(h[len("Bearer "):])
+	}
+
+	return strings.TrimSpace(first(md, strings.ToLower(APIKeyHeader)))
+}
+
+func first(md metadata.MD, key string) string {
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// grpcCodes maps the kinds of errors to gRPC status codes, as
+// httputil.AbortWithError maps them to HTTP statuses.
+var grpcCodes = map[errors.Kind]codes.Code{
+	errors.Invalid:    codes.InvalidArgument,
+	errors.Permission: codes.PermissionDenied,
+	errors.IO:         codes.Unavailable,
+	errors.Duplicate:  codes.AlreadyExists,
+	errors.NotFound:   codes.NotFound,
+	errors.Private:    codes.PermissionDenied,
+	errors.Internal:   codes.Internal,
+	errors.Transient:  codes.Unavailable,
+	errors.Exhausted:  codes.ResourceExhausted,
+}
+
+// grpcError converts err to a gRPC status error. The request ID is sent in
+// the metadata, and the time to wait before retrying in a RetryInfo.
+func grpcError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	code := codes.Unknown
+	if e, ok := err.(*errors.Error); ok {
+		if c, ok := grpcCodes[e.Kind]; ok {
+			code = c
+		}
+	}
+	if c, ok := contextCode(err); ok {
+		code = c
+	}
+
+	st := status.New(code, grpcMessage(err))
+	if wait, ok := httputil.RetryAfter(err); ok {
+		if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(wait)}); err == nil {
+			st = detailed
+		}
+	}
+
+	return st.Err()
+}
+
+// grpcMessage returns the message of the status of err, made of the kind and
+// the underlying error of each *errors.Error it wraps. Operations are left
+// out, and the request ID is already in the metadata.
+func grpcMessage(err error) string {
+	var parts []string
+	for err != nil {
+		e, ok := err.(*errors.Error)
+		if !ok {
+			parts = append(parts, log.Redact(err.Error()))
+			break
+		}
+
+		if e.Kind != errors.Other {
+			parts = append(parts, e.Kind.String())
+		}
+		err = e.Err
+	}
+	return strings.Join(parts, ": ")
+}
+
+// contextCode returns the code of the context error wrapped by err, if any.
+func contextCode(err error) (codes.Code, bool) {
+	for err != nil {
+		switch err {
+		case context.Canceled:
+			return codes.Canceled, true
+		case context.DeadlineExceeded:
+			return codes.DeadlineExceeded, true
+		}
+
+		switch e := err.(type) {
+		case *errors.Error:
+			err = e.Err
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return codes.Unknown, false
+		}
+	}
+	return codes.Unknown, false
+}
+
+// grpcLedger implements the Ledger gRPC API on top of the service.
+type grpcLedger struct {
+	ledgerpb.UnimplementedLedgerServer
+	svc *service
+}
+
+var _ ledgerpb.LedgerServer = (*grpcLedger)(nil)
+
+func (g *grpcLedger) Issue(req *ledgerpb.IssueRequest, ss ledgerpb.Ledger_IssueServer) error {
+	ctx := ss.Context()
+	if err := g.svc.checkSize(ctx, grpcIssueMethod, int(req.Size)); err != nil {
+		return err
+	}
+
+	return g.svc.issue(ctx, issueRequest{size: int(req.Size), ordered: req.Ordered}, &grpcStream{ss: ss})
+}
+
+func (g *grpcLedger) Verify(ctx context.Context, req *ledgerpb.TokenRequest) (*ledgerpb.Verification, error) {
+	v, err := g.svc.verify(ctx, ledger.Token(req.Token))
+	if err != nil {
+		return nil, err
+	}
+
+	return &ledgerpb.Verification{Token: string(v.Token), Valid: v.Valid}, nil
+}
+
+func (g *grpcLedger) Lookup(ctx context.Context, req *ledgerpb.TokenRequest) (*ledgerpb.TokenRecord, error) {
+	record, err := g.svc.lookup(ctx, ledger.Token(req.Token))
+	if err != nil {
+		return nil, err
+	}
+
+	return newTokenRecordProto(record)
+}
+
+func (g *grpcLedger) Revoke(ctx context.Context, req *ledgerpb.TokenRequest) (*ledgerpb.TokenRecord, error) {
+	record, err := g.svc.revoke(ctx, ledger.Token(req.Token))
+	if err != nil {
+		return nil, err
+	}
+
+	return newTokenRecordProto(record)
+}
+
+func newTokenRecordProto(r *ledger.Record) (*ledgerpb.TokenRecord, error) {
+	const op errors.Op = "server/newTokenRecordProto"
+
+	issuedAt, err := ptypes.TimestampProto(r.IssuedAt)
+	if err != nil {
+		return nil, errors.E(op, errors.Internal, err)
+	}
+
+	record := &ledgerpb.TokenRecord{Token: string(r.Token), IssuedAt: issuedAt}
+	if r.Revoked() {
+		if record.RevokedAt, err = ptypes.TimestampProto(r.RevokedAt); err != nil {
+			return nil, errors.E(op, errors.Internal, err)
+		}
+	}
+	return record, nil
+}
+
+// grpcStream sends the events of a request as IssueEvent messages. Clients
+// cancel the request by cancelling the call.
+type grpcStream struct {
+	ss ledgerpb.Ledger_IssueServer
+}
+
+func (g *grpcStream) begin(batch *source.Batch) error {
+	if batch.Trace != nil {
+		_ = g.ss.SetHeader(metadata.Pairs("server-timing", batch.Trace.ServerTiming()))
+	}
+	return nil
+}
+
+func (g *grpcStream) result(r tokenResult) {
+	_ = g.ss.Send(&ledgerpb.IssueEvent{Event: &ledgerpb.IssueEvent_Result{Result: &ledgerpb.TokenResult{
+		Index:  int32(r.Index),
+		Token:  string(r.Token),
+		Result: r.Result,
+	}}})
+}
+
+func (g *grpcStream) progress(p issueProgress) {
+	_ = g.ss.Send(&ledgerpb.IssueEvent{Event: &ledgerpb.IssueEvent_Progress{Progress: &ledgerpb.Progress{
+		Done:   int32(p.Done),
+		Total:  int32(p.Total),
+		Issued: int32(p.Issued),
+	}}})
+}
+
+func (g *grpcStream) end(sum issueSummary) {
+	_ = g.ss.Send(&ledgerpb.IssueEvent{Event: &ledgerpb.IssueEvent_Summary{Summary: &ledgerpb.Summary{
+		Status:    sum.Status,
+		Requested: int32(sum.Requested),
+		Tokens:    int32(sum.Tokens),
+		Rejected:  int32(sum.Rejected),
+		Issued:    int32(sum.Issued),
+		Failed:    int32(sum.Failed),
+		Cancelled: int32(sum.Cancelled),
+	}}})
+}
@@ -0,0 +1,278 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/auth"
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/ledger"
+	"github.com/danielnegri/tokenapi-go/ledgerpb"
+	"github.com/danielnegri/tokenapi-go/metrics"
+	"github.com/danielnegri/tokenapi-go/quota"
+	"github.com/danielnegri/tokenapi-go/source"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// dialGRPC serves the gRPC API of s in memory and returns a connection to
+// it.
+func dialGRPC(t *testing.T, s *service) (*grpc.ClientConn, func()) {
+	ln := bufconn.Listen(1 << 20)
+	srv := s.newGRPCServer()
+	go func() { _ = srv.Serve(ln) }()
+
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(),
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return ln.Dial() }))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn, func() {
+		_ = conn.Close()
+		srv.Stop()
+	}
+}
+
+// issue calls Issue and returns the tokens issued and the summary.
+func issue(t *testing.T, ctx context.Context, client ledgerpb.LedgerClient, size int32) ([]string, *ledgerpb.Summary, error) {
+	stream, err := client.Issue(ctx, &ledgerpb.IssueRequest{Size: size, Ordered: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tokens []string
+	for {
+		event, err := stream.Recv()
+		if err == io.EOF {
+			return tokens, nil, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch e := event.Event.(type) {
+		case *ledgerpb.IssueEvent_Result:
+			assert.Equal(t, int32(len(tokens)), e.Result.Index)
+			tokens = append(tokens, e.Result.Token)
+		case *ledgerpb.IssueEvent_Summary:
+			return tokens, e.Summary, nil
+		}
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	s, storage := newTestService(source.NewSeeded(nil), 4)
+	conn, stop := dialGRPC(t, s)
+	defer stop()
+
+	ctx := context.Background()
+	client := ledgerpb.NewLedgerClient(conn)
+
+	tokens, summary, err := issue(t, ctx, client, 10)
+	if assert.NoError(t, err) && assert.NotNil(t, summary) {
+		assert.Len(t, tokens, 10)
+		assert.Equal(t, StatusComplete, summary.Status)
+		assert.Equal(t, int32(10), summary.Issued)
+		assert.Equal(t, 10, storage.Len())
+	}
+
+	v, err := client.Verify(ctx, &ledgerpb.TokenRequest{Token: tokens[0]})
+	if assert.NoError(t, err) {
+		assert.True(t, v.Valid)
+	}
+
+	record, err := client.Revoke(ctx, &ledgerpb.TokenRequest{Token: tokens[0]})
+	if assert.NoError(t, err) {
+		assert.NotNil(t, record.IssuedAt)
+		assert.NotNil(t, record.RevokedAt)
+	}
+
+	record, err = client.Lookup(ctx, &ledgerpb.TokenRequest{Token: tokens[0]})
+	if assert.NoError(t, err) {
+		assert.NotNil(t, record.RevokedAt)
+	}
+
+	_, err = client.Lookup(ctx, &ledgerpb.TokenRequest{Token: "ijkr2lXOkM1EElPSDQFkeg"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.Verify(ctx, &ledgerpb.TokenRequest{Token: "has-dash"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, _, err = issue(t, ctx, client, 0)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// The health and reflection services are served too.
+	health, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: grpcService})
+	if assert.NoError(t, err) {
+		assert.Equal(t, healthpb.HealthCheckResponse_SERVING, health.Status)
+	}
+
+	refl, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if assert.NoError(t, err) {
+		assert.NoError(t, refl.Send(&reflectionpb.ServerReflectionRequest{
+			MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+		}))
+		resp, err := refl.Recv()
+		if assert.NoError(t, err) {
+			var services []string
+			for _, svc := range resp.GetListServicesResponse().Service {
+				services = append(services, svc.Name)
+			}
+			assert.Contains(t, services, grpcService)
+		}
+	}
+
+	s.Shutdown()
+	health, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: grpcService})
+	if assert.NoError(t, err) {
+		assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, health.Status)
+	}
+}
+
+func TestGRPC_auth(t *testing.T) {
+	s, storage := newTestService(source.NewSeeded(nil), 1)
+	s.cfg.AuthDisabled = false
+	conn, stop := dialGRPC(t, s)
+	defer stop()
+
+	client := ledgerpb.NewLedgerClient(conn)
+	req := &ledgerpb.TokenRequest{Token: "ijkr2lXOkM1EElPSDQFkeg"}
+
+	_, err := client.Verify(context.Background(), req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	apiKey, key, err := auth.NewKey("backend", []auth.Scope{auth.ScopeVerify})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, storage.CreateKey(context.Background(), key))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+apiKey)
+	_, err = client.Verify(ctx, req)
+	assert.NoError(t, err)
+
+	_, err = client.Revoke(ctx, req)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "x-api-key", apiKey)
+	_, err = client.Verify(ctx, req)
+	assert.NoError(t, err)
+}
+
+// panicRegistry and panicSource panic on every call: the interfaces they
+// embed are nil.
+type panicRegistry struct{ ledger.Registry }
+type panicSource struct{ source.Source }
+
+func TestGRPC_panic(t *testing.T) {
+	s, _ := newTestService(panicSource{}, 1)
+	s.registry = panicRegistry{}
+	conn, stop := dialGRPC(t, s)
+	defer stop()
+
+	ctx := context.Background()
+	client := ledgerpb.NewLedgerClient(conn)
+	method := "/" + grpcService + "/Verify"
+	calls := sampleCount(t, method, codes.Internal)
+
+	_, err := client.Verify(ctx, &ledgerpb.TokenRequest{Token: "ijkr2lXOkM1EElPSDQFkeg"})
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.Equal(t, calls+1, sampleCount(t, method, codes.Internal))
+
+	_, _, err = issue(t, ctx, client, 10)
+	assert.Equal(t, codes.Internal, status.Code(err))
+
+	// The server keeps serving.
+	health, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: grpcService})
+	if assert.NoError(t, err) {
+		assert.Equal(t, healthpb.HealthCheckResponse_SERVING, health.Status)
+	}
+}
+
+// sampleCount returns the number of calls to method that ended with code
+// observed in the request metrics.
+func sampleCount(t *testing.T, method string, code codes.Code) uint64 {
+	var m dto.Metric
+	if err := metrics.RequestSeconds.WithLabelValues(grpcMethodLabel, method, code.String()).(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestGRPCError(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		err  error
+		code codes.Code
+	}{
+		{errors.E(errors.Invalid, "bad"), codes.InvalidArgument},
+		{errors.E(errors.NotFound), codes.NotFound},
+		{errors.E(errors.Permission), codes.PermissionDenied},
+		{errors.E(errors.Transient), codes.Unavailable},
+		{errors.E(errors.Internal), codes.Internal},
+		{io.EOF, codes.Unknown},
+		{status.Error(codes.Canceled, "cancelled"), codes.Canceled},
+		{context.Canceled, codes.Canceled},
+		{errors.E(errors.Internal, errors.E(errors.Transient, context.Canceled)), codes.Canceled},
+		{errors.E(errors.Internal, &url.Error{Op: "Post", URL: "/", Err: context.DeadlineExceeded}), codes.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.code, status.Code(grpcError(ctx, tt.err)), tt.err.Error())
+	}
+
+	// Messages keep the kinds and underlying errors, without operations
+	// or request IDs.
+	messages := []struct {
+		err error
+		msg string
+	}{
+		{errors.E(errors.Op("server/service.issue"), errors.Invalid, "size: must be positive"), "invalid operation: size: must be positive"},
+		{errors.E(errors.Invalid, "size: must be positive"), "invalid operation: size: must be positive"},
+		{errors.E(errors.Op("a"), errors.Internal, errors.E(errors.Op("b"), errors.Transient, errors.Str("timeout"))), "internal error: transient error: timeout"},
+		{&errors.Error{Kind: errors.NotFound, RequestID: "r1"}, errors.NotFound.String()},
+		{io.EOF, "EOF"},
+	}
+	for _, tt := range messages {
+		assert.Equal(t, tt.msg, status.Convert(grpcError(ctx, tt.err)).Message())
+	}
+
+	// The wait of exhausted quotas is sent as a RetryInfo.
+	err := grpcError(ctx, errors.E(errors.Exhausted, &quota.ExceededError{Wait: 30 * time.Second}))
+	st := status.Convert(err)
+	assert.Equal(t, codes.ResourceExhausted, st.Code())
+	if assert.Len(t, st.Details(), 1) {
+		info := st.Details()[0].(*errdetails.RetryInfo)
+		wait, _ := ptypes.Duration(info.RetryDelay)
+		assert.Equal(t, 30*time.Second, wait)
+	}
+}
@@ -19,14 +19,17 @@ import (
 	"fmt"
 	"net/http"
 	"runtime"
-	"strconv"
 	"time"
 
+	"github.com/danielnegri/tokenapi-go/auth"
 	"github.com/danielnegri/tokenapi-go/errors"
 	"github.com/danielnegri/tokenapi-go/ledger"
 	"github.com/danielnegri/tokenapi-go/log"
+	"github.com/danielnegri/tokenapi-go/metrics"
 	"github.com/danielnegri/tokenapi-go/net/httputil"
-	"github.com/danielnegri/tokenapi-go/sync"
+	"github.com/danielnegri/tokenapi-go/quota"
+	"github.com/danielnegri/tokenapi-go/source"
+	"github.com/danielnegri/tokenapi-go/tracing"
 	"github.com/danielnegri/tokenapi-go/version"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -37,14 +40,33 @@ const Prefix = "/api/v1"
 func (s *service) newHandler() http.Handler {
 	router := gin.New()
 	router.Use(gin.Recovery())
+	router.Use(accessTokenHandler())
+	router.Use(httputil.RequestIDHandler())
+	router.Use(httputil.TracingHandler(tracing.Tracer()))
+	router.Use(httputil.MetricsHandler(metrics.RequestSeconds))
+	router.Use(httputil.LoggerHandler(log.Logger(), time.RFC3339, true))
 	router.Use(cors.Default())
 	router.NoRoute(httputil.NotFoundHandler)
 
 	router.GET("/", s.handleRoot())
 	router.GET("/health/heartbeat", s.handleHeartbeat())
+	router.GET("/health/live", s.handleLive())
+	s.healthChecks = s.newHealthChecks()
+	router.GET("/health/ready", s.handleReady(s.healthChecks))
+	if s.cfg.MetricsPort == 0 {
+		router.GET("/metrics", gin.WrapH(metrics.Handler()))
+	}
 
 	api := router.Group(Prefix)
-	api.POST("/tokens", s.handleInsert())
+	api.GET("/openapi.json", s.handleOpenAPI())
+	api.POST("/tokens", s.authorize(auth.ScopeIssue), s.handleInsert())
+	api.GET("/tokens/stream", s.authorize(auth.ScopeIssue), s.handleStream())
+	api.GET("/tokens/ws", s.authorize(auth.ScopeIssue), s.handleWebSocket())
+	api.POST("/tokens/verify", s.authorize(auth.ScopeVerify), s.handleVerify())
+	api.POST("/tokens/lookup", s.authorize(auth.ScopeVerify), s.handleLookup())
+	api.POST("/tokens/revoke", s.authorize(auth.ScopeRevoke), s.handleRevoke())
+	api.GET("/admin/usage", s.authorize(auth.ScopeAdmin), s.handleUsage())
+	api.GET("/limits", s.authorize(""), s.handleLimits())
 	return router
 }
 
@@ -66,7 +88,7 @@ func (s *service) handleRoot() gin.HandlerFunc {
 
 func (s *service) handleHeartbeat() gin.HandlerFunc {
 	heartbeat := gin.H{
-		"startup_time": time.Now(),
+		"startup_time": startTime,
 		"current_time": time.Now(),
 		"message":      http.StatusText(http.StatusOK),
 		"service":      ledger.Description,
@@ -76,7 +98,7 @@ func (s *service) handleHeartbeat() gin.HandlerFunc {
 
 	return func(ctx *gin.Context) {
 		now := time.Now()
-		switch ctx.NegotiateFormat(gin.MIMEHTML, gin.MIMEJSON) {
+		switch ctx.NegotiateFormat(gin.MIMEPlain, gin.MIMEJSON) {
 		case gin.MIMEJSON:
 			heartbeat["current_time"] = now
 			ctx.JSON(http.StatusOK, heartbeat)
@@ -90,62 +112,77 @@ func (s *service) handleInsert() gin.HandlerFunc {
 	const op errors.Op = "server/service.handleInsert"
 
 	return func(ctx *gin.Context) {
-		rawsize := ctx.DefaultQuery("size", "0")
-		size, err := strconv.Atoi(rawsize)
-		if err != nil {
-			log.Error(errors.E(op, err))
-			httputil.AbortWithError(ctx, errors.E(errors.Invalid, "size must be an integer"))
-			return
+		// The request context carries the request ID, the request logger
+		// and the request span, which gin.Context does not expose to the
+		// source and the storage.
+		reqCtx := ctx.Request.Context()
+
+		req, err := s.issueRequest(ctx)
+		if err == nil {
+			err = s.issue(reqCtx, req, &plainStream{ctx: reqCtx, w: ctx.Writer, draining: s.streams.isDraining})
 		}
-
-		tokens, err := s.source.Generate(ctx, size)
 		if err != nil {
-			log.Error(errors.E(op, err))
-			httputil.AbortWithError(ctx, err)
-			return
+			abortIssue(ctx, errors.E(op, reqCtx, err))
 		}
+	}
+}
 
-		w := ctx.Writer
-		h := w.Header()
-		h.Set("Transfer-Encoding", "chunked")
-		h.Set("Content-Type", gin.MIMEPlain)
-		w.WriteHeader(http.StatusOK)
-
-		count := 0
-		lines := make(chan string)
-		finished := make(chan struct{}, 1)
-		go s.insert(ctx, tokens, lines, finished)
-		for {
-			select {
-			case line := <-lines:
-				w.Write([]byte(line + "\n"))
-				w.Flush()
-				count++
-			case <-finished:
-				log.Debugf("Processed %d tokens", count)
-				return
-			}
-		}
+// plainStream writes the results of a request as lines of plain text:
+//
+//	OK : <token>
+//	ERR: <token>
+//
+// Streams open during a shutdown end with a status line, so that clients
+// can tell a drained stream from a cut one.
+type plainStream struct {
+	ctx      context.Context
+	w        gin.ResponseWriter
+	draining func() bool
+}
+
+func (p *plainStream) begin(batch *source.Batch) error {
+	h := p.w.Header()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Content-Type", gin.MIMEPlain)
+	if batch.Trace != nil {
+		h.Set("Server-Timing", batch.Trace.ServerTiming())
 	}
+	p.w.WriteHeader(http.StatusOK)
+	return nil
 }
 
-func (s *service) insert(ctx context.Context, tokens []ledger.Token, lines chan string, finished chan struct{}) {
-	wg := sync.NewWaitGroup(s.cfg.Concurrency)
-	for _, token := range tokens {
-		wg.Add()
-		go func(c context.Context, t ledger.Token) {
-			defer wg.Done()
+func (p *plainStream) result(r tokenResult) {
+	p.w.Write([]byte(r.line() + "\n"))
+	p.w.Flush()
+}
 
-			line := fmt.Sprintf("OK : %v", t)
-			if err := s.storage.Insert(c, t); err != nil {
-				line = fmt.Sprintf("ERR: %v", t)
-			}
+func (p *plainStream) progress(issueProgress) {}
 
-			log.Debug(line)
-			lines <- line
-		}(ctx, token)
+func (p *plainStream) end(sum issueSummary) {
+	if !p.draining() || p.ctx.Err() != nil {
+		return
 	}
 
-	wg.Wait()
-	finished <- struct{}{}
+	fmt.Fprintf(p.w, "END: %s, %d of %d tokens committed\n", sum.Status, sum.Issued, sum.Tokens)
+	p.w.Flush()
+}
+
+// handleUsage reports the tokens issued by each client in the current
+// quota windows.
+func (s *service) handleUsage() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		usage := []quota.Usage{}
+		if s.quota != nil {
+			u, err := s.quota.Usage(ctx.Request.Context())
+			if err != nil {
+				httputil.AbortWithError(ctx, err)
+				return
+			}
+			if u != nil {
+				usage = u
+			}
+		}
+
+		ctx.JSON(http.StatusOK, gin.H{"usage": usage})
+	}
 }
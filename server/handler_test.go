@@ -0,0 +1,244 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/breaker"
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/metrics"
+	"github.com/danielnegri/tokenapi-go/net/httputil"
+	"github.com/danielnegri/tokenapi-go/source"
+	"github.com/danielnegri/tokenapi-go/storage/memory"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func newTestService(src source.Source, concurrency int) (*service, *memory.Memory) {
+	storage := memory.New()
+	return &service{
+		cfg:      &Config{AuthDisabled: true, Concurrency: concurrency},
+		source:   src,
+		storage:  storage,
+		registry: storage,
+		keys:     storage,
+	}, storage
+}
+
+func insert(h http.Handler, size int) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("%s/tokens?size=%d", Prefix, size), nil)
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// expectedLines replays the seeded sequence into a fresh storage to compute
+// the lines handleInsert must stream, in source order.
+func expectedLines(t *testing.T, cfg *source.SeededConfig, sizes ...int) [][]string {
+	src := source.NewSeeded(cfg)
+	storage := memory.New()
+
+	var out [][]string
+	for _, size := range sizes {
+		batch, err := src.Generate(context.Background(), size)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lines := make([]string, 0, size)
+		for _, token := range batch.Tokens {
+			if err := storage.Insert(context.Background(), token); err != nil {
+				lines = append(lines, fmt.Sprintf("ERR: %v", token))
+			} else {
+				lines = append(lines, fmt.Sprintf("OK : %v", token))
+			}
+		}
+		out = append(out, lines)
+	}
+	return out
+}
+
+func TestHandleInsert(t *testing.T) {
+	cfg := &source.SeededConfig{Seed: 7, DashRate: 0.1, RepeatRate: 0.1}
+	sizes := []int{50, 50}
+	want := expectedLines(t, cfg, sizes...)
+
+	// A single worker streams results in source order.
+	s, storage := newTestService(source.NewSeeded(cfg), 1)
+	h := s.newHandler()
+
+	for i, lines := range want {
+		w := insert(h, sizes[i])
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, gin.MIMEPlain, w.Header().Get("Content-Type"))
+		assert.Equal(t, strings.Join(lines, "\n")+"\n", w.Body.String())
+	}
+
+	ok := 0
+	for _, lines := range want {
+		for _, line := range lines {
+			if strings.HasPrefix(line, "OK") {
+				ok++
+			}
+		}
+	}
+	assert.Equal(t, ok, storage.Len())
+}
+
+func TestHandleInsert_concurrent(t *testing.T) {
+	cfg := &source.SeededConfig{Seed: 11, DashRate: 0.05}
+	want := expectedLines(t, cfg, 200)[0]
+
+	s, _ := newTestService(source.NewSeeded(cfg), 8)
+	w := insert(s.newHandler(), 200)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	got := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	assert.ElementsMatch(t, want, got)
+}
+
+func TestHandleInsert_invalidSize(t *testing.T) {
+	s, _ := newTestService(source.NewSeeded(nil), 1)
+	h := s.newHandler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, Prefix+"/tokens?size=abc", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = insert(h, 0)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// trialSource fails its first call, then blocks every call until release
+// is closed.
+type trialSource struct {
+	source.Source
+	calls   int32
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *trialSource) Generate(ctx context.Context, n int) (*source.Batch, error) {
+	if atomic.AddInt32(&s.calls, 1) == 1 {
+		return nil, errors.E(errors.IO, "source unavailable")
+	}
+	s.entered <- struct{}{}
+	<-s.release
+	return s.Source.Generate(ctx, n)
+}
+
+func TestHandleInsert_breakerHalfOpen(t *testing.T) {
+	src := &trialSource{Source: source.NewSeeded(nil), entered: make(chan struct{}), release: make(chan struct{})}
+	b := breaker.New("source", &breaker.Config{FailureThreshold: 1, OpenTimeout: 10 * time.Millisecond})
+	s, _ := newTestService(source.WithBreaker(src, b), 1)
+	h := s.newHandler()
+
+	insert(h, 1)
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- insert(h, 1) }()
+	<-src.entered
+
+	// Calls beyond the trial call are told when to retry.
+	w := insert(h, 1)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	close(src.release)
+	assert.Equal(t, http.StatusOK, (<-done).Code)
+	assert.Equal(t, breaker.Closed, b.State())
+}
+
+func BenchmarkHandleInsert(b *testing.B) {
+	s, _ := newTestService(source.NewSeeded(&source.SeededConfig{Seed: 1, DashRate: 0.01, RepeatRate: 0.01}), 8)
+	h := s.newHandler()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		insert(h, 1000)
+	}
+}
+
+func TestHandleMetrics(t *testing.T) {
+	cfg := &source.SeededConfig{Seed: 3, DashRate: 0.2}
+	want := expectedLines(t, cfg, 20)[0]
+
+	issued := testutil.ToFloat64(metrics.Tokens.WithLabelValues(metrics.ResultIssued))
+	invalid := testutil.ToFloat64(metrics.Tokens.WithLabelValues(metrics.ResultInvalid))
+	requested := testutil.ToFloat64(metrics.TokensRequested)
+
+	s, _ := newTestService(source.NewSeeded(cfg), 1)
+	h := s.newHandler()
+	insert(h, 20)
+
+	ok := 0
+	for _, line := range want {
+		if strings.HasPrefix(line, "OK") {
+			ok++
+		}
+	}
+	assert.Equal(t, requested+20, testutil.ToFloat64(metrics.TokensRequested))
+	assert.Equal(t, issued+float64(ok), testutil.ToFloat64(metrics.Tokens.WithLabelValues(metrics.ResultIssued)))
+	assert.Equal(t, invalid+float64(20-ok), testutil.ToFloat64(metrics.Tokens.WithLabelValues(metrics.ResultInvalid)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.StreamsInFlight))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.InsertWorkers))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `ledger_http_request_duration_seconds_count{code="200",method="POST",route="/api/v1/tokens"}`)
+}
+
+func TestRequestID(t *testing.T) {
+	s, _ := newTestService(source.NewSeeded(nil), 1)
+	h := s.newHandler()
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, Prefix+"/tokens?size=0", nil)
+	req.Header.Set(httputil.RequestIDHeader, "client-id-1")
+	h.ServeHTTP(w, req)
+	assert.Equal(t, "client-id-1", w.Header().Get(httputil.RequestIDHeader))
+
+	var resp httputil.ErrorResponse
+	if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp)) {
+		assert.Equal(t, "client-id-1", resp.RequestID)
+		assert.NotContains(t, resp.Message, "client-id-1")
+	}
+
+	// An ID is generated when the client sends none or an invalid one.
+	req = httptest.NewRequest(http.MethodPost, Prefix+"/tokens?size=1", nil)
+	req.Header.Set(httputil.RequestIDHeader, "bad id\x01")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	id := w.Header().Get(httputil.RequestIDHeader)
+	assert.Len(t, id, 32)
+	assert.NotEqual(t, id, insert(h, 1).Header().Get(httputil.RequestIDHeader))
+}
@@ -0,0 +1,236 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/ledger"
+	"github.com/danielnegri/tokenapi-go/log"
+	"github.com/danielnegri/tokenapi-go/version"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// DefaultHealthTimeout bounds each dependency check.
+	DefaultHealthTimeout = 2 * time.Second
+
+	// DefaultHealthCache is how long the result of a dependency check is
+	// reused before the dependency is checked again.
+	DefaultHealthCache = 5 * time.Second
+)
+
+// Dependency statuses reported by the health endpoints.
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+
+	// StatusDraining is reported by the readiness probe once the service
+	// is shutting down.
+	StatusDraining = "draining"
+)
+
+// Reasons reported for a dependency that is down. The errors themselves
+// are only logged, as they may reveal the addresses and credentials of the
+// dependencies.
+const (
+	ReasonTimeout     = "timeout"
+	ReasonUnavailable = "unavailable"
+)
+
+// startTime approximates the start of the process.
+var startTime = time.Now()
+
+// DependencyStatus is the outcome of the last check of a dependency.
+type DependencyStatus struct {
+	Status    string    `json:"status"`
+	Latency   string    `json:"latency"`
+	CheckedAt time.Time `json:"checked_at"`
+	Reason    string    `json:"reason,omitempty"`
+
+	// LastReason is the reason of the most recent failure, kept after the
+	// dependency recovers.
+	LastReason    string     `json:"last_reason,omitempty"`
+	LastFailureAt *time.Time `json:"last_failure_at,omitempty"`
+}
+
+// healthCheck checks a dependency and caches the outcome.
+type healthCheck struct {
+	name    string
+	check   func(context.Context) error
+	timeout time.Duration
+	ttl     time.Duration
+	now     func() time.Time
+
+	// mu is held during a check so that concurrent probes share it.
+	mu     sync.Mutex
+	status DependencyStatus
+}
+
+func newHealthCheck(name string, cfg *Config, check func(context.Context) error) *healthCheck {
+	h := &healthCheck{
+		name:    name,
+		check:   check,
+		timeout: cfg.HealthTimeout,
+		ttl:     cfg.HealthCache,
+		now:     time.Now,
+	}
+
+	if h.timeout == 0 {
+		h.timeout = DefaultHealthTimeout
+	}
+
+	if h.ttl == 0 {
+		h.ttl = DefaultHealthCache
+	}
+
+	return h
+}
+
+// Status returns the cached status of the dependency, checking it first if
+// the cache has expired.
+func (h *healthCheck) Status(ctx context.Context) DependencyStatus {
+	const op errors.Op = "server/healthCheck.Status"
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.status.CheckedAt.IsZero() && h.now().Sub(h.status.CheckedAt) < h.ttl {
+		return h.status
+	}
+
+	// The result is shared with other probes, so a probe giving up must
+	// not cut the check short.
+	ctx, cancel := context.WithTimeout(detach(ctx), h.timeout)
+	defer cancel()
+
+	start := h.now()
+	err := h.check(ctx)
+	if err == nil && ctx.Err() != nil {
+		err = errors.E(op, errors.Transient, ctx.Err())
+	}
+
+	h.status.CheckedAt = h.now()
+	h.status.Latency = h.status.CheckedAt.Sub(start).String()
+	h.status.Status = StatusUp
+	h.status.Reason = ""
+	if err != nil {
+		log.FromContext(ctx).Errorf("%s health check failed: %v", h.name, err)
+
+		at := h.status.CheckedAt
+		h.status.Status = StatusDown
+		h.status.Reason = ReasonUnavailable
+		if ctx.Err() == context.DeadlineExceeded {
+			h.status.Reason = ReasonTimeout
+		}
+		h.status.LastReason = h.status.Reason
+		h.status.LastFailureAt = &at
+	}
+
+	return h.status
+}
+
+// detachedContext carries the values of its parent, such as the request ID
+// and the trace, without its deadline and cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func detach(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+func (s *service) newHealthChecks() []*healthCheck {
+	return []*healthCheck{
+		newHealthCheck("source", s.cfg, func(ctx context.Context) error {
+			if s.source == nil {
+				return errors.E(errors.Internal, "token source is not configured")
+			}
+			return s.source.Check(ctx)
+		}),
+		newHealthCheck("storage", s.cfg, func(ctx context.Context) error {
+			if s.storage == nil {
+				return errors.E(errors.Internal, "storage is not connected")
+			}
+			return s.storage.Check(ctx)
+		}),
+	}
+}
+
+// handleLive reports that the process is up and serving requests. It does
+// not check dependencies, so that an orchestrator does not restart the
+// service for an outage it cannot fix.
+func (s *service) handleLive() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		now := time.Now()
+		ctx.JSON(http.StatusOK, gin.H{
+			"service":      ledger.Description,
+			"status":       StatusUp,
+			"startup_time": startTime,
+			"current_time": now,
+			"uptime":       now.Sub(startTime).Round(time.Second).String(),
+			"version":      version.Version,
+		})
+	}
+}
+
+// handleReady checks every dependency, in parallel, and responds with 503
+// unless all of them are up and the service is not draining.
+func (s *service) handleReady(checks []*healthCheck) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		reqCtx := ctx.Request.Context()
+
+		statuses := make([]DependencyStatus, len(checks))
+		var wg sync.WaitGroup
+		for i, check := range checks {
+			wg.Add(1)
+			go func(i int, check *healthCheck) {
+				defer wg.Done()
+				statuses[i] = check.Status(reqCtx)
+			}(i, check)
+		}
+		wg.Wait()
+
+		code, status := http.StatusOK, StatusUp
+		dependencies := make(map[string]DependencyStatus, len(checks))
+		for i, check := range checks {
+			dependencies[check.name] = statuses[i]
+			if statuses[i].Status != StatusUp {
+				code, status = http.StatusServiceUnavailable, StatusDown
+			}
+		}
+		if s.streams.isDraining() {
+			code, status = http.StatusServiceUnavailable, StatusDraining
+		}
+
+		ctx.JSON(code, gin.H{
+			"service":      ledger.Description,
+			"status":       status,
+			"dependencies": dependencies,
+		})
+	}
+}
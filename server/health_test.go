@@ -0,0 +1,129 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/source"
+	"github.com/stretchr/testify/assert"
+)
+
+// checkSource is a Source whose Check fails while err is set.
+type checkSource struct {
+	source.Source
+	err   error
+	calls int
+}
+
+func (s *checkSource) Check(ctx context.Context) error {
+	s.calls++
+	return s.err
+}
+
+type readiness struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+}
+
+func ready(t *testing.T, h http.Handler) (int, readiness) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+
+	var body readiness
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, body
+}
+
+func TestHandleReady(t *testing.T) {
+	src := &checkSource{Source: source.NewSeeded(nil), err: errors.E(errors.Transient, "upstream down")}
+	s, _ := newTestService(src, 1)
+	s.cfg.HealthCache = time.Hour
+	h := s.newHandler()
+
+	now := time.Now()
+	for _, check := range s.healthChecks {
+		check.now = func() time.Time { return now }
+	}
+
+	code, body := ready(t, h)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, StatusDown, body.Status)
+	assert.Equal(t, StatusDown, body.Dependencies["source"].Status)
+	assert.Equal(t, ReasonUnavailable, body.Dependencies["source"].Reason)
+	assert.Equal(t, StatusUp, body.Dependencies["storage"].Status)
+
+	// The error itself is only logged.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+	assert.NotContains(t, w.Body.String(), "upstream down")
+
+	// The result is cached.
+	src.err = nil
+	code, _ = ready(t, h)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, 1, src.calls)
+
+	// Once the cache expires, the recovery shows and the last error is kept.
+	now = now.Add(2 * time.Hour)
+	code, body = ready(t, h)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, StatusUp, body.Status)
+	dep := body.Dependencies["source"]
+	assert.Equal(t, StatusUp, dep.Status)
+	assert.Empty(t, dep.Reason)
+	assert.Equal(t, ReasonUnavailable, dep.LastReason)
+	assert.NotNil(t, dep.LastFailureAt)
+}
+
+func TestHealthCheck_timeout(t *testing.T) {
+	s, _ := newTestService(source.NewSeeded(nil), 1)
+	s.cfg.HealthTimeout = 10 * time.Millisecond
+
+	check := newHealthCheck("slow", s.cfg, func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+
+	// A cancelled probe does not cut the shared check short.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	status := check.Status(ctx)
+	assert.Equal(t, StatusDown, status.Status)
+	assert.Equal(t, ReasonTimeout, status.Reason)
+}
+
+func TestHandleLive(t *testing.T) {
+	s, _ := newTestService(source.NewSeeded(nil), 1)
+
+	w := httptest.NewRecorder()
+	s.newHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health/live", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var body struct {
+		StartupTime time.Time `json:"startup_time"`
+	}
+	if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body)) {
+		assert.True(t, body.StartupTime.Equal(startTime))
+	}
+}
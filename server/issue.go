@@ -0,0 +1,391 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/auth"
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/ledger"
+	"github.com/danielnegri/tokenapi-go/log"
+	"github.com/danielnegri/tokenapi-go/metrics"
+	"github.com/danielnegri/tokenapi-go/net/httputil"
+	"github.com/danielnegri/tokenapi-go/quota"
+	"github.com/danielnegri/tokenapi-go/source"
+	"github.com/danielnegri/tokenapi-go/sync"
+	"github.com/danielnegri/tokenapi-go/tracing"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/api/kv"
+)
+
+// progressSteps is the number of progress events sent over a request.
+const progressSteps = 20
+
+// Statuses of a finished request.
+const (
+	StatusComplete  = "complete"
+	StatusCancelled = "cancelled"
+)
+
+// refundTimeout bounds the refund of the tokens a request did not issue.
+const refundTimeout = 5 * time.Second
+
+// issueRequest holds the parameters of a request for tokens, shared by the
+// streaming formats.
+type issueRequest struct {
+	size    int
+	ordered bool
+}
+
+// tokenResult is the outcome of storing a token. Result is one of the
+// metrics result labels.
+type tokenResult struct {
+	Index  int          `json:"index"`
+	Token  ledger.Token `json:"token"`
+	Result string       `json:"result"`
+}
+
+// line returns the result in the plain text format.
+func (r tokenResult) line() string {
+	if r.Result == metrics.ResultIssued {
+		return fmt.Sprintf("OK : %v", r.Token)
+	}
+	return fmt.Sprintf("ERR: %v", r.Token)
+}
+
+// issueProgress reports how many of the tokens of a request are done.
+type issueProgress struct {
+	Done   int `json:"done"`
+	Total  int `json:"total"`
+	Issued int `json:"issued"`
+}
+
+// issueSummary is the outcome of a request. Tokens is the number of valid
+// tokens received from the source, out of the Requested ones; Rejected
+// ones failed its validation.
+type issueSummary struct {
+	Status    string `json:"status"`
+	Requested int    `json:"requested"`
+	Tokens    int    `json:"tokens"`
+	Rejected  int    `json:"rejected"`
+	Issued    int    `json:"issued"`
+	Failed    int    `json:"failed"`
+	Cancelled int    `json:"cancelled"`
+
+	// SourceTiming is the latency breakdown of the Token source call in
+	// milliseconds, keyed by phase, when the source is traced.
+	SourceTiming map[string]float64 `json:"source_timing,omitempty"`
+}
+
+func (sum *issueSummary) add(r tokenResult) {
+	switch r.Result {
+	case metrics.ResultIssued:
+		sum.Issued++
+	case metrics.ResultCancelled:
+		sum.Cancelled++
+	default:
+		sum.Failed++
+	}
+}
+
+// stream writes the events of a request in one of the streaming formats.
+// Its methods are called from a single goroutine.
+type stream interface {
+	// begin is called once the tokens are generated. An error stops the
+	// request before any token is stored.
+	begin(batch *source.Batch) error
+	result(r tokenResult)
+	progress(p issueProgress)
+	end(sum issueSummary)
+}
+
+// issueRequest parses the parameters of a request for tokens.
+func (s *service) issueRequest(ctx *gin.Context) (issueRequest, error) {
+	size, err := s.size(ctx)
+	if err != nil {
+		return issueRequest{}, err
+	}
+
+	ordered, err := parseOrdered(ctx)
+	if err != nil {
+		return issueRequest{}, err
+	}
+
+	return issueRequest{size: size, ordered: ordered}, nil
+}
+
+// parseOrdered reports whether the request asks for results in the order
+// of the tokens, with ?ordered=true.
+func parseOrdered(ctx *gin.Context) (bool, error) {
+	const op errors.Op = "server/parseOrdered"
+
+	v, ok := ctx.GetQuery("ordered")
+	if !ok || v == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, errors.E(op, errors.Invalid, "ordered must be true or false")
+	}
+	return b, nil
+}
+
+// abortIssue logs err, which failed a request for tokens before its stream
+// began, and responds with it.
+func abortIssue(ctx *gin.Context, err error) {
+	logger := log.FromContext(ctx.Request.Context())
+	switch {
+	case errors.Is(errors.Invalid, err), errors.Is(errors.Exhausted, err):
+		logger.Warn(err)
+	default:
+		logger.Error(err)
+	}
+
+	if !ctx.Writer.Written() {
+		httputil.AbortWithError(ctx, err)
+	}
+}
+
+// issue generates the tokens of req and stores them, reporting the events
+// of the request to out. It fails before out begins when the request cannot
+// be served; once begun, the outcome is reported by out.end. Work stops when
+// ctx is done or the service shuts down, and results are no longer reported
+// once ctx is done.
+func (s *service) issue(ctx context.Context, req issueRequest, out stream) error {
+	const op errors.Op = "server/service.issue"
+
+	if !s.streams.start() {
+		return errors.E(op, ctx, errors.Transient, "service is shutting down")
+	}
+	defer s.streams.done()
+
+	// Fail fast rather than generating tokens that cannot be stored.
+	if s.storageBreaker != nil {
+		if err := s.storageBreaker.Err(); err != nil {
+			return errors.E(op, ctx, err)
+		}
+	}
+
+	reservation, err := s.allow(ctx, req.size)
+	if err != nil {
+		return errors.E(op, ctx, err)
+	}
+
+	// Only the tokens committed are charged, whatever stops the others.
+	issued := 0
+	defer func() { s.refund(ctx, reservation, req.size-issued) }()
+
+	metrics.TokensRequested.Add(float64(req.size))
+
+	// Work stops when the client goes away or the service shuts down.
+	workCtx, cancel := s.workContext(ctx)
+	defer cancel()
+
+	start := time.Now()
+	batch, err := s.source.Generate(workCtx, req.size)
+	metrics.SourceSeconds.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return errors.E(op, ctx, err)
+	}
+
+	for _, r := range batch.Report.Rejected {
+		if r.Reason == source.ReasonDuplicate {
+			metrics.Tokens.WithLabelValues(metrics.ResultDuplicate).Inc()
+		} else {
+			metrics.Tokens.WithLabelValues(metrics.ResultInvalid).Inc()
+		}
+	}
+
+	if err := out.begin(batch); err != nil {
+		return errors.E(op, ctx, err)
+	}
+
+	metrics.StreamsInFlight.Inc()
+	defer metrics.StreamsInFlight.Dec()
+
+	total := len(batch.Tokens)
+	step := total / progressSteps
+	if step < 1 {
+		step = 1
+	}
+
+	results := make(chan tokenResult)
+	go s.insert(workCtx, batch.Tokens, req.ordered, results)
+
+	// Results are drained until insert closes the channel, even once
+	// nobody reads them, so that no worker is left blocked.
+	sum := issueSummary{Requested: req.size, Tokens: total, Rejected: len(batch.Report.Rejected)}
+	if batch.Trace != nil {
+		sum.SourceTiming = batch.Trace.Milliseconds()
+	}
+	done := 0
+	for r := range results {
+		done++
+		sum.add(r)
+		if ctx.Err() != nil {
+			continue
+		}
+
+		out.result(r)
+		if done%step == 0 || done == total {
+			out.progress(issueProgress{Done: done, Total: total, Issued: sum.Issued})
+		}
+	}
+
+	issued = sum.Issued
+
+	// Tokens never handed to a worker have no result.
+	sum.Cancelled += total - done
+	sum.Status = StatusComplete
+	if sum.Cancelled > 0 {
+		sum.Status = StatusCancelled
+	}
+	out.end(sum)
+
+	entry := log.FromContext(ctx).WithFields(logrus.Fields{
+		"tokens":    done,
+		"committed": sum.Issued,
+		"cancelled": sum.Cancelled,
+	})
+	if batch.Trace != nil {
+		entry = entry.WithFields(batch.Trace.Fields())
+	}
+
+	if err := workCtx.Err(); err != nil {
+		entry.Warnf("Request cancelled (%v): %d of %d tokens committed", err, sum.Issued, total)
+		return nil
+	}
+	entry.Debugf("Processed %d tokens", done)
+	return nil
+}
+
+// workContext returns a context for the work of a request, cancelled when
+// ctx is or when the service shuts down.
+func (s *service) workContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	if s.ctx == nil {
+		return ctx, cancel
+	}
+
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// allow charges size tokens to the quota of the authenticated client.
+func (s *service) allow(ctx context.Context, size int) (*quota.Reservation, error) {
+	if s.quota == nil {
+		return nil, nil
+	}
+
+	principal, ok := auth.FromContext(ctx)
+	if !ok {
+		return nil, nil
+	}
+
+	return s.quota.Allow(ctx, principal.ID, int64(size))
+}
+
+// refund gives n tokens of r back to the client. It runs once the request
+// is over, so it does not use the request context, which may be cancelled.
+func (s *service) refund(ctx context.Context, r *quota.Reservation, n int) {
+	if r == nil || n <= 0 {
+		return
+	}
+
+	logger := log.FromContext(ctx)
+	refundCtx := log.WithRequestID(log.NewContext(context.Background(), logger), log.RequestID(ctx))
+	refundCtx, cancel := context.WithTimeout(refundCtx, refundTimeout)
+	defer cancel()
+
+	if err := s.quota.Refund(refundCtx, r, int64(n)); err != nil {
+		logger.Errorf("failed to refund %d tokens to the quota: %v", n, err)
+	}
+}
+
+// insert stores tokens, sending the result of each of them, and closes
+// results once done. Results are sent as tokens complete or, when ordered,
+// in the order of tokens. When ctx is cancelled the tokens not yet handed
+// to a worker are skipped. results must be read until closed.
+func (s *service) insert(ctx context.Context, tokens []ledger.Token, ordered bool, results chan<- tokenResult) {
+	defer close(results)
+
+	send := func(r tokenResult) { results <- r }
+	var r *reorder
+	if ordered {
+		r = newReorder(s.cfg.ReorderWindow, results)
+		send = r.put
+	}
+
+	wg := sync.NewWaitGroup(s.cfg.Concurrency)
+	for i, token := range tokens {
+		if (r != nil && !r.acquire(ctx)) || !wg.AddContext(ctx) {
+			skipped := len(tokens) - i
+			metrics.Tokens.WithLabelValues(metrics.ResultCancelled).Add(float64(skipped))
+			break
+		}
+
+		metrics.InsertWorkers.Inc()
+		go func(c context.Context, i int, t ledger.Token) {
+			defer wg.Done()
+			defer metrics.InsertWorkers.Dec()
+
+			c, span := tracing.Tracer().Start(c, "storage.Insert")
+			defer span.End()
+
+			start := time.Now()
+			err := s.storage.Insert(c, t)
+			metrics.StorageInsertSeconds.Observe(time.Since(start).Seconds())
+			res := result(c, err)
+			metrics.Tokens.WithLabelValues(res).Inc()
+			span.SetAttributes(kv.String("result", res))
+
+			r := tokenResult{Index: i, Token: t, Result: res}
+			log.FromContext(c).Debug(r.line())
+			send(r)
+		}(ctx, i, token)
+	}
+
+	wg.Wait()
+}
+
+// result returns the metrics result label of a storage insert made with
+// ctx.
+func result(ctx context.Context, err error) string {
+	switch {
+	case err == nil:
+		return metrics.ResultIssued
+	case ctx.Err() != nil:
+		return metrics.ResultCancelled
+	case errors.Is(errors.Duplicate, err):
+		return metrics.ResultDuplicate
+	case errors.Is(errors.Invalid, err):
+		return metrics.ResultInvalid
+	default:
+		return metrics.ResultFailed
+	}
+}
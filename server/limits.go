@@ -0,0 +1,177 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/danielnegri/tokenapi-go/auth"
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/ledger"
+	"github.com/gin-gonic/gin"
+)
+
+// MinSize is the smallest batch of tokens a client may request.
+const MinSize = 1
+
+// sizedRoutes are the routes taking a size parameter, as keyed in
+// Limits.Routes: HTTP routes and gRPC methods.
+var sizedRoutes = []string{
+	http.MethodPost + " " + Prefix + "/tokens",
+	http.MethodGet + " " + Prefix + "/tokens/stream",
+	http.MethodGet + " " + Prefix + "/tokens/ws",
+	grpcIssueMethod,
+}
+
+// Limits bounds the size of the batches clients may request. Routes and
+// clients may only lower MaxSize.
+type Limits struct {
+	// MaxSize is the largest batch of every route. The default, and the
+	// highest value allowed, is ledger.MaxBatchSize.
+	MaxSize int `json:"max_size,omitempty"`
+
+	// Routes holds the largest batch of given routes, keyed by method and
+	// path such as "POST /api/v1/tokens".
+	Routes map[string]int `json:"routes,omitempty"`
+
+	// Clients holds the largest batch of given clients, by client ID.
+	Clients map[string]int `json:"clients,omitempty"`
+}
+
+// Validate checks that every limit is within MinSize and
+// ledger.MaxBatchSize and that routes exist.
+func (l *Limits) Validate() error {
+	const op errors.Op = "server/Limits.Validate"
+
+	check := func(name string, max int) error {
+		if max < MinSize || max > ledger.MaxBatchSize {
+			return errors.E(op, errors.Invalid, errors.Errorf("%s: max size %d is not between %d and %d", name, max, MinSize, ledger.MaxBatchSize))
+		}
+		return nil
+	}
+
+	if l.MaxSize != 0 {
+		if err := check("default", l.MaxSize); err != nil {
+			return err
+		}
+	}
+
+	for route, max := range l.Routes {
+		if !sizedRoute(route) {
+			return errors.E(op, errors.Invalid, errors.Errorf("route %q does not take a size", route))
+		}
+		if err := check(route, max); err != nil {
+			return err
+		}
+	}
+
+	for client, max := range l.Clients {
+		if err := check("client "+client, max); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func sizedRoute(route string) bool {
+	for _, r := range sizedRoutes {
+		if r == route {
+			return true
+		}
+	}
+	return false
+}
+
+// maxSize returns the largest batch client may request on route.
+func (l *Limits) maxSize(route, client string) int {
+	max := ledger.MaxBatchSize
+	if l == nil {
+		return max
+	}
+
+	for _, m := range []int{l.MaxSize, l.Routes[route], l.Clients[client]} {
+		if m > 0 && m < max {
+			max = m
+		}
+	}
+	return max
+}
+
+// size parses the size parameter of the request and checks it against the
+// limits of the route and of the authenticated client.
+func (s *service) size(ctx *gin.Context) (int, error) {
+	size, err := strconv.Atoi(ctx.Query("size"))
+	if err != nil {
+		size = 0
+	}
+
+	if err := s.checkSize(ctx.Request.Context(), ctx.Request.Method+" "+ctx.FullPath(), size); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// checkSize checks size against the limits of route and of the client
+// authenticated in ctx.
+func (s *service) checkSize(ctx context.Context, route string, size int) error {
+	const op errors.Op = "server/service.checkSize"
+
+	max := s.cfg.Limits.maxSize(route, clientID(ctx))
+	if size < MinSize || size > max {
+		return errors.E(op, ctx, errors.Invalid, errors.Errorf("size must be an integer between %d and %d", MinSize, max))
+	}
+
+	return nil
+}
+
+// clientID returns the ID of the authenticated client, if any.
+func clientID(ctx context.Context) string {
+	if principal, ok := auth.FromContext(ctx); ok {
+		return principal.ID
+	}
+	return ""
+}
+
+// RouteLimits are the limits of a route.
+type RouteLimits struct {
+	MinSize int `json:"min_size"`
+	MaxSize int `json:"max_size"`
+}
+
+// handleLimits publishes the limits applying to the caller: the size
+// range of each route and, when quotas are enforced, its quota policy.
+func (s *service) handleLimits() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		client := clientID(ctx.Request.Context())
+
+		routes := make(map[string]RouteLimits, len(sizedRoutes))
+		for _, route := range sizedRoutes {
+			routes[route] = RouteLimits{MinSize: MinSize, MaxSize: s.cfg.Limits.maxSize(route, client)}
+		}
+
+		body := gin.H{"routes": routes}
+		if client != "" {
+			body["client"] = client
+		}
+		if s.cfg.Quota != nil {
+			body["quota"] = s.cfg.Quota.Policy(client)
+		}
+
+		ctx.JSON(http.StatusOK, body)
+	}
+}
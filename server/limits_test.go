@@ -0,0 +1,107 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/danielnegri/tokenapi-go/auth"
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/ledger"
+	"github.com/danielnegri/tokenapi-go/net/httputil"
+	"github.com/danielnegri/tokenapi-go/quota"
+	"github.com/danielnegri/tokenapi-go/source"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSize(t *testing.T) {
+	s, _ := newTestService(source.NewSeeded(nil), 1)
+	s.cfg.Limits = &Limits{MaxSize: 100}
+	h := s.newHandler()
+
+	for _, size := range []string{"", "abc", "0", "-5", "101", "99999999999999999999"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, Prefix+"/tokens?size="+size, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, size)
+
+		var resp httputil.ErrorResponse
+		if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp)) {
+			assert.Contains(t, resp.Message, "size must be an integer between 1 and 100")
+		}
+	}
+
+	assert.Equal(t, http.StatusOK, insert(h, 100).Code)
+}
+
+func TestLimits_maxSize(t *testing.T) {
+	route := sizedRoutes[0]
+	l := &Limits{
+		MaxSize: 1000,
+		Routes:  map[string]int{route: 500},
+		Clients: map[string]int{"small": 10, "large": 5000},
+	}
+
+	assert.Equal(t, ledger.MaxBatchSize, (*Limits)(nil).maxSize(route, ""))
+	assert.Equal(t, 500, l.maxSize(route, ""))
+	assert.Equal(t, 10, l.maxSize(route, "small"))
+	assert.Equal(t, 1000, l.maxSize("GET /other", "large"))
+
+	assert.NoError(t, l.Validate())
+	for _, bad := range []*Limits{
+		{MaxSize: ledger.MaxBatchSize + 1},
+		{MaxSize: -1},
+		{Routes: map[string]int{"GET /health/live": 10}},
+		{Clients: map[string]int{"small": 0}},
+	} {
+		assert.True(t, errors.Is(errors.Invalid, bad.Validate()))
+	}
+}
+
+func TestHandleLimits(t *testing.T) {
+	s, storage := newTestService(source.NewSeeded(nil), 1)
+	s.cfg.AuthDisabled = false
+	s.cfg.Limits = &Limits{Clients: map[string]int{}}
+	s.cfg.Quota = &quota.Config{Default: quota.Policy{PerDay: 1000}}
+	h := s.newHandler()
+
+	apiKey, key, _ := auth.NewKey("test", []auth.Scope{auth.ScopeVerify})
+	_ = storage.CreateKey(context.Background(), key)
+	s.cfg.Limits.Clients[key.ID] = 50
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, Prefix+"/limits", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, Prefix+"/limits", nil)
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var body struct {
+		Client string                 `json:"client"`
+		Routes map[string]RouteLimits `json:"routes"`
+		Quota  quota.Policy           `json:"quota"`
+	}
+	if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body)) {
+		assert.Equal(t, key.ID, body.Client)
+		assert.Equal(t, RouteLimits{MinSize: 1, MaxSize: 50}, body.Routes["POST /api/v1/tokens"])
+		assert.Equal(t, quota.Policy{PerDay: 1000}, body.Quota)
+	}
+}
@@ -0,0 +1,652 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/net/httputil"
+	"github.com/danielnegri/tokenapi-go/version"
+	"github.com/gin-gonic/gin"
+)
+
+// openAPI returns the OpenAPI document of the HTTP routes, with the
+// version of the running service.
+func openAPI() ([]byte, error) {
+	const op errors.Op = "server/openAPI"
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(openAPIDocument), &doc); err != nil {
+		return nil, errors.E(op, errors.Internal, err)
+	}
+	if info, ok := doc["info"].(map[string]interface{}); ok {
+		info["version"] = version.Version
+	}
+
+	return json.Marshal(doc)
+}
+
+// handleOpenAPI serves the OpenAPI document, which needs no credentials.
+func (s *service) handleOpenAPI() gin.HandlerFunc {
+	doc, err := openAPI()
+
+	return func(ctx *gin.Context) {
+		if err != nil {
+			httputil.AbortWithError(ctx, err)
+			return
+		}
+		ctx.Data(http.StatusOK, gin.MIMEJSON+"; charset=utf-8", doc)
+	}
+}
+
+// openAPIDocument describes every route of newHandler in OpenAPI 3. Keep it
+// in sync with the routes and the types they answer with: the tests check
+// both.
+const openAPIDocument = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "Ledger",
+    "description": "Issues unique string tokens from the Token source and keeps track of them.",
+    "license": {"name": "AGPL 3.0", "url": "https://www.gnu.org/licenses/agpl-3.0.en.html"},
+    "version": "dev"
+  },
+  "tags": [
+    {"name": "tokens", "description": "Issuing, verifying and revoking tokens."},
+    {"name": "limits", "description": "Size limits and quotas."},
+    {"name": "health", "description": "Probes and service information."}
+  ],
+  "security": [{"bearerAuth": []}, {"apiKey": []}],
+  "paths": {
+    "/": {
+      "get": {
+        "tags": ["health"],
+        "summary": "Describe the service",
+        "operationId": "getRoot",
+        "security": [],
+        "responses": {
+          "200": {
+            "description": "The service and its build.",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ServiceInfo"}}}
+          }
+        }
+      }
+    },
+    "/health/heartbeat": {
+      "get": {
+        "tags": ["health"],
+        "summary": "Check that the service answers",
+        "operationId": "getHeartbeat",
+        "security": [],
+        "responses": {
+          "200": {
+            "description": "The service answers, as JSON when asked for it and as a line of text otherwise.",
+            "content": {
+              "application/json": {"schema": {"$ref": "#/components/schemas/Heartbeat"}},
+              "text/plain": {"schema": {"type": "string", "example": "Ledger @ 2020-07-01T12:00:00Z"}}
+            }
+          }
+        }
+      }
+    },
+    "/health/live": {
+      "get": {
+        "tags": ["health"],
+        "summary": "Liveness probe",
+        "operationId": "getLive",
+        "security": [],
+        "responses": {
+          "200": {
+            "description": "The process serves requests.",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Liveness"}}}
+          }
+        }
+      }
+    },
+    "/health/ready": {
+      "get": {
+        "tags": ["health"],
+        "summary": "Readiness probe",
+        "description": "Checks the Token source and the storage. The outcome of each check is cached.",
+        "operationId": "getReady",
+        "security": [],
+        "responses": {
+          "200": {
+            "description": "Every dependency is up.",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Readiness"}}}
+          },
+          "503": {
+            "description": "A dependency is down, or the service is draining.",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Readiness"}}}
+          }
+        }
+      }
+    },
+    "/metrics": {
+      "get": {
+        "tags": ["health"],
+        "summary": "Prometheus metrics",
+        "description": "Served on the HTTP port unless --metrics-port serves them on a port of their own.",
+        "operationId": "getMetrics",
+        "security": [],
+        "responses": {
+          "200": {
+            "description": "Metrics in the Prometheus text format.",
+            "content": {"text/plain": {"schema": {"type": "string"}}}
+          }
+        }
+      }
+    },
+    "/api/v1/openapi.json": {
+      "get": {
+        "tags": ["health"],
+        "summary": "This document",
+        "operationId": "getOpenAPI",
+        "security": [],
+        "responses": {
+          "200": {
+            "description": "The OpenAPI document of the HTTP routes.",
+            "content": {"application/json": {"schema": {"type": "object"}}}
+          }
+        }
+      }
+    },
+    "/api/v1/tokens": {
+      "post": {
+        "tags": ["tokens"],
+        "summary": "Issue tokens",
+        "description": "Generates size tokens and streams the outcome of storing each of them as a line of text. Requires the tokens:issue scope.",
+        "operationId": "issueTokens",
+        "parameters": [
+          {"$ref": "#/components/parameters/Size"},
+          {"$ref": "#/components/parameters/Ordered"}
+        ],
+        "responses": {
+          "200": {
+            "description": "One line per token: \"OK : <token>\" once issued, \"ERR: <token>\" otherwise. Streams open during a shutdown end with \"END: <status>, <issued> of <tokens> tokens committed\", where status is complete or cancelled.",
+            "headers": {"Server-Timing": {"$ref": "#/components/headers/Server-Timing"}},
+            "content": {
+              "text/plain": {
+                "schema": {"type": "string"},
+                "example": "OK : ijkr2lXOkM1EElPSDQFkeg\nERR: 1ZbXHwdD6vd5WUAuUq3Pvw\n"
+              }
+            }
+          },
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/InternalError"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    },
+    "/api/v1/tokens/stream": {
+      "get": {
+        "tags": ["tokens"],
+        "summary": "Issue tokens over server-sent events",
+        "description": "Issues tokens as POST /api/v1/tokens does and streams the outcome as server-sent events. Closing the connection cancels the request. Requires the tokens:issue scope.",
+        "operationId": "streamTokens",
+        "security": [{"bearerAuth": []}, {"apiKey": []}, {"accessToken": []}],
+        "parameters": [
+          {"$ref": "#/components/parameters/Size"},
+          {"$ref": "#/components/parameters/Ordered"}
+        ],
+        "responses": {
+          "200": {
+            "description": "A result event per token, a progress event every 5% of the tokens and a final summary event. The data of each event is the JSON of the schema named in x-events.",
+            "headers": {"Server-Timing": {"$ref": "#/components/headers/Server-Timing"}},
+            "content": {
+              "text/event-stream": {
+                "schema": {
+                  "type": "string",
+                  "x-events": {
+                    "result": {"$ref": "#/components/schemas/TokenResult"},
+                    "progress": {"$ref": "#/components/schemas/Progress"},
+                    "summary": {"$ref": "#/components/schemas/Summary"}
+                  }
+                },
+                "example": "event:result\ndata:{\"index\":0,\"token\":\"ijkr2lXOkM1EElPSDQFkeg\",\"result\":\"issued\"}\n\nevent:progress\ndata:{\"done\":1,\"total\":1,\"issued\":1}\n\nevent:summary\ndata:{\"status\":\"complete\",\"requested\":1,\"tokens\":1,\"rejected\":0,\"issued\":1,\"failed\":0,\"cancelled\":0}\n\n"
+              }
+            }
+          },
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/InternalError"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    },
+    "/api/v1/tokens/ws": {
+      "get": {
+        "tags": ["tokens"],
+        "summary": "Issue tokens over a WebSocket",
+        "description": "Issues tokens as POST /api/v1/tokens does. The connection is upgraded once the tokens are generated, so that failed requests are answered with an HTTP error. Requires the tokens:issue scope.",
+        "operationId": "streamTokensWebSocket",
+        "security": [{"bearerAuth": []}, {"apiKey": []}, {"accessToken": []}],
+        "parameters": [
+          {"$ref": "#/components/parameters/Size"},
+          {"$ref": "#/components/parameters/Ordered"}
+        ],
+        "responses": {
+          "101": {
+            "description": "The server sends the events of GET /api/v1/tokens/stream as StreamMessage messages and closes the connection after the summary. Sending {\"event\": \"cancel\"}, or closing the connection, cancels the request.",
+            "x-messages": {
+              "send": {"$ref": "#/components/schemas/CancelMessage"},
+              "receive": {"$ref": "#/components/schemas/StreamMessage"}
+            }
+          },
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "429": {"$ref": "#/components/responses/TooManyRequests"},
+          "500": {"$ref": "#/components/responses/InternalError"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    },
+    "/api/v1/tokens/verify": {
+      "post": {
+        "tags": ["tokens"],
+        "summary": "Verify a token",
+        "description": "Tells whether a token was issued and not revoked. Requires the tokens:verify scope.",
+        "operationId": "verifyToken",
+        "requestBody": {"$ref": "#/components/requestBodies/TokenRequest"},
+        "responses": {
+          "200": {
+            "description": "Whether the token is valid.",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Verification"}}}
+          },
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "500": {"$ref": "#/components/responses/InternalError"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    },
+    "/api/v1/tokens/lookup": {
+      "post": {
+        "tags": ["tokens"],
+        "summary": "Look up a token",
+        "description": "Returns when a token was issued and revoked. Requires the tokens:verify scope.",
+        "operationId": "lookupToken",
+        "requestBody": {"$ref": "#/components/requestBodies/TokenRequest"},
+        "responses": {
+          "200": {
+            "description": "The issued token.",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TokenRecord"}}}
+          },
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "500": {"$ref": "#/components/responses/InternalError"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    },
+    "/api/v1/tokens/revoke": {
+      "post": {
+        "tags": ["tokens"],
+        "summary": "Revoke a token",
+        "description": "Revokes an issued token. Revoking a revoked token keeps its first revocation date. Requires the tokens:revoke scope.",
+        "operationId": "revokeToken",
+        "requestBody": {"$ref": "#/components/requestBodies/TokenRequest"},
+        "responses": {
+          "200": {
+            "description": "The revoked token.",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TokenRecord"}}}
+          },
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "500": {"$ref": "#/components/responses/InternalError"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    },
+    "/api/v1/admin/usage": {
+      "get": {
+        "tags": ["limits"],
+        "summary": "Quota usage",
+        "description": "Reports the tokens issued by each client in the current quota windows. Requires the admin scope.",
+        "operationId": "getUsage",
+        "responses": {
+          "200": {
+            "description": "The usage of each client with a counter in the current windows.",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "required": ["usage"],
+                  "properties": {
+                    "usage": {"type": "array", "items": {"$ref": "#/components/schemas/Usage"}}
+                  }
+                }
+              }
+            }
+          },
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "500": {"$ref": "#/components/responses/InternalError"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    },
+    "/api/v1/limits": {
+      "get": {
+        "tags": ["limits"],
+        "summary": "Limits of the caller",
+        "description": "Reports the size range of each route taking a size and the quota policy applying to the authenticated client. Requires authentication only.",
+        "operationId": "getLimits",
+        "responses": {
+          "200": {
+            "description": "The limits applying to the caller.",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Limits"}}}
+          },
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "503": {"$ref": "#/components/responses/Unavailable"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearerAuth": {
+        "type": "http",
+        "scheme": "bearer",
+        "description": "An API key, or a JWT once a JSON Web Key Set is configured."
+      },
+      "apiKey": {"type": "apiKey", "in": "header", "name": "X-Api-Key"},
+      "accessToken": {
+        "type": "apiKey",
+        "in": "query",
+        "name": "access_token",
+        "description": "For EventSource and WebSocket clients, which cannot set headers. Accepted on GET routes only."
+      }
+    },
+    "parameters": {
+      "Size": {
+        "name": "size",
+        "in": "query",
+        "required": true,
+        "description": "Number of tokens. Lowered for some routes or clients by the limits, see GET /api/v1/limits.",
+        "schema": {"type": "integer", "minimum": 1, "maximum": 455902}
+      },
+      "Ordered": {
+        "name": "ordered",
+        "in": "query",
+        "description": "Streams the results in the order of the tokens rather than as they complete.",
+        "schema": {"type": "boolean", "default": false}
+      }
+    },
+    "headers": {
+      "Server-Timing": {
+        "description": "Latency breakdown of the call to the Token source, when tracing it is enabled.",
+        "schema": {"type": "string"}
+      },
+      "Retry-After": {
+        "description": "Seconds to wait before retrying.",
+        "schema": {"type": "integer"}
+      },
+      "WWW-Authenticate": {"schema": {"type": "string"}}
+    },
+    "requestBodies": {
+      "TokenRequest": {
+        "required": true,
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TokenRequest"}}}
+      }
+    },
+    "responses": {
+      "BadRequest": {
+        "description": "Invalid parameters.",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorResponse"}}}
+      },
+      "Unauthorized": {
+        "description": "Missing credentials.",
+        "headers": {"WWW-Authenticate": {"$ref": "#/components/headers/WWW-Authenticate"}},
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorResponse"}}}
+      },
+      "Forbidden": {
+        "description": "Unknown, revoked or insufficient credentials.",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorResponse"}}}
+      },
+      "NotFound": {
+        "description": "Unknown token.",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorResponse"}}}
+      },
+      "TooManyRequests": {
+        "description": "Over quota. Retry-After is set unless the total quota is exhausted.",
+        "headers": {"Retry-After": {"$ref": "#/components/headers/Retry-After"}},
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorResponse"}}}
+      },
+      "InternalError": {
+        "description": "The Token source or the storage failed.",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorResponse"}}}
+      },
+      "Unavailable": {
+        "description": "The service is draining or a dependency is unavailable.",
+        "headers": {"Retry-After": {"$ref": "#/components/headers/Retry-After"}},
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorResponse"}}}
+      }
+    },
+    "schemas": {
+      "ErrorResponse": {
+        "type": "object",
+        "required": ["code", "message"],
+        "properties": {
+          "code": {"type": "integer", "description": "The HTTP status code."},
+          "message": {"type": "string"},
+          "request_id": {"type": "string", "description": "The X-Request-Id of the request."}
+        }
+      },
+      "Token": {
+        "type": "string",
+        "pattern": "^[^-]+$",
+        "example": "ijkr2lXOkM1EElPSDQFkeg"
+      },
+      "TokenRequest": {
+        "type": "object",
+        "required": ["token"],
+        "properties": {"token": {"$ref": "#/components/schemas/Token"}}
+      },
+      "TokenRecord": {
+        "type": "object",
+        "required": ["token", "issued_at"],
+        "properties": {
+          "token": {"$ref": "#/components/schemas/Token"},
+          "issued_at": {"type": "string", "format": "date-time"},
+          "revoked_at": {"type": "string", "format": "date-time", "description": "Set once the token is revoked."}
+        }
+      },
+      "Verification": {
+        "type": "object",
+        "required": ["token", "valid"],
+        "properties": {
+          "token": {"$ref": "#/components/schemas/Token"},
+          "valid": {"type": "boolean", "description": "Whether the token was issued and not revoked."}
+        }
+      },
+      "TokenResult": {
+        "type": "object",
+        "required": ["index", "token", "result"],
+        "properties": {
+          "index": {"type": "integer", "description": "Position of the token in the batch issued by the Token source."},
+          "token": {"$ref": "#/components/schemas/Token"},
+          "result": {"type": "string", "enum": ["issued", "duplicate", "invalid", "failed", "cancelled"]}
+        }
+      },
+      "Progress": {
+        "type": "object",
+        "required": ["done", "total", "issued"],
+        "properties": {
+          "done": {"type": "integer"},
+          "total": {"type": "integer"},
+          "issued": {"type": "integer"}
+        }
+      },
+      "Summary": {
+        "type": "object",
+        "required": ["status", "requested", "tokens", "rejected", "issued", "failed", "cancelled"],
+        "properties": {
+          "status": {"type": "string", "enum": ["complete", "cancelled"]},
+          "requested": {"type": "integer"},
+          "tokens": {"type": "integer", "description": "Valid tokens received from the Token source."},
+          "rejected": {"type": "integer", "description": "Tokens received from the Token source that failed its validation."},
+          "issued": {"type": "integer"},
+          "failed": {"type": "integer"},
+          "cancelled": {"type": "integer"},
+          "source_timing": {
+            "type": "object",
+            "description": "Latency breakdown of the Token source call in milliseconds, keyed by phase (dns, connect, tls, server, response, total). Present when the source is traced.",
+            "additionalProperties": {"type": "number"}
+          }
+        }
+      },
+      "StreamMessage": {
+        "type": "object",
+        "required": ["event"],
+        "properties": {
+          "event": {"type": "string", "enum": ["result", "progress", "summary"]},
+          "data": {
+            "oneOf": [
+              {"$ref": "#/components/schemas/TokenResult"},
+              {"$ref": "#/components/schemas/Progress"},
+              {"$ref": "#/components/schemas/Summary"}
+            ]
+          }
+        }
+      },
+      "CancelMessage": {
+        "type": "object",
+        "required": ["event"],
+        "properties": {
+          "event": {"type": "string", "enum": ["cancel"]}
+        }
+      },
+      "QuotaPolicy": {
+        "type": "object",
+        "description": "Tokens a client may issue; a missing or zero field is unlimited.",
+        "properties": {
+          "per_minute": {"type": "integer"},
+          "per_day": {"type": "integer"},
+          "total": {"type": "integer"}
+        }
+      },
+      "Usage": {
+        "type": "object",
+        "required": ["client", "policy", "used"],
+        "properties": {
+          "client": {"type": "string"},
+          "policy": {"$ref": "#/components/schemas/QuotaPolicy"},
+          "used": {
+            "type": "object",
+            "description": "Tokens issued in the current window of each period: minute, day and total.",
+            "additionalProperties": {"type": "integer"}
+          }
+        }
+      },
+      "RouteLimits": {
+        "type": "object",
+        "required": ["min_size", "max_size"],
+        "properties": {
+          "min_size": {"type": "integer"},
+          "max_size": {"type": "integer"}
+        }
+      },
+      "Limits": {
+        "type": "object",
+        "required": ["routes"],
+        "properties": {
+          "client": {"type": "string", "description": "The authenticated client, if any."},
+          "routes": {
+            "type": "object",
+            "description": "Limits keyed by route, such as \"POST /api/v1/tokens\", and by gRPC method.",
+            "additionalProperties": {"$ref": "#/components/schemas/RouteLimits"}
+          },
+          "quota": {"$ref": "#/components/schemas/QuotaPolicy"}
+        }
+      },
+      "ServiceInfo": {
+        "type": "object",
+        "required": ["service", "arch", "build_time", "commit", "os", "runtime_version", "version"],
+        "properties": {
+          "service": {"type": "string"},
+          "arch": {"type": "string"},
+          "build_time": {"type": "string"},
+          "commit": {"type": "string"},
+          "os": {"type": "string"},
+          "runtime_version": {"type": "string"},
+          "version": {"type": "string"}
+        }
+      },
+      "Heartbeat": {
+        "type": "object",
+        "required": ["startup_time", "current_time", "message", "service", "status", "version"],
+        "properties": {
+          "startup_time": {"type": "string", "format": "date-time"},
+          "current_time": {"type": "string", "format": "date-time"},
+          "message": {"type": "string"},
+          "service": {"type": "string"},
+          "status": {"type": "integer"},
+          "version": {"type": "string"}
+        }
+      },
+      "Liveness": {
+        "type": "object",
+        "required": ["service", "status", "startup_time", "current_time", "uptime", "version"],
+        "properties": {
+          "service": {"type": "string"},
+          "status": {"type": "string", "enum": ["up"]},
+          "startup_time": {"type": "string", "format": "date-time"},
+          "current_time": {"type": "string", "format": "date-time"},
+          "uptime": {"type": "string", "example": "1h2m3s"},
+          "version": {"type": "string"}
+        }
+      },
+      "DependencyStatus": {
+        "type": "object",
+        "required": ["status", "latency", "checked_at"],
+        "properties": {
+          "status": {"type": "string", "enum": ["up", "down"]},
+          "latency": {"type": "string", "example": "1.2ms"},
+          "checked_at": {"type": "string", "format": "date-time"},
+          "reason": {"type": "string", "enum": ["timeout", "unavailable"], "description": "Why the dependency is down. The error is only logged."},
+          "last_reason": {"type": "string", "enum": ["timeout", "unavailable"], "description": "The reason of the most recent failure, kept after the dependency recovers."},
+          "last_failure_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Readiness": {
+        "type": "object",
+        "required": ["service", "status", "dependencies"],
+        "properties": {
+          "service": {"type": "string"},
+          "status": {"type": "string", "enum": ["up", "down", "draining"]},
+          "dependencies": {
+            "type": "object",
+            "additionalProperties": {"$ref": "#/components/schemas/DependencyStatus"}
+          }
+        }
+      }
+    }
+  }
+}
+`
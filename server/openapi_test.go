@@ -0,0 +1,250 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/danielnegri/tokenapi-go/net/httputil"
+	"github.com/danielnegri/tokenapi-go/quota"
+	"github.com/danielnegri/tokenapi-go/source"
+	"github.com/danielnegri/tokenapi-go/version"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openAPISpec is the subset of the OpenAPI document checked by the tests.
+type openAPISpec struct {
+	Info struct {
+		Version string `json:"version"`
+	} `json:"info"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]struct {
+			Required   []string                   `json:"required"`
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+func parseOpenAPI(t *testing.T) openAPISpec {
+	var spec openAPISpec
+	require.NoError(t, json.Unmarshal([]byte(openAPIDocument), &spec))
+	return spec
+}
+
+var ginParam = regexp.MustCompile(`[:*]([^/]+)`)
+
+// TestOpenAPI_routes fails when a route is added to or removed from
+// newHandler without the document following.
+func TestOpenAPI_routes(t *testing.T) {
+	s, _ := newTestService(source.NewSeeded(nil), 1)
+	router := s.newHandler().(*gin.Engine)
+
+	var routes []string
+	for _, r := range router.Routes() {
+		routes = append(routes, r.Method+" "+ginParam.ReplaceAllString(r.Path, "{$1}"))
+	}
+
+	var documented []string
+	for path, item := range parseOpenAPI(t).Paths {
+		for method := range item {
+			switch method {
+			case "get", "put", "post", "delete", "options", "head", "patch", "trace":
+				documented = append(documented, strings.ToUpper(method)+" "+path)
+			}
+		}
+	}
+
+	sort.Strings(routes)
+	sort.Strings(documented)
+	assert.Equal(t, routes, documented)
+}
+
+// TestOpenAPI_schemas fails when the JSON fields of a type drift from its
+// schema. Fields without omitempty must be required.
+func TestOpenAPI_schemas(t *testing.T) {
+	spec := parseOpenAPI(t)
+
+	types := map[string]interface{}{
+		"ErrorResponse":    httputil.ErrorResponse{},
+		"TokenRequest":     TokenRequest{},
+		"TokenRecord":      TokenRecord{},
+		"Verification":     Verification{},
+		"TokenResult":      tokenResult{},
+		"Progress":         issueProgress{},
+		"Summary":          issueSummary{},
+		"StreamMessage":    wsMessage{},
+		"QuotaPolicy":      quota.Policy{},
+		"Usage":            quota.Usage{},
+		"RouteLimits":      RouteLimits{},
+		"DependencyStatus": DependencyStatus{},
+	}
+
+	for name, v := range types {
+		schema, ok := spec.Components.Schemas[name]
+		if !assert.True(t, ok, "missing schema %s", name) {
+			continue
+		}
+
+		var properties, required []string
+		typ := reflect.TypeOf(v)
+		for i := 0; i < typ.NumField(); i++ {
+			tag := strings.Split(typ.Field(i).Tag.Get("json"), ",")
+			properties = append(properties, tag[0])
+			if len(tag) == 1 || tag[1] != "omitempty" {
+				required = append(required, tag[0])
+			}
+		}
+
+		var documented []string
+		for property := range schema.Properties {
+			documented = append(documented, property)
+		}
+
+		assert.ElementsMatch(t, properties, documented, "properties of %s", name)
+		assert.ElementsMatch(t, required, schema.Required, "required properties of %s", name)
+	}
+}
+
+// TestOpenAPI_contentTypes fails when a route answers with a status or a
+// media type that its document does not list.
+func TestOpenAPI_contentTypes(t *testing.T) {
+	var doc struct {
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Responses map[string]json.RawMessage `json:"responses"`
+		} `json:"components"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(openAPIDocument), &doc))
+
+	type response struct {
+		Ref     string                     `json:"$ref"`
+		Content map[string]json.RawMessage `json:"content"`
+	}
+	documented := func(method, path string, code int) ([]string, bool) {
+		var op struct {
+			Responses map[string]response `json:"responses"`
+		}
+		require.NoError(t, json.Unmarshal(doc.Paths[path][strings.ToLower(method)], &op))
+
+		r, ok := op.Responses[strconv.Itoa(code)]
+		if !ok {
+			return nil, false
+		}
+		if r.Ref != "" {
+			name := strings.TrimPrefix(r.Ref, "#/components/responses/")
+			require.NoError(t, json.Unmarshal(doc.Components.Responses[name], &r))
+		}
+
+		var types []string
+		for mediaType := range r.Content {
+			types = append(types, mediaType)
+		}
+		return types, true
+	}
+
+	const token = `{"token": "ijkr2lXOkM1EElPSDQFkeg"}`
+	tests := []struct {
+		method, path, target, accept, body string
+	}{
+		{method: "GET", path: "/", target: "/"},
+		{method: "GET", path: "/health/heartbeat", target: "/health/heartbeat"},
+		{method: "GET", path: "/health/heartbeat", target: "/health/heartbeat", accept: gin.MIMEHTML},
+		{method: "GET", path: "/health/heartbeat", target: "/health/heartbeat", accept: gin.MIMEJSON},
+		{method: "GET", path: "/health/live", target: "/health/live"},
+		{method: "GET", path: "/health/ready", target: "/health/ready"},
+		{method: "GET", path: "/metrics", target: "/metrics"},
+		{method: "GET", path: Prefix + "/openapi.json", target: Prefix + "/openapi.json"},
+		{method: "GET", path: Prefix + "/limits", target: Prefix + "/limits"},
+		{method: "POST", path: Prefix + "/tokens", target: Prefix + "/tokens?size=2"},
+		{method: "POST", path: Prefix + "/tokens", target: Prefix + "/tokens?size=0"},
+		{method: "GET", path: Prefix + "/tokens/stream", target: Prefix + "/tokens/stream?size=2"},
+		{method: "GET", path: Prefix + "/tokens/ws", target: Prefix + "/tokens/ws?size=2"},
+		{method: "POST", path: Prefix + "/tokens/verify", target: Prefix + "/tokens/verify", body: token},
+		{method: "POST", path: Prefix + "/tokens/lookup", target: Prefix + "/tokens/lookup", body: token},
+		{method: "POST", path: Prefix + "/tokens/revoke", target: Prefix + "/tokens/revoke", body: "token"},
+	}
+
+	s, _ := newTestService(source.NewSeeded(nil), 1)
+	h := s.newHandler()
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		if tt.body != "" {
+			req.Header.Set("Content-Type", gin.MIMEJSON)
+		}
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		name := fmt.Sprintf("%s %s (Accept: %s)", tt.method, tt.target, tt.accept)
+		types, ok := documented(tt.method, tt.path, w.Code)
+		if !assert.True(t, ok, "%s: undocumented status %d", name, w.Code) {
+			continue
+		}
+
+		mediaType, _, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		if assert.NoError(t, err, name) {
+			assert.Contains(t, types, mediaType, name)
+		}
+	}
+}
+
+var openAPIRef = regexp.MustCompile(`"\$ref": "#/components/([^/]+)/([^"]+)"`)
+
+func TestOpenAPI_refs(t *testing.T) {
+	var doc struct {
+		Components map[string]map[string]json.RawMessage `json:"components"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(openAPIDocument), &doc))
+
+	refs := openAPIRef.FindAllStringSubmatch(openAPIDocument, -1)
+	require.NotEmpty(t, refs)
+	for _, m := range refs {
+		_, ok := doc.Components[m[1]][m[2]]
+		assert.True(t, ok, "unresolved reference #/components/%s/%s", m[1], m[2])
+	}
+}
+
+func TestHandleOpenAPI(t *testing.T) {
+	s, _ := newTestService(source.NewSeeded(nil), 1)
+	s.cfg.AuthDisabled = false
+	h := s.newHandler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, Prefix+"/openapi.json", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), gin.MIMEJSON)
+
+	var spec openAPISpec
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &spec))
+	assert.Equal(t, version.Version, spec.Info.Version)
+	assert.NotEmpty(t, spec.Paths)
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"sync"
+)
+
+// DefaultReorderWindow is the number of results an ordered insert may hold
+// in flight or buffered.
+const DefaultReorderWindow = 1024
+
+// reorder sends the results of an ordered insert in the order of the
+// tokens, whatever the order in which the workers complete them. It holds
+// at most window results: acquire blocks until the result window positions
+// back is sent, so a slow token stalls the workers rather than growing the
+// buffer.
+type reorder struct {
+	slots   chan struct{}
+	results chan<- tokenResult
+
+	mu      sync.Mutex
+	next    int
+	pending map[int]tokenResult
+}
+
+func newReorder(window int, results chan<- tokenResult) *reorder {
+	if window <= 0 {
+		window = DefaultReorderWindow
+	}
+
+	return &reorder{
+		slots:   make(chan struct{}, window),
+		results: results,
+		pending: make(map[int]tokenResult, window),
+	}
+}
+
+// acquire reserves a position for the next token. It returns false if ctx
+// is done first.
+func (r *reorder) acquire(ctx context.Context) bool {
+	select {
+	case r.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// put buffers res, then sends every result that is next in order.
+// Positions are acquired in order, so each of them is eventually put.
+func (r *reorder) put(res tokenResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pending[res.Index] = res
+	for {
+		res, ok := r.pending[r.next]
+		if !ok {
+			return
+		}
+
+		delete(r.pending, r.next)
+		r.next++
+		r.results <- res
+		<-r.slots
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/ledger"
+	"github.com/danielnegri/tokenapi-go/source"
+	"github.com/danielnegri/tokenapi-go/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+// jitterStorage delays each insert by up to 2ms, derived from the token so
+// that workers complete out of order.
+type jitterStorage struct {
+	*memory.Memory
+}
+
+func (s jitterStorage) Insert(ctx context.Context, token ledger.Token) error {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(token))
+	time.Sleep(time.Duration(h.Sum32()%2000) * time.Microsecond)
+	return s.Memory.Insert(ctx, token)
+}
+
+func TestHandleInsert_ordered(t *testing.T) {
+	batch, err := source.NewSeeded(nil).Generate(context.Background(), 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, _ := newTestService(source.NewSeeded(nil), 16)
+	s.cfg.ReorderWindow = 32
+	s.storage = jitterStorage{Memory: memory.New()}
+
+	w := httptest.NewRecorder()
+	s.newHandler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, fmt.Sprintf("%s/tokens?size=200&ordered=true", Prefix), nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	if assert.Len(t, lines, len(batch.Tokens)) {
+		for i, token := range batch.Tokens {
+			assert.Equal(t, "OK : "+string(token), lines[i])
+		}
+	}
+}
+
+func TestHandleInsert_orderedInvalid(t *testing.T) {
+	s, _ := newTestService(source.NewSeeded(nil), 1)
+
+	w := httptest.NewRecorder()
+	s.newHandler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, fmt.Sprintf("%s/tokens?size=1&ordered=maybe", Prefix), nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestReorder_window(t *testing.T) {
+	results := make(chan tokenResult, 10)
+	r := newReorder(2, results)
+	ctx := context.Background()
+
+	assert.True(t, r.acquire(ctx))
+	assert.True(t, r.acquire(ctx))
+
+	// Line 1 waits for line 0 and holds the window.
+	r.put(tokenResult{Index: 1, Token: "b"})
+	assert.Len(t, results, 0)
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.False(t, r.acquire(timeout))
+
+	r.put(tokenResult{Index: 0, Token: "a"})
+	assert.Equal(t, ledger.Token("a"), (<-results).Token)
+	assert.Equal(t, ledger.Token("b"), (<-results).Token)
+	assert.True(t, r.acquire(ctx))
+}
@@ -17,17 +17,26 @@ package server
 import (
 	"context"
 	"fmt"
+	"io"
+	"time"
 
+	"github.com/danielnegri/tokenapi-go/auth"
+	"github.com/danielnegri/tokenapi-go/breaker"
 	"github.com/danielnegri/tokenapi-go/errors"
 	"github.com/danielnegri/tokenapi-go/ledger"
 	"github.com/danielnegri/tokenapi-go/log"
+	"github.com/danielnegri/tokenapi-go/metrics"
 	"github.com/danielnegri/tokenapi-go/net"
+	"github.com/danielnegri/tokenapi-go/quota"
+	"github.com/danielnegri/tokenapi-go/retry"
 	"github.com/danielnegri/tokenapi-go/source"
 	"github.com/danielnegri/tokenapi-go/storage"
 	"github.com/danielnegri/tokenapi-go/storage/postgres"
+	"github.com/danielnegri/tokenapi-go/tracing"
 	"github.com/danielnegri/tokenapi-go/version"
 	"github.com/gin-gonic/gin"
 	"github.com/go-pg/pg/v10"
+	"google.golang.org/grpc/health"
 )
 
 const (
@@ -40,21 +49,99 @@ type Server interface {
 }
 
 type service struct {
-	cfg     *Config
-	server  net.Server
-	source  source.Source
-	storage storage.Storage
-	debug   bool
+	cfg      *Config
+	server   net.Server
+	source   source.Source
+	storage  storage.Storage
+	registry ledger.Registry
+	keys     auth.KeyStore
+	jwt      *auth.JWTVerifier
+	quota    *quota.Limiter
+	debug    bool
+
+	sourceBreaker  *breaker.Breaker
+	storageBreaker *breaker.Breaker
+
+	healthChecks []*healthCheck
+	grpcHealth   *health.Server
+	stopTracing  func()
+
+	// streams tracks the streams in flight, drained on Shutdown.
+	streams streams
+
+	// closers release the storage pool and the source client once the
+	// listeners are shut down, in reverse order.
+	closers []io.Closer
+
+	// ctx is cancelled on close, or when the drain times out, to stop the
+	// work of in-flight requests.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 var _ Server = (*service)(nil)
 
 type Config struct {
+	// Admin configures the admin server. Nil disables it.
+	Admin *net.AdminConfig
+
+	// AuthDisabled lets any client issue tokens without credentials.
+	AuthDisabled bool
+
+	// JWT configures the validation of bearer JWTs, accepted next to API
+	// keys. Nil only accepts API keys.
+	JWT *auth.JWTConfig
+
+	// Breaker configures the circuit breakers placed around the Token
+	// source and the storage. Nil disables them.
+	Breaker *breaker.Config
+
 	Concurrency int
 	Debug       bool
-	HTTPServer  *net.ServerConfig
-	Source      *source.Config
-	Storage     *pg.Options
+
+	// GRPCPort is the port serving the gRPC API. Zero disables it.
+	GRPCPort int
+
+	// DrainTimeout is how long Shutdown lets in-flight streams finish
+	// before cancelling them. The default is DefaultDrainTimeout.
+	DrainTimeout time.Duration
+
+	// HealthTimeout bounds each dependency check of the readiness probe
+	// and HealthCache is how long its result is reused. The defaults are
+	// DefaultHealthTimeout and DefaultHealthCache.
+	HealthTimeout time.Duration
+	HealthCache   time.Duration
+
+	HTTPServer *net.ServerConfig
+
+	// Limits bounds the size of the batches clients may request. Nil
+	// allows up to ledger.MaxBatchSize.
+	Limits *Limits
+
+	// MetricsPort is the port serving the Prometheus metrics. Zero serves
+	// them on the main port under /metrics.
+	MetricsPort int
+
+	// Quota holds the number of tokens each client may issue. Nil leaves
+	// clients unlimited.
+	Quota *quota.Config
+
+	// ReorderWindow is the number of results an ordered insert may hold
+	// in flight or buffered, waiting for an earlier token. A window
+	// smaller than Concurrency limits the workers of ordered inserts. The
+	// default is DefaultReorderWindow.
+	ReorderWindow int
+
+	Source  *source.Config
+	Storage *pg.Options
+
+	// StorageRetry is the policy applied to storage calls failing with a
+	// transient error. Nil disables retries.
+	StorageRetry *retry.Policy
+
+	// Tracing configures the export of OpenTelemetry spans. Nil only
+	// propagates the trace context.
+	Tracing *tracing.Config
 }
 
 func New(cfg *Config) *service {
@@ -66,9 +153,36 @@ func New(cfg *Config) *service {
 		cfg:    cfg,
 		source: source.New(cfg.Source),
 	}
+	svc.ctx, svc.cancel = context.WithCancel(context.Background())
+	if c, ok := svc.source.(io.Closer); ok {
+		svc.closers = append(svc.closers, c)
+	}
+
+	if cfg.Breaker != nil {
+		svc.sourceBreaker = breaker.New("source", cfg.Breaker)
+		svc.source = source.WithBreaker(svc.source, svc.sourceBreaker)
+	}
+
+	// Calls rejected by the rate limiter must not count against the
+	// breaker, so the limiter goes in front of it.
+	if cfg.Source != nil && cfg.Source.RateLimit != nil {
+		svc.source = source.WithRateLimit(svc.source, cfg.Source.RateLimit)
+	}
 
 	server := net.NewServer(cfg.HTTPServer, svc.newHandler())
 	server.Shutdown = svc.Shutdown
+	server.Close = svc.close
+	if cfg.MetricsPort != 0 {
+		server.Handle(cfg.MetricsPort, metrics.Handler())
+	}
+
+	if cfg.GRPCPort != 0 {
+		server.HandleService(cfg.GRPCPort, "gRPC", grpcServer{svc.newGRPCServer()})
+	}
+
+	if admin := cfg.Admin; admin != nil && (admin.Socket != "" || admin.Port != 0) {
+		server.HandleAdmin(admin)
+	}
 	svc.server = server
 
 	return svc
@@ -83,6 +197,22 @@ func (s *service) Run() error {
 		return errors.E(errors.Internal, "invalid server configuration")
 	}
 
+	stopTracing, err := tracing.Setup(cfg.Tracing)
+	if err != nil {
+		log.Errorf("error while setting up tracing: %v", err)
+		return err
+	}
+	s.stopTracing = stopTracing
+
+	if cfg.JWT != nil {
+		verifier, err := auth.NewJWTVerifier(ctx, cfg.JWT)
+		if err != nil {
+			log.Errorf("error while loading JWT keys: %v", err)
+			return err
+		}
+		s.jwt = verifier
+	}
+
 	if cfg.Source != nil && s.source != nil {
 		if err := s.source.Check(ctx); err != nil {
 			log.Errorf("error while connecting to Token source: %v", err)
@@ -94,13 +224,35 @@ func (s *service) Run() error {
 	}
 
 	if cfg.Storage != nil {
-		storage, err := postgres.Connect(cfg.Storage)
+		db, err := postgres.Connect(cfg.Storage)
 		if err != nil {
 			log.Errorf("error while connecting to Postgres: %v", err)
 			return err
 		}
 
-		s.storage = storage
+		s.storage = db
+		s.registry = db
+		s.keys = db
+		s.closers = append(s.closers, db)
+		if cfg.Quota != nil {
+			s.quota = quota.New(cfg.Quota, db)
+		}
+		if err := metrics.Registry.Register(postgres.NewPoolCollector(db)); err != nil {
+			log.Errorf("error while registering storage metrics: %v", err)
+		}
+
+		if cfg.StorageRetry != nil {
+			s.storage = storage.WithRetry(s.storage, cfg.StorageRetry)
+			s.registry = storage.RegistryWithRetry(s.registry, cfg.StorageRetry)
+		}
+
+		// Lookups and revocations share the breaker of the database they
+		// query with inserts.
+		if cfg.Breaker != nil {
+			s.storageBreaker = breaker.New("storage", cfg.Breaker)
+			s.storage = storage.WithBreaker(s.storage, s.storageBreaker)
+			s.registry = storage.RegistryWithBreaker(s.registry, s.storageBreaker)
+		}
 		if err := s.storage.Check(ctx); err != nil {
 			log.Errorf("error while checking connection with storage: %v", err)
 		} else {
@@ -118,6 +270,31 @@ func (s *service) Run() error {
 	return nil
 }
 
+// Shutdown drains the streams in flight. The listeners still answer while
+// it runs, so the storage pool and the Token source client stay open until
+// close.
 func (s *service) Shutdown() {
 	log.Infof("%s: Stopping Ledger service", ledger.Description)
+	if s.grpcHealth != nil {
+		s.grpcHealth.Shutdown()
+	}
+	s.drain()
+}
+
+// close cancels the work left in flight, then closes the storage pool, the
+// Token source client and the span exporter. It is called once the
+// listeners are shut down.
+func (s *service) close() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		if err := s.closers[i].Close(); err != nil {
+			log.Errorf("error while closing %T: %v", s.closers[i], err)
+		}
+	}
+	if s.stopTracing != nil {
+		s.stopTracing()
+	}
 }
@@ -0,0 +1,222 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/log"
+	"github.com/danielnegri/tokenapi-go/source"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Events sent over the SSE and WebSocket streams, and sent by WebSocket
+// clients.
+const (
+	EventProgress = "progress"
+	EventResult   = "result"
+	EventSummary  = "summary"
+	EventCancel   = "cancel"
+)
+
+// wsWriteTimeout bounds each write to a WebSocket client.
+const wsWriteTimeout = 10 * time.Second
+
+// handleStream streams a request for tokens as server-sent events: a
+// progress event every 5% of the tokens, a result event per token and a
+// summary event once done. Clients cancel the request by closing the
+// connection.
+func (s *service) handleStream() gin.HandlerFunc {
+	const op errors.Op = "server/service.handleStream"
+
+	return func(ctx *gin.Context) {
+		reqCtx := ctx.Request.Context()
+
+		req, err := s.issueRequest(ctx)
+		if err == nil {
+			err = s.issue(reqCtx, req, &sseStream{ctx: ctx})
+		}
+		if err != nil {
+			abortIssue(ctx, errors.E(op, reqCtx, err))
+		}
+	}
+}
+
+// sseStream writes the events of a request as server-sent events.
+type sseStream struct {
+	ctx *gin.Context
+}
+
+func (s *sseStream) begin(batch *source.Batch) error {
+	h := s.ctx.Writer.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	// Proxies must not buffer the stream.
+	h.Set("X-Accel-Buffering", "no")
+	if batch.Trace != nil {
+		h.Set("Server-Timing", batch.Trace.ServerTiming())
+	}
+	s.ctx.Status(http.StatusOK)
+	s.ctx.Writer.WriteHeaderNow()
+	s.ctx.Writer.Flush()
+	return nil
+}
+
+func (s *sseStream) send(event string, data interface{}) {
+	s.ctx.SSEvent(event, data)
+	s.ctx.Writer.Flush()
+}
+
+func (s *sseStream) result(r tokenResult)     { s.send(EventResult, r) }
+func (s *sseStream) progress(p issueProgress) { s.send(EventProgress, p) }
+
+func (s *sseStream) end(sum issueSummary) {
+	if s.ctx.Request.Context().Err() == nil {
+		s.send(EventSummary, sum)
+	}
+}
+
+// wsMessage is a message exchanged over a WebSocket stream.
+type wsMessage struct {
+	Event string      `json:"event"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// upgrader accepts WebSocket connections from any origin: clients send
+// their credentials explicitly, never as cookies, so a cross-site page
+// cannot act on their behalf.
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// handleWebSocket streams a request for tokens over a WebSocket, with the
+// events of handleStream sent as {"event": ..., "data": ...} messages. The
+// connection is upgraded once the tokens are generated, so that failed
+// requests are answered with a plain HTTP error; handshakes the upgrader
+// would refuse are refused up front. Clients cancel the
+// request by sending {"event": "cancel"} or by closing the connection.
+func (s *service) handleWebSocket() gin.HandlerFunc {
+	const op errors.Op = "server/service.handleWebSocket"
+
+	return func(ctx *gin.Context) {
+		reqCtx, cancel := context.WithCancel(ctx.Request.Context())
+		defer cancel()
+
+		ws := &wsStream{ctx: ctx, cancel: cancel}
+		defer ws.close()
+
+		if err := checkUpgrade(ctx.Request); err != nil {
+			abortIssue(ctx, errors.E(op, reqCtx, errors.Invalid, err))
+			return
+		}
+
+		req, err := s.issueRequest(ctx)
+		if err == nil {
+			err = s.issue(reqCtx, req, ws)
+		}
+		if err != nil {
+			abortIssue(ctx, errors.E(op, reqCtx, err))
+		}
+	}
+}
+
+// checkUpgrade runs the handshake checks of the upgrader that depend on
+// the request alone, so that a request it would refuse fails before tokens
+// are generated and charged to the client.
+func checkUpgrade(r *http.Request) error {
+	if !websocket.IsWebSocketUpgrade(r) {
+		return errors.Str("WebSocket upgrade required")
+	}
+
+	supported := false
+	for _, v := range strings.Split(r.Header.Get("Sec-Websocket-Version"), ",") {
+		if strings.TrimSpace(v) == "13" {
+			supported = true
+		}
+	}
+	if !supported {
+		return errors.Str("unsupported WebSocket version, 13 is required")
+	}
+
+	if r.Header.Get("Sec-Websocket-Key") == "" {
+		return errors.Str("missing Sec-WebSocket-Key header")
+	}
+	return nil
+}
+
+// wsStream writes the events of a request to a WebSocket and cancels the
+// request when the client asks to or goes away.
+type wsStream struct {
+	ctx    *gin.Context
+	cancel context.CancelFunc
+	conn   *websocket.Conn
+}
+
+func (s *wsStream) begin(*source.Batch) error {
+	conn, err := upgrader.Upgrade(s.ctx.Writer, s.ctx.Request, nil)
+	if err != nil {
+		// The upgrader has already responded.
+		return errors.E(errors.Invalid, err)
+	}
+	s.conn = conn
+
+	go s.read()
+	return nil
+}
+
+// read cancels the request once the client sends a cancel message, closes
+// the connection or sends anything unexpected.
+func (s *wsStream) read() {
+	defer s.cancel()
+
+	for {
+		var msg wsMessage
+		if err := s.conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		if msg.Event == EventCancel {
+			log.FromContext(s.ctx.Request.Context()).Info("Request cancelled by the client")
+			return
+		}
+	}
+}
+
+func (s *wsStream) send(event string, data interface{}) {
+	_ = s.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := s.conn.WriteJSON(wsMessage{Event: event, Data: data}); err != nil {
+		s.cancel()
+	}
+}
+
+func (s *wsStream) result(r tokenResult)     { s.send(EventResult, r) }
+func (s *wsStream) progress(p issueProgress) { s.send(EventProgress, p) }
+func (s *wsStream) end(sum issueSummary)     { s.send(EventSummary, sum) }
+
+// close closes the connection, if upgraded, with a close message.
+func (s *wsStream) close() {
+	if s.conn == nil {
+		return
+	}
+
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	_ = s.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteTimeout))
+	_ = s.conn.Close()
+}
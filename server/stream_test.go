@@ -0,0 +1,219 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/auth"
+	"github.com/danielnegri/tokenapi-go/metrics"
+	"github.com/danielnegri/tokenapi-go/source"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+type sseEvent struct {
+	event string
+	data  string
+}
+
+func parseSSE(t *testing.T, body string) []sseEvent {
+	var events []sseEvent
+	for _, block := range strings.Split(strings.TrimSpace(body), "\n\n") {
+		var e sseEvent
+		for _, line := range strings.Split(block, "\n") {
+			switch {
+			case strings.HasPrefix(line, "event:"):
+				e.event = strings.TrimPrefix(line, "event:")
+			case strings.HasPrefix(line, "data:"):
+				e.data = strings.TrimPrefix(line, "data:")
+			}
+		}
+		if e.event == "" {
+			t.Fatalf("malformed event: %q", block)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestHandleStream(t *testing.T) {
+	s, storage := newTestService(source.NewSeeded(nil), 4)
+
+	w := httptest.NewRecorder()
+	s.newHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("%s/tokens/stream?size=40", Prefix), nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+
+	var (
+		results  int
+		progress issueProgress
+		summary  issueSummary
+	)
+	for _, e := range parseSSE(t, w.Body.String()) {
+		switch e.event {
+		case EventResult:
+			var r tokenResult
+			assert.NoError(t, json.Unmarshal([]byte(e.data), &r))
+			assert.Equal(t, metrics.ResultIssued, r.Result)
+			results++
+		case EventProgress:
+			assert.NoError(t, json.Unmarshal([]byte(e.data), &progress))
+		case EventSummary:
+			assert.NoError(t, json.Unmarshal([]byte(e.data), &summary))
+		default:
+			t.Errorf("unexpected event %q", e.event)
+		}
+	}
+
+	assert.Equal(t, 40, results)
+	assert.Equal(t, issueProgress{Done: 40, Total: 40, Issued: 40}, progress)
+	assert.Equal(t, issueSummary{Status: StatusComplete, Requested: 40, Tokens: 40, Issued: 40}, summary)
+	assert.Equal(t, 40, storage.Len())
+}
+
+func TestHandleStream_accessToken(t *testing.T) {
+	s, storage := newTestService(source.NewSeeded(nil), 1)
+	s.cfg.AuthDisabled = false
+	h := s.newHandler()
+
+	apiKey, key, err := auth.NewKey("browser", []auth.Scope{auth.ScopeIssue})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, storage.CreateKey(context.Background(), key))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("%s/tokens/stream?size=1", Prefix), nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("%s/tokens/stream?size=1&%s=%s", Prefix, AccessTokenParam, apiKey), nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// The query parameter is only accepted on GET requests.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, fmt.Sprintf("%s/tokens?size=1&%s=%s", Prefix, AccessTokenParam, apiKey), nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func dialWebSocket(t *testing.T, h http.Handler, size int) (*websocket.Conn, func()) {
+	srv := httptest.NewServer(h)
+	url := fmt.Sprintf("ws%s%s/tokens/ws?size=%d", strings.TrimPrefix(srv.URL, "http"), Prefix, size)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	return conn, func() {
+		_ = conn.Close()
+		srv.Close()
+	}
+}
+
+type wsTestMessage struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// readSummary reads messages until the summary, counting the results.
+func readSummary(t *testing.T, conn *websocket.Conn) (int, issueSummary) {
+	results := 0
+	for {
+		var msg wsTestMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+
+		switch msg.Event {
+		case EventResult:
+			results++
+		case EventSummary:
+			var sum issueSummary
+			assert.NoError(t, json.Unmarshal(msg.Data, &sum))
+			return results, sum
+		}
+	}
+}
+
+func TestHandleWebSocket(t *testing.T) {
+	s, storage := newTestService(source.NewSeeded(nil), 4)
+	conn, closeConn := dialWebSocket(t, s.newHandler(), 30)
+	defer closeConn()
+
+	results, sum := readSummary(t, conn)
+	assert.Equal(t, 30, results)
+	assert.Equal(t, issueSummary{Status: StatusComplete, Requested: 30, Tokens: 30, Issued: 30}, sum)
+	assert.Equal(t, 30, storage.Len())
+
+	// The server closes the connection once done.
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), err)
+}
+
+func TestHandleWebSocket_cancel(t *testing.T) {
+	storage := newBlockingStorage(5)
+	s := &service{cfg: &Config{AuthDisabled: true, Concurrency: 2}, source: source.NewSeeded(nil), storage: storage}
+	conn, closeConn := dialWebSocket(t, s.newHandler(), 100)
+	defer closeConn()
+
+	<-storage.blocked
+	assert.NoError(t, conn.WriteJSON(wsMessage{Event: EventCancel}))
+
+	_, sum := readSummary(t, conn)
+	assert.Equal(t, StatusCancelled, sum.Status)
+	assert.Equal(t, 5, sum.Issued)
+	assert.Equal(t, 95, sum.Cancelled)
+	assert.Equal(t, 5, storage.Len())
+}
+
+func TestHandleWebSocket_upgradeRequired(t *testing.T) {
+	s, _ := newTestService(source.NewSeeded(nil), 1)
+
+	w := httptest.NewRecorder()
+	s.newHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("%s/tokens/ws?size=1", Prefix), nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestHandleWebSocket_badHandshake(t *testing.T) {
+	// The handshake is refused before the source is called: a failing
+	// source would answer 500.
+	s, _ := newTestService(failingSource{}, 1)
+
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("%s/tokens/ws?size=1", Prefix), nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "8")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+	w := httptest.NewRecorder()
+	s.newHandler().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Del("Sec-WebSocket-Key")
+	w = httptest.NewRecorder()
+	s.newHandler().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,177 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/ledger"
+	"github.com/danielnegri/tokenapi-go/log"
+	"github.com/danielnegri/tokenapi-go/net/httputil"
+	"github.com/danielnegri/tokenapi-go/valid"
+	"github.com/gin-gonic/gin"
+)
+
+// TokenRequest is the body of the requests about an issued token. Tokens
+// are secrets, so they are never sent in URLs.
+type TokenRequest struct {
+	Token ledger.Token `json:"token"`
+}
+
+// TokenRecord describes an issued token.
+type TokenRecord struct {
+	Token     ledger.Token `json:"token"`
+	IssuedAt  time.Time    `json:"issued_at"`
+	RevokedAt *time.Time   `json:"revoked_at,omitempty"`
+}
+
+func newTokenRecord(r *ledger.Record) *TokenRecord {
+	record := &TokenRecord{Token: r.Token, IssuedAt: r.IssuedAt}
+	if r.Revoked() {
+		revokedAt := r.RevokedAt
+		record.RevokedAt = &revokedAt
+	}
+	return record
+}
+
+// Verification tells whether a token was issued and not revoked.
+type Verification struct {
+	Token ledger.Token `json:"token"`
+	Valid bool         `json:"valid"`
+}
+
+// lookup returns the record of token.
+func (s *service) lookup(ctx context.Context, token ledger.Token) (*ledger.Record, error) {
+	const op errors.Op = "server/service.lookup"
+
+	if err := valid.Token(token); err != nil {
+		return nil, errors.E(op, ctx, err)
+	}
+
+	if s.registry == nil {
+		return nil, errors.E(op, ctx, errors.Transient, "issued tokens are not available")
+	}
+
+	return s.registry.Lookup(ctx, token)
+}
+
+// verify reports whether token was issued and not revoked.
+func (s *service) verify(ctx context.Context, token ledger.Token) (*Verification, error) {
+	record, err := s.lookup(ctx, token)
+	if errors.Is(errors.NotFound, err) {
+		return &Verification{Token: token}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Verification{Token: token, Valid: !record.Revoked()}, nil
+}
+
+// revoke revokes token.
+func (s *service) revoke(ctx context.Context, token ledger.Token) (*ledger.Record, error) {
+	const op errors.Op = "server/service.revoke"
+
+	if err := valid.Token(token); err != nil {
+		return nil, errors.E(op, ctx, err)
+	}
+
+	if s.registry == nil {
+		return nil, errors.E(op, ctx, errors.Transient, "issued tokens are not available")
+	}
+
+	record, err := s.registry.Revoke(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	log.FromContext(ctx).Infof("Token %s revoked", log.RedactToken(string(token)))
+	return record, nil
+}
+
+// tokenRequest binds the body of a request about an issued token.
+func tokenRequest(ctx *gin.Context) (ledger.Token, error) {
+	const op errors.Op = "server/tokenRequest"
+
+	var req TokenRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		return "", errors.E(op, ctx.Request.Context(), errors.Invalid, errors.Errorf("invalid request body: %v", err))
+	}
+
+	return req.Token, nil
+}
+
+// handleVerify serves POST /tokens/verify, which answers 200 whether the
+// token is valid or not.
+func (s *service) handleVerify() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		token, err := tokenRequest(ctx)
+		if err != nil {
+			httputil.AbortWithError(ctx, err)
+			return
+		}
+
+		v, err := s.verify(ctx.Request.Context(), token)
+		if err != nil {
+			httputil.AbortWithError(ctx, err)
+			return
+		}
+
+		ctx.JSON(http.StatusOK, v)
+	}
+}
+
+// handleLookup serves POST /tokens/lookup, which answers 404 for unknown
+// tokens.
+func (s *service) handleLookup() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		token, err := tokenRequest(ctx)
+		if err != nil {
+			httputil.AbortWithError(ctx, err)
+			return
+		}
+
+		record, err := s.lookup(ctx.Request.Context(), token)
+		if err != nil {
+			httputil.AbortWithError(ctx, err)
+			return
+		}
+
+		ctx.JSON(http.StatusOK, newTokenRecord(record))
+	}
+}
+
+// handleRevoke serves POST /tokens/revoke, which answers 404 for unknown
+// tokens. Revoking a revoked token succeeds.
+func (s *service) handleRevoke() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		token, err := tokenRequest(ctx)
+		if err != nil {
+			httputil.AbortWithError(ctx, err)
+			return
+		}
+
+		record, err := s.revoke(ctx.Request.Context(), token)
+		if err != nil {
+			httputil.AbortWithError(ctx, err)
+			return
+		}
+
+		ctx.JSON(http.StatusOK, newTokenRecord(record))
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/danielnegri/tokenapi-go/source"
+	"github.com/stretchr/testify/assert"
+)
+
+func postToken(h http.Handler, route, token string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	body := fmt.Sprintf(`{"token": %q}`, token)
+	req := httptest.NewRequest(http.MethodPost, Prefix+"/tokens/"+route, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestHandleTokens(t *testing.T) {
+	s, _ := newTestService(source.NewSeeded(nil), 1)
+	h := s.newHandler()
+
+	w := insert(h, 1)
+	token := strings.TrimPrefix(strings.TrimSpace(w.Body.String()), "OK : ")
+
+	var v Verification
+	w = postToken(h, "verify", token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &v))
+	assert.True(t, v.Valid)
+
+	var record TokenRecord
+	w = postToken(h, "lookup", token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &record))
+	assert.Equal(t, token, string(record.Token))
+	assert.False(t, record.IssuedAt.IsZero())
+	assert.Nil(t, record.RevokedAt)
+
+	w = postToken(h, "revoke", token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &record))
+	if assert.NotNil(t, record.RevokedAt) {
+		// Revoking again keeps the first revocation time.
+		revokedAt := *record.RevokedAt
+		w = postToken(h, "revoke", token)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &record))
+		assert.True(t, revokedAt.Equal(*record.RevokedAt))
+	}
+
+	w = postToken(h, "verify", token)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &v))
+	assert.False(t, v.Valid)
+}
+
+func TestHandleTokens_errors(t *testing.T) {
+	s, _ := newTestService(source.NewSeeded(nil), 1)
+	h := s.newHandler()
+
+	var v Verification
+	w := postToken(h, "verify", "ijkr2lXOkM1EElPSDQFkeg")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &v))
+	assert.False(t, v.Valid)
+
+	assert.Equal(t, http.StatusNotFound, postToken(h, "lookup", "ijkr2lXOkM1EElPSDQFkeg").Code)
+	assert.Equal(t, http.StatusNotFound, postToken(h, "revoke", "ijkr2lXOkM1EElPSDQFkeg").Code)
+	assert.Equal(t, http.StatusBadRequest, postToken(h, "lookup", "has-dash").Code)
+	assert.Equal(t, http.StatusBadRequest, postToken(h, "verify", "").Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, Prefix+"/tokens/lookup", strings.NewReader("token")))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
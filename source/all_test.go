@@ -25,6 +25,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/danielnegri/tokenapi-go/retry"
 	"github.com/gin-gonic/gin"
 )
 
@@ -61,7 +62,7 @@ func newTestSource(t *testing.T, rawurl string) Source {
 	}
 
 	cfg := &Config{
-		Retry:   1,
+		Retry:   &retry.Policy{MaxAttempts: 2, BaseBackoff: time.Millisecond},
 		Timeout: 1 * time.Second,
 		URL:     cfgURL,
 	}
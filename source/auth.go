@@ -0,0 +1,387 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+)
+
+// Headers set on requests signed with an HMAC key.
+const (
+	TimestampHeader = "X-Ledger-Timestamp"
+	SignatureHeader = "X-Ledger-Signature"
+)
+
+// AuthConfig configures how requests to the Token source are authenticated.
+// Secrets are read from an environment variable or a file; files are read
+// again whenever they change, so credentials can be rotated in place.
+type AuthConfig struct {
+	// TokenEnv and TokenFile name where a static credential is read from.
+	// It is sent as "Authorization: Bearer <token>", or as the value of
+	// Header when set (for example "X-API-Key").
+	TokenEnv  string
+	TokenFile string
+	Header    string
+
+	// HMACKeyEnv and HMACKeyFile name where the key used to sign requests
+	// is read from. Signed requests carry the Unix time in TimestampHeader
+	// and, in SignatureHeader, the hex-encoded HMAC-SHA256 of
+	//
+	//	timestamp + "\n" + method + "\n" + request URI + "\n" + hex(sha256(body))
+	HMACKeyEnv  string
+	HMACKeyFile string
+
+	// CertFile and KeyFile hold a PEM client certificate presented to the
+	// Token source. CAFile holds the PEM bundle used instead of the system
+	// roots to verify the Token source.
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+func (cfg *AuthConfig) token() *secret {
+	return newSecret(cfg.TokenEnv, cfg.TokenFile)
+}
+
+func (cfg *AuthConfig) hmacKey() *secret {
+	return newSecret(cfg.HMACKeyEnv, cfg.HMACKeyFile)
+}
+
+// Validate checks that every configured credential can be loaded.
+func (cfg *AuthConfig) Validate() error {
+	const op errors.Op = "source/AuthConfig.Validate"
+
+	for _, s := range []*secret{cfg.token(), cfg.hmacKey()} {
+		if s == nil {
+			continue
+		}
+
+		if _, err := s.get(); err != nil {
+			return errors.E(op, errors.Invalid, err)
+		}
+	}
+
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return errors.E(op, errors.Invalid, "client certificate and key must be set together")
+	}
+
+	if cfg.CAFile != "" {
+		if _, err := newCAPool(cfg.CAFile).get(); err != nil {
+			return errors.E(op, errors.Invalid, err)
+		}
+	}
+
+	if cfg.CertFile != "" {
+		if _, err := newKeyPair(cfg.CertFile, cfg.KeyFile).get(); err != nil {
+			return errors.E(op, errors.Invalid, err)
+		}
+	}
+
+	return nil
+}
+
+// tlsConfig returns the TLS configuration for the Token source at
+// serverName, or nil if the defaults apply.
+func (cfg *AuthConfig) tlsConfig(serverName string) (*tls.Config, error) {
+	if cfg.CAFile == "" && cfg.CertFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+	if cfg.CAFile != "" {
+		ca := newCAPool(cfg.CAFile)
+		if _, err := ca.get(); err != nil {
+			return nil, err
+		}
+
+		// RootCAs cannot change once the transport holds the config, so
+		// the chain is verified against the current pool here instead.
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return ca.verify(serverName, rawCerts)
+		}
+	}
+
+	if cfg.CertFile != "" {
+		pair := newKeyPair(cfg.CertFile, cfg.KeyFile)
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return pair.get()
+		}
+	}
+
+	return config, nil
+}
+
+// authTransport is an http.RoundTripper that adds credentials to requests.
+type authTransport struct {
+	transport http.RoundTripper
+	header    string
+	token     *secret
+	hmacKey   *secret
+	now       func() time.Time
+}
+
+func newAuthTransport(transport http.RoundTripper, cfg *AuthConfig) http.RoundTripper {
+	token, hmacKey := cfg.token(), cfg.hmacKey()
+	if token == nil && hmacKey == nil {
+		return transport
+	}
+
+	return &authTransport{
+		transport: transport,
+		header:    cfg.Header,
+		token:     token,
+		hmacKey:   hmacKey,
+		now:       time.Now,
+	}
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request it was given.
+	r := req.Clone(req.Context())
+
+	if t.token != nil {
+		token, err := t.token.get()
+		if err != nil {
+			return nil, err
+		}
+
+		if t.header != "" {
+			r.Header.Set(t.header, string(token))
+		} else {
+			r.Header.Set("Authorization", "Bearer "+string(token))
+		}
+	}
+
+	if t.hmacKey != nil {
+		key, err := t.hmacKey.get()
+		if err != nil {
+			return nil, err
+		}
+
+		var body []byte
+		if r.Body != nil && r.Body != http.NoBody {
+			body, err = ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		timestamp := strconv.FormatInt(t.now().Unix(), 10)
+		r.Header.Set(TimestampHeader, timestamp)
+		r.Header.Set(SignatureHeader, Sign(key, timestamp, r.Method, r.URL.RequestURI(), body))
+	}
+
+	return t.transport.RoundTrip(r)
+}
+
+// Sign returns the signature of a request as sent in SignatureHeader.
+func Sign(key []byte, timestamp, method, uri string, body []byte) string {
+	sum := sha256.Sum256(body)
+
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", timestamp, method, uri, hex.EncodeToString(sum[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// failingTransport fails every request with the error that prevented the
+// client from being configured.
+type failingTransport struct {
+	err error
+}
+
+func (t failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, t.err
+}
+
+// secret is a credential read from an environment variable or from a file
+// that is read again when its modification time changes.
+type secret struct {
+	env  string
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	value   []byte
+}
+
+// newSecret returns nil if neither env nor path is set.
+func newSecret(env, path string) *secret {
+	if env == "" && path == "" {
+		return nil
+	}
+	return &secret{env: env, path: path}
+}
+
+func (s *secret) get() ([]byte, error) {
+	if s.path == "" {
+		value, ok := os.LookupEnv(s.env)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("environment variable %s is not set", s.env)
+		}
+		return []byte(value), nil
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.value == nil || !info.ModTime().Equal(s.modTime) {
+		value, err := ioutil.ReadFile(s.path)
+		if err != nil {
+			return nil, err
+		}
+
+		value = bytes.TrimSpace(value)
+		if len(value) == 0 {
+			return nil, fmt.Errorf("%s is empty", s.path)
+		}
+
+		s.value, s.modTime = value, info.ModTime()
+	}
+
+	return s.value, nil
+}
+
+// keyPair is a client certificate loaded from files that are read again
+// when either of them changes.
+type keyPair struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	modTimes [2]time.Time
+	cert     *tls.Certificate
+}
+
+func newKeyPair(certFile, keyFile string) *keyPair {
+	return &keyPair{certFile: certFile, keyFile: keyFile}
+}
+
+func (p *keyPair) get() (*tls.Certificate, error) {
+	var modTimes [2]time.Time
+	for i, path := range []string{p.certFile, p.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cert == nil || modTimes != p.modTimes {
+		cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		p.cert, p.modTimes = &cert, modTimes
+	}
+
+	return p.cert, nil
+}
+
+// caPool is a bundle of PEM certificates read from a file that is read
+// again when it changes.
+type caPool struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	pool    *x509.CertPool
+}
+
+func newCAPool(path string) *caPool {
+	return &caPool{path: path}
+}
+
+func (c *caPool) get() (*x509.CertPool, error) {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pool == nil || !info.ModTime().Equal(c.modTime) {
+		pem, err := ioutil.ReadFile(c.path)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.path)
+		}
+		c.pool, c.modTime = pool, info.ModTime()
+	}
+
+	return c.pool, nil
+}
+
+// verify checks the certificate chain presented by serverName against the
+// current pool, as crypto/tls does with RootCAs.
+func (c *caPool) verify(serverName string, rawCerts [][]byte) error {
+	pool, err := c.get()
+	if err != nil {
+		return err
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificate presented by %s", serverName)
+	}
+
+	opts := x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	_, err = certs[0].Verify(opts)
+	return err
+}
@@ -0,0 +1,226 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/retry"
+	"github.com/stretchr/testify/assert"
+)
+
+func newAuthTestSource(t *testing.T, rawurl string, auth *AuthConfig) Source {
+	srcURL, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return New(&Config{
+		URL:     srcURL,
+		Retry:   &retry.Policy{MaxAttempts: 1},
+		Timeout: time.Second,
+		Auth:    auth,
+	})
+}
+
+func newAuthTestServer(check func(req *http.Request) bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if !check(req) {
+			res.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		res.Write([]byte("xPGvwdBqDrpFLXyMVf0ovQ\n"))
+	}))
+}
+
+func writeFile(t *testing.T, path, content string, modTime time.Time) {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuth_tokenFileReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	want := "first"
+	ts := newAuthTestServer(func(req *http.Request) bool {
+		return req.Header.Get("Authorization") == "Bearer "+want
+	})
+	defer ts.Close()
+
+	path := filepath.Join(dir, "token")
+	writeFile(t, path, "first\n", time.Now().Add(-time.Hour))
+
+	src := newAuthTestSource(t, ts.URL, &AuthConfig{TokenFile: path})
+	assert.NoError(t, src.Check(context.Background()))
+
+	want = "second"
+	assert.Error(t, src.Check(context.Background()))
+
+	writeFile(t, path, "second", time.Now())
+	assert.NoError(t, src.Check(context.Background()))
+}
+
+func TestAuth_apiKeyHeader(t *testing.T) {
+	ts := newAuthTestServer(func(req *http.Request) bool {
+		return req.Header.Get("X-API-Key") == "secret" && req.Header.Get("Authorization") == ""
+	})
+	defer ts.Close()
+
+	os.Setenv("LEDGER_TEST_SOURCE_KEY", "secret")
+	defer os.Unsetenv("LEDGER_TEST_SOURCE_KEY")
+
+	auth := &AuthConfig{TokenEnv: "LEDGER_TEST_SOURCE_KEY", Header: "X-API-Key"}
+	assert.NoError(t, auth.Validate())
+	assert.NoError(t, newAuthTestSource(t, ts.URL, auth).Check(context.Background()))
+
+	assert.Error(t, (&AuthConfig{TokenEnv: "LEDGER_TEST_SOURCE_UNSET"}).Validate())
+}
+
+func TestAuth_hmac(t *testing.T) {
+	key := []byte("signing key")
+	ts := newAuthTestServer(func(req *http.Request) bool {
+		timestamp := req.Header.Get(TimestampHeader)
+		want := Sign(key, timestamp, req.Method, req.URL.RequestURI(), nil)
+		return timestamp != "" && req.Header.Get(SignatureHeader) == want
+	})
+	defer ts.Close()
+
+	os.Setenv("LEDGER_TEST_SOURCE_HMAC", string(key))
+	defer os.Unsetenv("LEDGER_TEST_SOURCE_HMAC")
+
+	src := newAuthTestSource(t, ts.URL, &AuthConfig{HMACKeyEnv: "LEDGER_TEST_SOURCE_HMAC"})
+	batch, err := src.Generate(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Len(t, batch.Tokens, 1)
+}
+
+func TestAuth_mTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clientCert, clientKey := newTestCertificate(t)
+	certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	writeFile(t, certFile, clientCert, time.Now())
+	writeFile(t, keyFile, clientKey, time.Now())
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM([]byte(clientCert))
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte("xPGvwdBqDrpFLXyMVf0ovQ\n"))
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	ts.StartTLS()
+	defer ts.Close()
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	writeFile(t, caFile, string(ca), time.Now())
+
+	auth := &AuthConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}
+	assert.NoError(t, auth.Validate())
+	assert.NoError(t, newAuthTestSource(t, ts.URL, auth).Check(context.Background()))
+
+	// Without a client certificate the handshake fails.
+	assert.Error(t, newAuthTestSource(t, ts.URL, &AuthConfig{CAFile: caFile}).Check(context.Background()))
+}
+
+func TestAuth_caFileReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte("xPGvwdBqDrpFLXyMVf0ovQ\n"))
+	}))
+	defer ts.Close()
+
+	// The bundle does not hold the server's CA at first.
+	other, _ := newTestCertificate(t)
+	caFile := filepath.Join(dir, "ca.pem")
+	writeFile(t, caFile, other, time.Now().Add(-time.Minute))
+
+	src := newAuthTestSource(t, ts.URL, &AuthConfig{CAFile: caFile})
+	assert.Error(t, src.Check(context.Background()))
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	writeFile(t, caFile, string(ca), time.Now())
+	assert.NoError(t, src.Check(context.Background()))
+
+	// The certificate must still name the host.
+	u, _ := url.Parse(ts.URL)
+	u.Host = "localhost:" + u.Port()
+	assert.Error(t, newAuthTestSource(t, u.String(), &AuthConfig{CAFile: caFile}).Check(context.Background()))
+}
+
+func newTestCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ledger"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return string(cert), string(keyPEM)
+}
@@ -0,0 +1,46 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+
+	"github.com/danielnegri/tokenapi-go/breaker"
+)
+
+type breakerSource struct {
+	src     Source
+	breaker *breaker.Breaker
+}
+
+// WithBreaker returns a Source that sends every call to src through the
+// given circuit breaker.
+func WithBreaker(src Source, b *breaker.Breaker) Source {
+	return &breakerSource{src: src, breaker: b}
+}
+
+func (s *breakerSource) Check(ctx context.Context) error {
+	return s.breaker.Do(ctx, s.src.Check)
+}
+
+func (s *breakerSource) Generate(ctx context.Context, n int) (*Batch, error) {
+	var batch *Batch
+	err := s.breaker.Do(ctx, func(ctx context.Context) error {
+		var err error
+		batch, err = s.src.Generate(ctx, n)
+		return err
+	})
+	return batch, err
+}
@@ -0,0 +1,228 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/danielnegri/tokenapi-go/log"
+)
+
+// Transport modes of the Token source client.
+const (
+	// ModeLive sends requests to the Token source.
+	ModeLive = "live"
+
+	// ModeRecord sends requests to the Token source and appends every
+	// exchange to the fixture file.
+	ModeRecord = "record"
+
+	// ModeReplay serves responses from the fixture file without touching
+	// the network.
+	ModeReplay = "replay"
+)
+
+// Exchange is a request and response pair stored in a fixture file.
+// Fixture files hold one JSON-encoded Exchange per line.
+type Exchange struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+type RecordedRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+}
+
+type RecordedResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body"`
+}
+
+// exchangeKey identifies a request regardless of the host it was sent to,
+// so fixtures recorded against one source can be replayed against any URL.
+func exchangeKey(method, uri string) string {
+	return method + " " + uri
+}
+
+// requestURI returns the path and query of req with the query parameters
+// in a canonical order.
+func requestURI(req *http.Request) string {
+	u := *req.URL
+	u.RawQuery = u.Query().Encode()
+	return u.RequestURI()
+}
+
+// recorder is an http.RoundTripper that appends every exchange to a
+// fixture file.
+type recorder struct {
+	transport http.RoundTripper
+	path      string
+
+	mu sync.Mutex
+}
+
+func newRecorder(transport http.RoundTripper, path string) *recorder {
+	return &recorder{transport: transport, path: path}
+}
+
+func (r *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	exchange := Exchange{
+		Request: RecordedRequest{Method: req.Method, URL: requestURI(req)},
+		Response: RecordedResponse{
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+			Body:       string(body),
+		},
+	}
+
+	if err := r.write(&exchange); err != nil {
+		log.Errorf("failed to record token source exchange to %s: %v", r.path, err)
+	}
+
+	return resp, nil
+}
+
+func (r *recorder) write(exchange *Exchange) error {
+	line, err := json.Marshal(exchange)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// replayer is an http.RoundTripper that serves responses from a fixture
+// file. Exchanges recorded for the same request are served in order; once
+// they run out, the last one is served again.
+type replayer struct {
+	path string
+
+	once      sync.Once
+	err       error
+	mu        sync.Mutex
+	exchanges map[string][]*Exchange
+	served    map[string]int
+}
+
+func newReplayer(path string) *replayer {
+	return &replayer{path: path}
+}
+
+func (r *replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.once.Do(r.load)
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	key := exchangeKey(req.Method, requestURI(req))
+
+	r.mu.Lock()
+	exchanges := r.exchanges[key]
+	if len(exchanges) == 0 {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("no recorded exchange in %s for %s", r.path, key)
+	}
+
+	i := r.served[key]
+	if i < len(exchanges)-1 {
+		r.served[key]++
+	}
+	exchange := exchanges[i]
+	r.mu.Unlock()
+
+	header := make(http.Header, len(exchange.Response.Header))
+	for k, v := range exchange.Response.Header {
+		header[k] = append([]string(nil), v...)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", exchange.Response.StatusCode, http.StatusText(exchange.Response.StatusCode)),
+		StatusCode:    exchange.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewBufferString(exchange.Response.Body)),
+		ContentLength: int64(len(exchange.Response.Body)),
+		Request:       req,
+	}, nil
+}
+
+func (r *replayer) load() {
+	f, err := os.Open(r.path)
+	if err != nil {
+		r.err = err
+		return
+	}
+	defer f.Close()
+
+	r.exchanges = make(map[string][]*Exchange)
+	r.served = make(map[string]int)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var exchange Exchange
+		if err := json.Unmarshal(scanner.Bytes(), &exchange); err != nil {
+			r.err = fmt.Errorf("%s:%d: %v", r.path, line, err)
+			return
+		}
+
+		key := exchangeKey(exchange.Request.Method, exchange.Request.URL)
+		r.exchanges[key] = append(r.exchanges[key], &exchange)
+	}
+	r.err = scanner.Err()
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/retry"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fixture := filepath.Join(dir, "exchanges.jsonl")
+
+	ts := newTestServer(t, 42)
+	srcURL, _ := url.Parse(ts.URL)
+	recorder := New(&Config{URL: srcURL, Mode: ModeRecord, Fixture: fixture})
+
+	ctx := context.Background()
+	assert.NoError(t, recorder.Check(ctx))
+	recorded, err := recorder.Generate(ctx, 5)
+	assert.NoError(t, err)
+	ts.Close()
+
+	replayURL, _ := url.Parse(discardURL)
+	replayer := New(&Config{
+		URL:     replayURL,
+		Mode:    ModeReplay,
+		Fixture: fixture,
+		Retry:   &retry.Policy{MaxAttempts: 1},
+		Timeout: time.Second,
+	})
+	assert.NoError(t, replayer.Check(ctx))
+
+	replayed, err := replayer.Generate(ctx, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, recorded.Tokens, replayed.Tokens)
+
+	_, err = replayer.Generate(ctx, 6)
+	assert.True(t, errors.Is(errors.Internal, err))
+}
@@ -0,0 +1,199 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+)
+
+// DefaultRateLimitWait is how long a call may queue for the rate limiter
+// when RateLimit.MaxWait is not set.
+const DefaultRateLimitWait = 5 * time.Second
+
+// RateLimit configures the token buckets limiting Generate calls to the
+// Token source, measured both in requests and in tokens requested.
+type RateLimit struct {
+	// Requests is the sustained number of requests per second and
+	// RequestBurst the number that may be sent at once. Zero Requests
+	// disables the limit. The burst defaults to one second worth of
+	// requests.
+	Requests     float64
+	RequestBurst int
+
+	// Tokens is the sustained number of tokens requested per second and
+	// TokenBurst the number that may be requested at once. Zero Tokens
+	// disables the limit. A single call may ask for more than the burst;
+	// it then waits until the bucket has refilled.
+	Tokens     float64
+	TokenBurst int
+
+	// MaxWait is how long a call may queue before failing with a
+	// Transient error. The default is DefaultRateLimitWait.
+	MaxWait time.Duration
+}
+
+type limitedSource struct {
+	src     Source
+	maxWait time.Duration
+	now     func() time.Time
+
+	// mu guards both buckets so that a call reserves from them at once.
+	// Reservations are served in the order they were made.
+	mu       sync.Mutex
+	requests *bucket
+	tokens   *bucket
+}
+
+// WithRateLimit returns a Source that queues calls to Generate so they stay
+// within the given rate limits. Check is not limited, so that health checks
+// keep reporting on the Token source while requests queue.
+func WithRateLimit(src Source, cfg *RateLimit) Source {
+	s := &limitedSource{
+		src:     src,
+		maxWait: cfg.MaxWait,
+		now:     time.Now,
+	}
+
+	if s.maxWait == 0 {
+		s.maxWait = DefaultRateLimitWait
+	}
+
+	if cfg.Requests > 0 {
+		s.requests = newBucket(cfg.Requests, cfg.RequestBurst)
+	}
+
+	if cfg.Tokens > 0 {
+		s.tokens = newBucket(cfg.Tokens, cfg.TokenBurst)
+	}
+
+	return s
+}
+
+func (s *limitedSource) Check(ctx context.Context) error {
+	return s.src.Check(ctx)
+}
+
+func (s *limitedSource) Generate(ctx context.Context, n int) (*Batch, error) {
+	const op errors.Op = "source/limitedSource.Generate"
+	if err := s.wait(ctx, n); err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	return s.src.Generate(ctx, n)
+}
+
+// wait reserves one request and n tokens and blocks until the reservation
+// is due. It fails without waiting if the reservation is due after MaxWait.
+func (s *limitedSource) wait(ctx context.Context, n int) error {
+	s.mu.Lock()
+	now := s.now()
+	var delay time.Duration
+	if s.requests != nil {
+		delay = s.requests.reserve(now, 1)
+	}
+	if s.tokens != nil && n > 0 {
+		if d := s.tokens.reserve(now, float64(n)); d > delay {
+			delay = d
+		}
+	}
+
+	if delay > s.maxWait {
+		s.cancel(n)
+		s.mu.Unlock()
+		return errors.E(errors.Transient, &LimitError{Wait: delay})
+	}
+	s.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		s.cancel(n)
+		s.mu.Unlock()
+		return errors.E(errors.Transient, ctx.Err())
+	}
+}
+
+// cancel returns a reservation to the buckets. s.mu must be held.
+func (s *limitedSource) cancel(n int) {
+	if s.requests != nil {
+		s.requests.tokens++
+	}
+	if s.tokens != nil && n > 0 {
+		s.tokens.tokens += float64(n)
+	}
+}
+
+// LimitError is the underlying error returned when a call would have to
+// queue longer than allowed for the rate limiter.
+type LimitError struct {
+	Wait time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("token source rate limit exceeded, retry in %v", e.Wait.Round(time.Millisecond))
+}
+
+// RetryAfter returns how long callers should wait before trying again.
+func (e *LimitError) RetryAfter() time.Duration {
+	return e.Wait
+}
+
+// bucket is a token bucket whose level may go negative: callers reserve
+// what they need and wait until the bucket has refilled to zero.
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, burst int) *bucket {
+	b := float64(burst)
+	if b <= 0 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+
+	return &bucket{rate: rate, burst: b, tokens: b}
+}
+
+// reserve takes n from the bucket and returns how long the caller has to
+// wait for the bucket to cover it.
+func (b *bucket) reserve(now time.Time, n float64) time.Duration {
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
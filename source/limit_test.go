@@ -0,0 +1,98 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/ledger"
+	"github.com/stretchr/testify/assert"
+)
+
+type nopSource struct{}
+
+func (nopSource) Check(context.Context) error { return nil }
+
+func (nopSource) Generate(_ context.Context, n int) (*Batch, error) {
+	return &Batch{Tokens: make([]ledger.Token, n)}, nil
+}
+
+func newTestLimiter(cfg *RateLimit, now *time.Time) *limitedSource {
+	s := WithRateLimit(nopSource{}, cfg).(*limitedSource)
+	s.now = func() time.Time { return *now }
+	return s
+}
+
+func TestWithRateLimit_requests(t *testing.T) {
+	now := time.Now()
+	src := newTestLimiter(&RateLimit{Requests: 10, RequestBurst: 2, MaxWait: 50 * time.Millisecond}, &now)
+	ctx := context.Background()
+
+	_, err := src.Generate(ctx, 1)
+	assert.NoError(t, err)
+	_, err = src.Generate(ctx, 1)
+	assert.NoError(t, err)
+
+	_, err = src.Generate(ctx, 1)
+	assert.True(t, errors.Is(errors.Transient, err))
+	if e, ok := err.(*errors.Error); assert.True(t, ok) {
+		inner := e.Err.(*errors.Error).Err.(*LimitError)
+		assert.Equal(t, 100*time.Millisecond, inner.RetryAfter())
+	}
+
+	// Health checks are not limited.
+	assert.NoError(t, src.Check(ctx))
+
+	// The rejected call gave its reservation back.
+	now = now.Add(100 * time.Millisecond)
+	_, err = src.Generate(ctx, 1)
+	assert.NoError(t, err)
+}
+
+func TestWithRateLimit_tokens(t *testing.T) {
+	now := time.Now()
+	src := newTestLimiter(&RateLimit{Tokens: 1000, TokenBurst: 100, MaxWait: 20 * time.Millisecond}, &now)
+	ctx := context.Background()
+
+	_, err := src.Generate(ctx, 100)
+	assert.NoError(t, err)
+
+	// Ten more tokens are due in 10ms: the call queues, then succeeds.
+	start := time.Now()
+	_, err = src.Generate(ctx, 10)
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) >= 10*time.Millisecond)
+
+	// A batch larger than the burst would wait for the bucket to refill
+	// longer than MaxWait, so it fails right away.
+	_, err = src.Generate(ctx, 500)
+	assert.True(t, errors.Is(errors.Transient, err))
+}
+
+func TestWithRateLimit_cancel(t *testing.T) {
+	now := time.Now()
+	src := newTestLimiter(&RateLimit{Requests: 1, RequestBurst: 1, MaxWait: time.Minute}, &now)
+
+	_, err := src.Generate(context.Background(), 1)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = src.Generate(ctx, 1)
+	assert.True(t, errors.Is(errors.Transient, err))
+}
@@ -0,0 +1,187 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mock implements a fake Token source speaking the same
+// POST /?size=N protocol as the upstream generator, with knobs to inject
+// the failures the Ledger has to cope with.
+package mock
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/ledger"
+	"github.com/danielnegri/tokenapi-go/log"
+)
+
+const (
+	DefaultPort = 8081
+
+	// DefaultLimit is the largest number of tokens the upstream returns
+	// for a single request.
+	DefaultLimit = 455_902
+
+	charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_"
+)
+
+// Config holds the behavior of the fake Token source. Rates are fractions
+// between 0 and 1.
+type Config struct {
+	// Latency is added before every response.
+	Latency time.Duration
+
+	// ErrorRate is the share of requests answered with 500.
+	ErrorRate float64
+
+	// DashRate is the share of tokens that contain a dash.
+	DashRate float64
+
+	// DuplicateRate is the share of tokens that repeat an earlier token of
+	// the same response.
+	DuplicateRate float64
+
+	// TruncateRate is the share of responses whose body is cut off before
+	// the connection is dropped.
+	TruncateRate float64
+
+	// Limit caps the number of tokens per response. The default is
+	// DefaultLimit.
+	Limit int
+
+	// Seed makes the generated tokens and injected failures reproducible.
+	Seed int64
+}
+
+type handler struct {
+	cfg Config
+
+	mu     sync.Mutex
+	random *rand.Rand
+}
+
+// NewHandler returns an http.Handler that behaves like the upstream
+// Token source.
+func NewHandler(cfg *Config) http.Handler {
+	var c Config
+	if cfg != nil {
+		c = *cfg
+	}
+
+	if c.Limit == 0 {
+		c.Limit = DefaultLimit
+	}
+
+	return &handler{
+		cfg:    c,
+		random: rand.New(rand.NewSource(c.Seed)),
+	}
+}
+
+func (h *handler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	// The upstream labels its plain-text output as HTML.
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if req.Method != http.MethodPost || req.URL.Path != "/" {
+		http.NotFound(res, req)
+		return
+	}
+
+	if h.cfg.Latency > 0 {
+		select {
+		case <-time.After(h.cfg.Latency):
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	if h.chance(h.cfg.ErrorRate) {
+		log.Debugf("mock source: injecting error for %s", req.URL)
+		http.Error(res, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Like the upstream, a size that is not an integer yields an empty 200.
+	size, err := strconv.Atoi(req.URL.Query().Get("size"))
+	if err != nil || size < 0 {
+		size = 0
+	}
+
+	if size > h.cfg.Limit {
+		size = h.cfg.Limit
+	}
+
+	body := h.generate(size)
+	if size > 0 && h.chance(h.cfg.TruncateRate) {
+		log.Debugf("mock source: truncating response for %s", req.URL)
+		res.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		res.WriteHeader(http.StatusOK)
+		res.Write([]byte(body[:h.intn(len(body))]))
+		panic(http.ErrAbortHandler)
+	}
+
+	res.WriteHeader(http.StatusOK)
+	res.Write([]byte(body))
+}
+
+func (h *handler) generate(n int) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var b strings.Builder
+	b.Grow(n * (ledger.TokenLength + 1))
+
+	tokens := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		var token string
+		if len(tokens) > 0 && h.random.Float64() < h.cfg.DuplicateRate {
+			token = tokens[h.random.Intn(len(tokens))]
+		} else {
+			buf := make([]byte, ledger.TokenLength)
+			for j := range buf {
+				buf[j] = charset[h.random.Intn(len(charset))]
+			}
+
+			if h.random.Float64() < h.cfg.DashRate {
+				buf[h.random.Intn(len(buf))] = '-'
+			}
+			token = string(buf)
+		}
+
+		tokens = append(tokens, token)
+		b.WriteString(token)
+		b.WriteByte('\n')
+	}
+
+	return b.String()
+}
+
+func (h *handler) chance(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.random.Float64() < rate
+}
+
+func (h *handler) intn(n int) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.random.Intn(n)
+}
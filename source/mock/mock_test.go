@@ -0,0 +1,94 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mock
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/retry"
+	"github.com/danielnegri/tokenapi-go/source"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSource(t *testing.T, cfg *Config) (source.Source, func()) {
+	ts := httptest.NewServer(NewHandler(cfg))
+	srcURL, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := source.New(&source.Config{
+		URL:     srcURL,
+		Retry:   &retry.Policy{MaxAttempts: 1},
+		Timeout: time.Second,
+	})
+	return src, ts.Close
+}
+
+func TestHandler(t *testing.T) {
+	src, stop := newTestSource(t, &Config{Seed: 1})
+	defer stop()
+
+	ctx := context.Background()
+	assert.NoError(t, src.Check(ctx))
+
+	batch, err := src.Generate(ctx, 100)
+	assert.NoError(t, err)
+	assert.Len(t, batch.Tokens, 100)
+}
+
+func TestHandler_failures(t *testing.T) {
+	ctx := context.Background()
+
+	src, stop := newTestSource(t, &Config{ErrorRate: 1})
+	_, err := src.Generate(ctx, 1)
+	assert.True(t, errors.Is(errors.Internal, err))
+	stop()
+
+	src, stop = newTestSource(t, &Config{TruncateRate: 1})
+	_, err = src.Generate(ctx, 10)
+	assert.True(t, errors.Is(errors.Internal, err))
+	stop()
+
+	src, stop = newTestSource(t, &Config{DashRate: 1})
+	batch, err := src.Generate(ctx, 10)
+	assert.NoError(t, err)
+	for _, token := range batch.Tokens {
+		assert.True(t, strings.Contains(string(token), "-"))
+	}
+	stop()
+
+	src, stop = newTestSource(t, &Config{DuplicateRate: 0.5, Seed: 1})
+	batch, err = src.Generate(ctx, 100)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, batch.Report.Rejected)
+	assert.Equal(t, 100, batch.Report.Lines)
+	stop()
+}
+
+func TestHandler_limit(t *testing.T) {
+	src, stop := newTestSource(t, &Config{Limit: 3})
+	defer stop()
+
+	batch, err := src.Generate(context.Background(), 10)
+	assert.NoError(t, err)
+	assert.Len(t, batch.Tokens, 3)
+}
@@ -0,0 +1,130 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"sync"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/ledger"
+)
+
+// seededCharset is the alphabet of generated tokens. The dash is left out
+// so that dashes only appear where they are injected.
+const seededCharset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_"
+
+// seededHistory bounds how many earlier tokens a seeded Source remembers
+// to pick repeats from.
+const seededHistory = 1024
+
+// SeededConfig configures a seeded Source. Rates are fractions between 0
+// and 1.
+type SeededConfig struct {
+	Seed int64
+
+	// DashRate is the share of tokens that contain a dash, which the
+	// storage rejects as invalid.
+	DashRate float64
+
+	// RepeatRate is the share of tokens that repeat a token generated
+	// earlier in the sequence. Repeats within a batch are rejected in its
+	// Report, like upstream duplicates; the storage rejects the others.
+	RepeatRate float64
+}
+
+type seeded struct {
+	cfg SeededConfig
+
+	mu      sync.Mutex
+	random  *rand.Rand
+	history []ledger.Token
+}
+
+var _ Source = (*seeded)(nil)
+
+// NewSeeded returns a Source that needs no network and produces the same
+// sequence of tokens for the same configuration. The sequence continues
+// across Generate calls, so a workload replays identically as long as it
+// requests the same batch sizes in the same order.
+func NewSeeded(cfg *SeededConfig) Source {
+	var c SeededConfig
+	if cfg != nil {
+		c = *cfg
+	}
+
+	return &seeded{
+		cfg:    c,
+		random: rand.New(rand.NewSource(c.Seed)),
+	}
+}
+
+func (s *seeded) Check(ctx context.Context) error {
+	return nil
+}
+
+func (s *seeded) Generate(ctx context.Context, n int) (*Batch, error) {
+	const op errors.Op = "source/seeded.Generate"
+	if n <= 0 {
+		return nil, errors.E(op, errors.Invalid, "number of tokens must be greater than zero")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, errors.E(op, errors.Internal, err)
+	}
+
+	s.mu.Lock()
+	var body strings.Builder
+	for i := 0; i < n; i++ {
+		body.WriteString(string(s.next()))
+		body.WriteByte('\n')
+	}
+	s.mu.Unlock()
+
+	// The batch goes through the validation of upstream responses, so
+	// that tokens repeated within it are reported as they would be.
+	batch, err := Parse("text/plain", []byte(body.String()))
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	return batch, nil
+}
+
+// next returns the next token of the sequence. s.mu must be held.
+func (s *seeded) next() ledger.Token {
+	if len(s.history) > 0 && s.random.Float64() < s.cfg.RepeatRate {
+		return s.history[s.random.Intn(len(s.history))]
+	}
+
+	b := make([]byte, ledger.TokenLength)
+	for i := range b {
+		b[i] = seededCharset[s.random.Intn(len(seededCharset))]
+	}
+
+	if s.random.Float64() < s.cfg.DashRate {
+		b[s.random.Intn(len(b))] = '-'
+	}
+
+	token := ledger.Token(b)
+	if len(s.history) < seededHistory {
+		s.history = append(s.history, token)
+	} else {
+		s.history[s.random.Intn(seededHistory)] = token
+	}
+
+	return token
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/ledger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSeeded(t *testing.T) {
+	ctx := context.Background()
+	cfg := &SeededConfig{Seed: 42, DashRate: 0.2, RepeatRate: 0.2}
+
+	// The same sequence comes out of sources with the same configuration.
+	a, b := NewSeeded(cfg), NewSeeded(cfg)
+	var first, second []ledger.Token
+	for _, n := range []int{1, 499, 500} {
+		batch, err := a.Generate(ctx, n)
+		assert.NoError(t, err)
+		first = append(first, batch.Tokens...)
+
+		batch, err = b.Generate(ctx, n)
+		assert.NoError(t, err)
+		second = append(second, batch.Tokens...)
+	}
+	assert.Equal(t, first, second)
+
+	// Tokens repeated within a batch are reported as upstream duplicates
+	// are; the others reach the storage.
+	batch, err := NewSeeded(cfg).Generate(ctx, 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, batch.Report.Lines)
+	assert.Equal(t, len(batch.Tokens), batch.Report.Accepted)
+	assert.Equal(t, 1000, batch.Report.Accepted+len(batch.Report.Rejected))
+	assert.InDelta(t, 200, len(batch.Report.Rejected), 60)
+
+	dashes, seen := 0, make(map[ledger.Token]bool)
+	for _, token := range batch.Tokens {
+		assert.Len(t, token, ledger.TokenLength)
+		assert.False(t, seen[token])
+		if strings.Contains(string(token), "-") {
+			dashes++
+		}
+		seen[token] = true
+	}
+	for _, r := range batch.Report.Rejected {
+		assert.Equal(t, ReasonDuplicate, r.Reason)
+	}
+	assert.InDelta(t, 160, dashes, 60)
+
+	other, err := NewSeeded(&SeededConfig{Seed: 43}).Generate(ctx, 10)
+	assert.NoError(t, err)
+	assert.NotEqual(t, first[:10], other.Tokens)
+
+	_, err = a.Generate(ctx, 0)
+	assert.True(t, errors.Is(errors.Invalid, err))
+}
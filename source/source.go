@@ -20,17 +20,21 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/danielnegri/tokenapi-go/errors"
-	"github.com/danielnegri/tokenapi-go/ledger"
 	"github.com/danielnegri/tokenapi-go/log"
+	"github.com/danielnegri/tokenapi-go/retry"
+	"github.com/danielnegri/tokenapi-go/tracing"
 	"github.com/danielnegri/tokenapi-go/version"
 	"github.com/go-resty/resty/v2"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/instrumentation/othttp"
 )
 
 const (
+	// DefaultRetry is the default number of retries after a failed request.
 	DefaultRetry   = 5
 	DefaultTimeout = 20 * time.Second
 	DefaultURL     = "https://us-east4-at-devops-inhouse.cloudfunctions.net/be-interview-env-datasource-0e709f7f"
@@ -40,21 +44,43 @@ var userAgent = fmt.Sprintf("AdhereTech/Ledger Go HTTP Client %s", version.Versi
 
 type Source interface {
 	Check(ctx context.Context) error
-	Generate(ctx context.Context, n int) ([]ledger.Token, error)
+	Generate(ctx context.Context, n int) (*Batch, error)
 }
 
 var _ Source = (*client)(nil)
 
 type client struct {
 	httpClient *resty.Client
+	transport  http.RoundTripper
+	retry      *retry.Policy
 	trace      bool
 }
 
 type Config struct {
-	Retry   int
+	// Retry is the policy applied to failed requests. Only transport errors
+	// and the policy's status codes are retried. The default allows
+	// DefaultRetry retries.
+	Retry   *retry.Policy
 	Timeout time.Duration
 	URL     *url.URL
 
+	// Mode selects how requests reach the Token source: ModeLive (the
+	// default), ModeRecord or ModeReplay. Fixture is the file exchanges
+	// are recorded to or replayed from.
+	Mode    string
+	Fixture string
+
+	// Auth configures how requests are authenticated. Nil sends them
+	// without credentials.
+	Auth *AuthConfig
+
+	// RateLimit limits the rate of calls made through the Source returned
+	// by WithRateLimit. Nil disables it.
+	RateLimit *RateLimit
+
+	// Trace records the latency breakdown of each upstream attempt, Check
+	// and retries included, exports it as metrics and attaches that of the
+	// attempt that returned a Batch to it.
 	Trace bool
 }
 
@@ -63,8 +89,11 @@ func New(cfg *Config) *client {
 		cfg = &Config{}
 	}
 
-	if cfg.Retry == 0 {
-		cfg.Retry = DefaultRetry
+	if cfg.Retry == nil {
+		cfg.Retry = &retry.Policy{
+			MaxAttempts: DefaultRetry + 1,
+			Jitter:      retry.DefaultJitter,
+		}
 	}
 
 	if cfg.Timeout == 0 {
@@ -82,73 +111,193 @@ func New(cfg *Config) *client {
 
 	httpClient := resty.New().
 		SetHostURL(cfg.URL.String()).
+		SetHeader("User-Agent", userAgent).
 		SetLogger(log.Logger()).
-		SetRetryCount(cfg.Retry).
 		SetTimeout(cfg.Timeout)
 
+	// The transports set below wrap this one, which holds the connections.
+	transport := httpClient.GetClient().Transport
+
+	if cfg.Auth != nil {
+		tlsConfig, err := cfg.Auth.tlsConfig(cfg.URL.Hostname())
+		if err != nil {
+			log.Errorf("failed to configure token source TLS: %v", err)
+			httpClient.SetTransport(failingTransport{err: err})
+		} else {
+			if tlsConfig != nil {
+				httpClient.SetTLSClientConfig(tlsConfig)
+			}
+			httpClient.SetTransport(newAuthTransport(httpClient.GetClient().Transport, cfg.Auth))
+		}
+	}
+
+	switch cfg.Mode {
+	case ModeRecord:
+		httpClient.SetTransport(newRecorder(httpClient.GetClient().Transport, cfg.Fixture))
+	case ModeReplay:
+		httpClient.SetTransport(newReplayer(cfg.Fixture))
+	}
+
+	// The span of each attempt propagates the trace to the Token source.
+	httpClient.SetTransport(othttp.NewTransport(httpClient.GetClient().Transport,
+		othttp.WithTracer(tracing.Tracer()),
+		othttp.WithSpanNameFormatter(func(string, *http.Request) string { return "source.request" }),
+	))
+
 	return &client{
 		httpClient: httpClient,
+		transport:  transport,
+		retry:      cfg.Retry,
 		trace:      cfg.Trace,
 	}
 }
 
+// Close closes the idle connections to the Token source. Requests in
+// flight are not interrupted.
+func (c *client) Close() error {
+	if t, ok := c.transport.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+	return nil
+}
+
 func (c *client) Check(ctx context.Context) error {
-	log.Debugf("Checking Token source at %s", c.httpClient.HostURL)
+	logger := log.FromContext(ctx)
+	logger.Debugf("Checking Token source at %s", c.httpClient.HostURL)
 
 	const op errors.Op = "source/client.Check"
-	var apiErr interface{}
-	resp, err := c.newRequest(ctx).SetError(&apiErr).SetQueryParam("size", "0").Post("/")
+	resp, _, err := c.post(ctx, 0)
 	if err != nil {
-		log.Errorf("failed to request health check: %v", err)
-		return errors.E(op, errors.Internal, err)
+		logger.Errorf("failed to request health check: %v", err)
+		return errors.E(op, ctx, errors.Internal, err)
 	}
 
 	if resp.StatusCode() != http.StatusOK {
-		log.Errorf("health check failed: status=%d, body=%s, error=%v", resp.StatusCode(), string(resp.Body()), apiErr)
-		return errors.E(op, errors.Internal)
+		logger.Errorf("health check failed: status=%d, body=%s, error=%v", resp.StatusCode(), string(resp.Body()), resp.Error())
+		return errors.E(op, ctx, errors.Internal)
 	}
 
 	return nil
 }
 
-func (c *client) Generate(ctx context.Context, n int) ([]ledger.Token, error) {
-	log.Debugf("Generating %d tokens", n)
+func (c *client) Generate(ctx context.Context, n int) (*Batch, error) {
+	logger := log.FromContext(ctx)
+	logger.Debugf("Generating %d tokens", n)
 
 	const op errors.Op = "source/client.Generate"
 	if n <= 0 {
-		return nil, errors.E(op, errors.Invalid, "number of tokens must be greater than zero")
+		return nil, errors.E(op, ctx, errors.Invalid, "number of tokens must be greater than zero")
 	}
 
-	var apiErr interface{}
-	resp, err := c.newRequest(ctx).
-		SetError(&apiErr).
-		SetQueryParam("size", strconv.Itoa(n)).Post("/")
+	ctx, span := tracing.Tracer().Start(ctx, "source.Generate", trace.WithAttributes(kv.Int("tokens.requested", n)))
+	defer span.End()
+
+	resp, tr, err := c.post(ctx, n)
 	if err != nil {
-		log.Errorf("failed to request new tokens: %v", err)
-		return nil, errors.E(op, errors.Internal, err)
+		logger.Errorf("failed to request new tokens: %v", err)
+		return nil, errors.E(op, ctx, errors.Internal, err)
 	}
 
 	if resp.StatusCode() != http.StatusOK {
-		log.Errorf("request new tokens failed: status=%d, body=%s, error=%v", resp.StatusCode(), string(resp.Body()), apiErr)
-		return nil, errors.E(op, errors.Internal)
+		logger.Errorf("request new tokens failed: status=%d, body=%s, error=%v", resp.StatusCode(), string(resp.Body()), resp.Error())
+		return nil, errors.E(op, ctx, errors.Internal)
 	}
 
-	tokens := make([]ledger.Token, 0)
-	for _, line := range strings.Split(string(resp.Body()), "\n") {
-		if line != "" {
-			token := ledger.Token(line)
-			tokens = append(tokens, token)
-		}
+	batch, err := Parse(resp.Header().Get("Content-Type"), resp.Body())
+	if err != nil {
+		logger.Errorf("invalid response from token source: %v", err)
+		return nil, errors.E(op, ctx, err)
+	}
+
+	if rejected := len(batch.Report.Rejected); rejected > 0 {
+		logger.WithField("lines", batch.Report.Lines).
+			WithField("accepted", batch.Report.Accepted).
+			WithField("rejected", batch.Report.Rejected).
+			Warnf("Dropped %d invalid lines from token source", rejected)
 	}
 
-	return tokens, nil
+	span.SetAttributes(
+		kv.Int("tokens.accepted", batch.Report.Accepted),
+		kv.Int("tokens.rejected", len(batch.Report.Rejected)),
+	)
+
+	if len(batch.Tokens) == 0 {
+		return nil, errors.E(op, ctx, errors.Internal, "no valid tokens in response")
+	}
+
+	batch.Trace = tr
+	return batch, nil
 }
 
-func (c *client) newRequest(ctx context.Context) *resty.Request {
-	req := c.httpClient.R()
-	if c.trace {
-		req = req.EnableTrace()
+// post asks the Token source for size tokens, retrying transport errors and
+// retryable status codes according to the client's policy. A response with
+// any other status is returned without error for the caller to inspect.
+//
+// When the client traces its requests, every attempt is traced, recorded in
+// the source phase histogram and logged; the trace of the last attempt is
+// returned.
+func (c *client) post(ctx context.Context, size int) (*resty.Response, *Trace, error) {
+	var (
+		resp    *resty.Response
+		last    *Trace
+		attempt int
+	)
+	err := c.retry.Do(ctx, func(ctx context.Context) error {
+		attempt++
+		var t *tracer
+		if c.trace {
+			t = newTracer()
+			ctx = t.context(ctx)
+		}
+
+		var apiErr interface{}
+		r, err := c.newRequest(ctx).
+			SetError(&apiErr).
+			SetQueryParam("size", strconv.Itoa(size)).
+			Post("/")
+		if t != nil {
+			last = t.finish(attempt)
+			last.observe()
+			entry := log.FromContext(ctx).WithFields(last.Fields())
+			if err != nil {
+				entry.Debugf("Token source attempt %d failed: %v", attempt, err)
+			} else {
+				entry.Debugf("Token source attempt %d responded with status %d", attempt, r.StatusCode())
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		resp = r
+		if c.retry.RetryStatusCode(r.StatusCode()) {
+			log.FromContext(ctx).Warnf("token source responded with status %d, retrying", r.StatusCode())
+			return &statusError{code: r.StatusCode()}
+		}
+		return nil
+	}, func(error) bool {
+		return ctx.Err() == nil
+	})
+
+	if _, ok := err.(*statusError); ok {
+		return resp, last, nil
 	}
+	return resp, last, err
+}
 
+func (c *client) newRequest(ctx context.Context) *resty.Request {
+	req := c.httpClient.R().SetContext(ctx)
+	if id := log.RequestID(ctx); id != "" {
+		req = req.SetHeader("X-Request-Id", id)
+	}
 	return req
 }
+
+// statusError marks a response whose status code the retry policy retries.
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d", e.code)
+}
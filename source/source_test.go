@@ -16,10 +16,14 @@ package source
 
 import (
 	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -28,7 +32,7 @@ func TestNew(t *testing.T) {
 	assert.NotNil(t, src)
 	assert.NotNil(t, src.httpClient)
 	assert.Equal(t, src.httpClient.HostURL, DefaultURL)
-	assert.Equal(t, src.httpClient.RetryCount, DefaultRetry)
+	assert.Equal(t, src.retry.Attempts(), DefaultRetry+1)
 	assert.Equal(t, src.httpClient.GetClient().Timeout, DefaultTimeout)
 }
 
@@ -42,3 +46,35 @@ func Test_client_Check(t *testing.T) {
 	assert.Error(t, err)
 	assert.True(t, errors.Is(errors.Internal, err))
 }
+
+func Test_client_retry(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			res.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			res.Header().Set("Content-Type", gin.MIMEPlain)
+			res.Write([]byte("xPGvwdBqDrpFLXyMVf0ovQ\n"))
+		}
+	}))
+	defer ts.Close()
+
+	batch, err := newTestSource(t, ts.URL).Generate(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Len(t, batch.Tokens, 1)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func Test_client_noRetry(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		res.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	_, err := newTestSource(t, ts.URL).Generate(context.Background(), 1)
+	assert.True(t, errors.Is(errors.Internal, err))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
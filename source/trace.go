@@ -0,0 +1,181 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// Trace is the latency breakdown of a request sent to the Token source.
+// Phases the transport skipped, such as DNS and TLS on a reused connection
+// or everything after a failed dial, are zero.
+type Trace struct {
+	// Attempt is the number of the traced attempt, starting at 1. The
+	// trace of a batch is that of the attempt that returned it.
+	Attempt int
+
+	DNSLookup    time.Duration
+	Connect      time.Duration
+	TLSHandshake time.Duration
+
+	// ServerTime is the time from sending the request to the first byte
+	// of the response, which is mostly spent generating tokens.
+	ServerTime time.Duration
+
+	// ResponseTime is the time spent reading the response body.
+	ResponseTime time.Duration
+
+	Total      time.Duration
+	ConnReused bool
+}
+
+// tracer records the timestamps of one attempt through httptrace. The
+// hooks may run on transport goroutines, so every field is guarded by mu.
+type tracer struct {
+	mu sync.Mutex
+
+	start, end                time.Time
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	wroteRequest, firstByte   time.Time
+	reused                    bool
+}
+
+func newTracer() *tracer {
+	return &tracer{start: time.Now()}
+}
+
+// mark sets *ts to the current time unless it is already set, so a phase
+// that happens more than once, such as a dial racing IPv4 and IPv6, is
+// measured from its first start to its first end.
+func (t *tracer) mark(ts *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ts.IsZero() {
+		*ts = time.Now()
+	}
+}
+
+// context returns ctx with the hooks of t attached.
+func (t *tracer) context(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { t.mark(&t.dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { t.mark(&t.dnsDone) },
+		ConnectStart:      func(string, string) { t.mark(&t.connectStart) },
+		ConnectDone:       func(string, string, error) { t.mark(&t.connectDone) },
+		TLSHandshakeStart: func() { t.mark(&t.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { t.mark(&t.tlsDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.reused = info.Reused
+			t.mu.Unlock()
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.mark(&t.wroteRequest) },
+		GotFirstResponseByte: func() { t.mark(&t.firstByte) },
+	})
+}
+
+// finish ends the attempt and returns its trace.
+func (t *tracer) finish(attempt int) *Trace {
+	t.mark(&t.end)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return &Trace{
+		Attempt:      attempt,
+		DNSLookup:    between(t.dnsStart, t.dnsDone),
+		Connect:      between(t.connectStart, t.connectDone),
+		TLSHandshake: between(t.tlsStart, t.tlsDone),
+		ServerTime:   between(t.wroteRequest, t.firstByte),
+		ResponseTime: between(t.firstByte, t.end),
+		Total:        between(t.start, t.end),
+		ConnReused:   t.reused,
+	}
+}
+
+// between returns the time from start to end, or zero when either did not
+// happen.
+func between(start, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+type phase struct {
+	name string
+	d    time.Duration
+}
+
+// phases returns the phases of t under their metric and header names.
+func (t *Trace) phases() []phase {
+	return []phase{
+		{"dns", t.DNSLookup},
+		{"connect", t.Connect},
+		{"tls", t.TLSHandshake},
+		{"server", t.ServerTime},
+		{"response", t.ResponseTime},
+		{"total", t.Total},
+	}
+}
+
+// Fields returns t as structured log fields.
+func (t *Trace) Fields() logrus.Fields {
+	fields := logrus.Fields{"attempt": t.Attempt, "conn_reused": t.ConnReused}
+	for _, p := range t.phases() {
+		fields[p.name] = p.d
+	}
+	return fields
+}
+
+// Milliseconds returns the phases of t in milliseconds, keyed by name.
+func (t *Trace) Milliseconds() map[string]float64 {
+	ms := make(map[string]float64)
+	for _, p := range t.phases() {
+		ms[p.name] = float64(p.d) / float64(time.Millisecond)
+	}
+	return ms
+}
+
+// ServerTiming formats t as the value of a Server-Timing header, with each
+// phase prefixed by "source-".
+func (t *Trace) ServerTiming() string {
+	phases := t.phases()
+	parts := make([]string, len(phases))
+	for i, p := range phases {
+		parts[i] = fmt.Sprintf("source-%s;dur=%.3f", p.name, float64(p.d)/float64(time.Millisecond))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// observe records t in the source phase histogram. Phases that did not
+// happen are left out so they do not drag the distribution towards zero.
+func (t *Trace) observe() {
+	for _, p := range t.phases() {
+		if p.d > 0 {
+			metrics.SourcePhaseSeconds.WithLabelValues(p.name).Observe(p.d.Seconds())
+		}
+	}
+}
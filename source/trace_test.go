@@ -0,0 +1,121 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/metrics"
+	"github.com/danielnegri/tokenapi-go/retry"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// phaseCount returns the number of observations of phase.
+func phaseCount(t *testing.T, phase string) uint64 {
+	var m dto.Metric
+	if err := metrics.SourcePhaseSeconds.WithLabelValues(phase).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestClient_trace(t *testing.T) {
+	ts := newTestServer(t, 1)
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	before := phaseCount(t, "total")
+
+	src := New(&Config{URL: u, Trace: true})
+	batch, err := src.Generate(context.Background(), 10)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	if assert.NotNil(t, batch.Trace) {
+		assert.True(t, batch.Trace.Total > 0)
+		assert.True(t, batch.Trace.ServerTime > 0)
+		assert.True(t, batch.Trace.Total >= batch.Trace.ServerTime)
+	}
+	assert.Equal(t, before+1, phaseCount(t, "total"))
+
+	// Tracing is off by default.
+	batch, err = newTestSource(t, ts.URL).Generate(context.Background(), 10)
+	if assert.NoError(t, err) {
+		assert.Nil(t, batch.Trace)
+	}
+}
+
+func TestClient_traceAttempts(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			res.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		res.Header().Set("Content-Type", gin.MIMEPlain)
+		res.Write([]byte("xPGvwdBqDrpFLXyMVf0ovQ\n"))
+	}))
+	defer ts.Close()
+
+	newSource := func(rawurl string) Source {
+		u, _ := url.Parse(rawurl)
+		return New(&Config{
+			URL:   u,
+			Retry: &retry.Policy{MaxAttempts: 2, BaseBackoff: time.Millisecond},
+			Trace: true,
+		})
+	}
+
+	// The retried attempt is traced as well as the one that returned
+	// the batch.
+	before := phaseCount(t, "total")
+	batch, err := newSource(ts.URL).Generate(context.Background(), 1)
+	if assert.NoError(t, err) && assert.NotNil(t, batch.Trace) {
+		assert.Equal(t, 2, batch.Trace.Attempt)
+	}
+	assert.Equal(t, before+2, phaseCount(t, "total"))
+
+	before = phaseCount(t, "total")
+	assert.NoError(t, newSource(ts.URL).Check(context.Background()))
+	assert.Equal(t, before+1, phaseCount(t, "total"))
+
+	// Attempts that fail to connect are traced too.
+	before = phaseCount(t, "total")
+	assert.Error(t, newSource(discardURL).Check(context.Background()))
+	assert.Equal(t, before+2, phaseCount(t, "total"))
+}
+
+func TestTrace_ServerTiming(t *testing.T) {
+	tr := &Trace{
+		Connect:    1500 * time.Microsecond,
+		ServerTime: 20 * time.Millisecond,
+		Total:      25 * time.Millisecond,
+	}
+
+	assert.Equal(t,
+		"source-dns;dur=0.000, source-connect;dur=1.500, source-tls;dur=0.000, "+
+			"source-server;dur=20.000, source-response;dur=0.000, source-total;dur=25.000",
+		tr.ServerTiming())
+}
@@ -0,0 +1,150 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"bytes"
+	"mime"
+	"strings"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/ledger"
+)
+
+// Reasons a line returned by the Token source is rejected.
+const (
+	ReasonLength    = "invalid length"
+	ReasonCharacter = "invalid character"
+	ReasonDuplicate = "duplicate in batch"
+)
+
+// maxRejectedValue bounds how much of a rejected line is kept in a Report,
+// so an HTML page or a runaway line does not end up in the logs verbatim.
+const maxRejectedValue = 64
+
+// Rejection describes a line of a Generate response that was dropped.
+// Line is 1-based.
+type Rejection struct {
+	Line   int    `json:"line"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+// Report summarizes how the lines of a Generate response were handled.
+type Report struct {
+	Lines    int         `json:"lines"`
+	Accepted int         `json:"accepted"`
+	Rejected []Rejection `json:"rejected,omitempty"`
+}
+
+// Batch is the result of a Generate call: the tokens that passed
+// validation and the report of the lines that did not.
+type Batch struct {
+	Tokens []ledger.Token
+	Report Report
+
+	// Trace is the latency breakdown of the upstream attempt that returned
+	// the batch, set when the Source traces its requests.
+	Trace *Trace
+}
+
+// Parse validates a Generate response body and returns the tokens it
+// contains. Line endings and surrounding whitespace are trimmed, blank
+// lines are skipped, and lines that are not well-formed tokens or that
+// repeat an earlier line are recorded in the batch Report.
+//
+// The upstream labels its plain-text output as text/html, so both media
+// types are accepted; a body that is an HTML document is not.
+func Parse(contentType string, body []byte) (*Batch, error) {
+	const op errors.Op = "source.Parse"
+
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, errors.E(op, errors.Internal, err)
+		}
+
+		if mediaType != "text/plain" && mediaType != "text/html" {
+			return nil, errors.E(op, errors.Internal, errors.Errorf("unexpected content type %q", mediaType))
+		}
+	}
+
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '<' {
+		return nil, errors.E(op, errors.Internal, "response is an HTML document")
+	}
+
+	batch := &Batch{Tokens: make([]ledger.Token, 0)}
+	seen := make(map[string]struct{})
+	for i, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		batch.Report.Lines++
+		reason := checkToken(line)
+		if reason == "" {
+			if _, ok := seen[line]; ok {
+				reason = ReasonDuplicate
+			}
+		}
+
+		if reason != "" {
+			batch.Report.Rejected = append(batch.Report.Rejected, Rejection{
+				Line:   i + 1,
+				Value:  truncate(line, maxRejectedValue),
+				Reason: reason,
+			})
+			continue
+		}
+
+		seen[line] = struct{}{}
+		batch.Tokens = append(batch.Tokens, ledger.Token(line))
+	}
+
+	batch.Report.Accepted = len(batch.Tokens)
+	return batch, nil
+}
+
+// checkToken returns why line is not a well-formed token, or the empty
+// string if it is. Tokens use the URL-safe base64 alphabet; dashes are
+// allowed here and rejected by the storage.
+func checkToken(line string) string {
+	if len(line) != ledger.TokenLength {
+		return ReasonLength
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case 'a' <= c && c <= 'z':
+		case 'A' <= c && c <= 'Z':
+		case '0' <= c && c <= '9':
+		case c == '-' || c == '_':
+		default:
+			return ReasonCharacter
+		}
+	}
+
+	return ""
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	return s[:n] + "..."
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/ledger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	body := "xPGvwdBqDrpFLXyMVf0ovQ\r\n" +
+		"  3oMUY0bSsieok9GKuSQKpQ \n" +
+		"\n" +
+		"_-kFu9fparYLZtyNBDH9vg\n" +
+		"short\n" +
+		"xPGvwdBqDrpFLXyMVf0o!Q\n" +
+		"xPGvwdBqDrpFLXyMVf0ovQ\n"
+
+	batch, err := Parse("text/html; charset=utf-8", []byte(body))
+	assert.NoError(t, err)
+	assert.Equal(t, []ledger.Token{
+		"xPGvwdBqDrpFLXyMVf0ovQ",
+		"3oMUY0bSsieok9GKuSQKpQ",
+		"_-kFu9fparYLZtyNBDH9vg",
+	}, batch.Tokens)
+	assert.Equal(t, Report{
+		Lines:    6,
+		Accepted: 3,
+		Rejected: []Rejection{
+			{Line: 5, Value: "short", Reason: ReasonLength},
+			{Line: 6, Value: "xPGvwdBqDrpFLXyMVf0o!Q", Reason: ReasonCharacter},
+			{Line: 7, Value: "xPGvwdBqDrpFLXyMVf0ovQ", Reason: ReasonDuplicate},
+		},
+	}, batch.Report)
+}
+
+func TestParse_invalidResponse(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{name: "json", contentType: "application/json", body: `{"tokens":[]}`},
+		{name: "malformed content type", contentType: "text/", body: "xPGvwdBqDrpFLXyMVf0ovQ\n"},
+		{name: "html page", contentType: "text/html", body: "\n<!DOCTYPE html>\n<html><body>Error</body></html>"},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.contentType, []byte(test.body))
+		if assert.Error(t, err, test.name) {
+			assert.True(t, errors.Is(errors.Internal, err), test.name)
+		}
+	}
+}
+
+func Test_client_Generate(t *testing.T) {
+	ts := newTestServer(t, time.Now().Unix())
+	defer ts.Close()
+
+	batch, err := newTestSource(t, ts.URL).Generate(context.Background(), 10)
+	assert.NoError(t, err)
+	assert.Len(t, batch.Tokens, 10)
+	assert.Equal(t, 10, batch.Report.Accepted)
+	assert.Empty(t, batch.Report.Rejected)
+
+	_, err = newTestSource(t, ts.URL).Generate(context.Background(), 0)
+	assert.True(t, errors.Is(errors.Invalid, err))
+}
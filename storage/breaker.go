@@ -0,0 +1,74 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+
+	"github.com/danielnegri/tokenapi-go/breaker"
+	"github.com/danielnegri/tokenapi-go/ledger"
+)
+
+type breakerStorage struct {
+	storage Storage
+	breaker *breaker.Breaker
+}
+
+// WithBreaker returns a Storage that sends every call to s through the
+// given circuit breaker.
+func WithBreaker(s Storage, b *breaker.Breaker) Storage {
+	return &breakerStorage{storage: s, breaker: b}
+}
+
+func (s *breakerStorage) Check(ctx context.Context) error {
+	return s.breaker.Do(ctx, s.storage.Check)
+}
+
+func (s *breakerStorage) Insert(ctx context.Context, token ledger.Token) error {
+	return s.breaker.Do(ctx, func(ctx context.Context) error {
+		return s.storage.Insert(ctx, token)
+	})
+}
+
+type breakerRegistry struct {
+	registry ledger.Registry
+	breaker  *breaker.Breaker
+}
+
+// RegistryWithBreaker returns a Registry that sends every call to r through
+// the given circuit breaker.
+func RegistryWithBreaker(r ledger.Registry, b *breaker.Breaker) ledger.Registry {
+	return &breakerRegistry{registry: r, breaker: b}
+}
+
+func (r *breakerRegistry) Lookup(ctx context.Context, token ledger.Token) (*ledger.Record, error) {
+	var record *ledger.Record
+	err := r.breaker.Do(ctx, func(ctx context.Context) error {
+		var err error
+		record, err = r.registry.Lookup(ctx, token)
+		return err
+	})
+	return record, err
+}
+
+func (r *breakerRegistry) Revoke(ctx context.Context, token ledger.Token) (*ledger.Record, error) {
+	var record *ledger.Record
+	err := r.breaker.Do(ctx, func(ctx context.Context) error {
+		var err error
+		record, err = r.registry.Revoke(ctx, token)
+		return err
+	})
+	return record, err
+}
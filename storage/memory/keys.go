@@ -0,0 +1,84 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/auth"
+	"github.com/danielnegri/tokenapi-go/errors"
+)
+
+func (m *Memory) CreateKey(ctx context.Context, key *auth.Key) error {
+	const op errors.Op = "storage/memory.CreateKey"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.keys[key.ID]; ok {
+		return errors.E(op, ctx, errors.Duplicate, errors.Errorf("API key %s", key.ID))
+	}
+
+	m.keys[key.ID] = *key
+	return nil
+}
+
+func (m *Memory) LookupKey(ctx context.Context, id string) (*auth.Key, error) {
+	const op errors.Op = "storage/memory.LookupKey"
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	key, ok := m.keys[id]
+	if !ok {
+		return nil, errors.E(op, ctx, errors.NotFound, errors.Errorf("API key %s", id))
+	}
+
+	return &key, nil
+}
+
+func (m *Memory) ListKeys(ctx context.Context) ([]*auth.Key, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := make([]*auth.Key, 0, len(m.keys))
+	for _, key := range m.keys {
+		key := key
+		keys = append(keys, &key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (m *Memory) RevokeKey(ctx context.Context, id string) error {
+	const op errors.Op = "storage/memory.RevokeKey"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, ok := m.keys[id]
+	if !ok || key.Revoked() {
+		return errors.E(op, ctx, errors.NotFound, errors.Errorf("API key %s", id))
+	}
+
+	key.RevokedAt = time.Now().UTC()
+	m.keys[id] = key
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package memory implements an in-memory storage with the same
+// constraints as the PostgreSQL schema. It is meant for tests and local
+// development: nothing survives a restart.
+package memory
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/auth"
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/ledger"
+	"github.com/danielnegri/tokenapi-go/quota"
+	"github.com/danielnegri/tokenapi-go/storage"
+	"github.com/danielnegri/tokenapi-go/valid"
+)
+
+type Memory struct {
+	mu       sync.RWMutex
+	tokens   map[ledger.Token]ledger.Record
+	keys     map[string]auth.Key
+	counters map[counterKey]quota.Counter
+}
+
+var (
+	_ storage.Storage = (*Memory)(nil)
+	_ ledger.Registry = (*Memory)(nil)
+	_ auth.KeyStore   = (*Memory)(nil)
+)
+
+func New() *Memory {
+	return &Memory{
+		tokens:   make(map[ledger.Token]ledger.Record),
+		keys:     make(map[string]auth.Key),
+		counters: make(map[counterKey]quota.Counter),
+	}
+}
+
+func (m *Memory) Insert(ctx context.Context, token ledger.Token) error {
+	const op errors.Op = "storage/memory.Insert"
+
+	if err := valid.Token(token); err != nil {
+		return errors.E(op, ctx, token, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.tokens[token]; ok {
+		return errors.E(op, ctx, token, errors.Duplicate)
+	}
+
+	m.tokens[token] = ledger.Record{Token: token, IssuedAt: time.Now()}
+	return nil
+}
+
+func (m *Memory) Check(ctx context.Context) error {
+	return nil
+}
+
+// Len returns the number of stored tokens.
+func (m *Memory) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.tokens)
+}
+
+// Contains reports whether token is stored.
+func (m *Memory) Contains(token ledger.Token) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.tokens[token]
+	return ok
+}
+
+func (m *Memory) Lookup(ctx context.Context, token ledger.Token) (*ledger.Record, error) {
+	const op errors.Op = "storage/memory.Lookup"
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	record, ok := m.tokens[token]
+	if !ok {
+		return nil, errors.E(op, ctx, token, errors.NotFound)
+	}
+
+	return &record, nil
+}
+
+func (m *Memory) Revoke(ctx context.Context, token ledger.Token) (*ledger.Record, error) {
+	const op errors.Op = "storage/memory.Revoke"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	record, ok := m.tokens[token]
+	if !ok {
+		return nil, errors.E(op, ctx, token, errors.NotFound)
+	}
+
+	if !record.Revoked() {
+		record.RevokedAt = time.Now()
+		m.tokens[token] = record
+	}
+	return &record, nil
+}
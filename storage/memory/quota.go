@@ -0,0 +1,103 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"context"
+	"sort"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/quota"
+)
+
+type counterKey struct {
+	client string
+	period quota.Period
+}
+
+var _ quota.Store = (*Memory)(nil)
+
+// Consume only keeps the counter of the latest window of each period.
+func (m *Memory) Consume(ctx context.Context, client string, n int64, limits []quota.Limit) error {
+	const op errors.Op = "storage/memory.Consume"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, l := range limits {
+		c := m.counters[counterKey{client, l.Period}]
+		if !c.Start.Equal(l.Start) {
+			c.Used = 0
+		}
+		if c.Used+n > l.Max {
+			return errors.E(op, ctx, errors.Exhausted, &quota.ExceededError{Limit: l, Used: c.Used})
+		}
+	}
+
+	for _, l := range limits {
+		key := counterKey{client, l.Period}
+		c := m.counters[key]
+		if !c.Start.Equal(l.Start) {
+			c = quota.Counter{Client: client, Window: l.Window}
+		}
+		c.Used += n
+		m.counters[key] = c
+	}
+
+	return nil
+}
+
+func (m *Memory) Release(ctx context.Context, client string, n int64, windows []quota.Window) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, w := range windows {
+		key := counterKey{client, w.Period}
+		c, ok := m.counters[key]
+		if !ok || !c.Start.Equal(w.Start) {
+			continue
+		}
+
+		c.Used -= n
+		if c.Used < 0 {
+			c.Used = 0
+		}
+		m.counters[key] = c
+	}
+
+	return nil
+}
+
+func (m *Memory) Counters(ctx context.Context, windows []quota.Window) ([]quota.Counter, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var counters []quota.Counter
+	for _, c := range m.counters {
+		for _, w := range windows {
+			if c.Period == w.Period && c.Start.Equal(w.Start) {
+				counters = append(counters, c)
+			}
+		}
+	}
+
+	sort.Slice(counters, func(i, j int) bool {
+		if counters[i].Client != counters[j].Client {
+			return counters[i].Client < counters[j].Client
+		}
+		return counters[i].Period < counters[j].Period
+	})
+	return counters, nil
+}
@@ -19,7 +19,11 @@ import (
 	"time"
 
 	"github.com/danielnegri/tokenapi-go/log"
+	"github.com/danielnegri/tokenapi-go/tracing"
 	"github.com/go-pg/pg/v10"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+	"google.golang.org/grpc/codes"
 )
 
 type DebugHook struct{}
@@ -31,7 +35,7 @@ func (DebugHook) BeforeQuery(ctx context.Context, event *pg.QueryEvent) (context
 }
 
 func (DebugHook) AfterQuery(ctx context.Context, event *pg.QueryEvent) error {
-	logger := log.WithField("latency", time.Since(event.StartTime))
+	logger := log.FromContext(ctx).WithField("latency", time.Since(event.StartTime))
 
 	query, err := event.FormattedQuery()
 	if err != nil {
@@ -39,11 +43,51 @@ func (DebugHook) AfterQuery(ctx context.Context, event *pg.QueryEvent) error {
 		return err
 	}
 
+	// Formatted queries hold the tokens being inserted.
+	redacted := log.Redact(string(query))
 	if event.Err != nil {
-		logger.Errorf("error %s executing query: %s", event.Err, query)
+		logger.Errorf("error %s executing query: %s", event.Err, redacted)
 	} else {
-		logger.Debugf("Query processed: %s", query)
+		logger.Debugf("Query processed: %s", redacted)
 	}
 
 	return nil
 }
+
+// TracingHook records a span for each query, child of the span found in
+// the query context. Statements are recorded unformatted so that tokens
+// never reach the tracing backend.
+type TracingHook struct{}
+
+var _ pg.QueryHook = (*TracingHook)(nil)
+
+func (TracingHook) BeforeQuery(ctx context.Context, event *pg.QueryEvent) (context.Context, error) {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		return ctx, nil
+	}
+
+	ctx, _ = tracing.Tracer().Start(ctx, "postgres.query", trace.WithSpanKind(trace.SpanKindClient))
+	return ctx, nil
+}
+
+func (TracingHook) AfterQuery(ctx context.Context, event *pg.QueryEvent) error {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return nil
+	}
+	defer span.End()
+
+	attrs := []kv.KeyValue{kv.String("db.system", "postgresql")}
+	if query, err := event.UnformattedQuery(); err == nil {
+		attrs = append(attrs, kv.String("db.statement", string(query)))
+	}
+
+	if event.Err != nil {
+		span.RecordError(ctx, event.Err, trace.WithErrorStatus(codes.Internal))
+	} else if event.Result != nil {
+		attrs = append(attrs, kv.Int("db.rows_affected", event.Result.RowsAffected()))
+	}
+
+	span.SetAttributes(attrs...)
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/auth"
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/go-pg/pg/v10"
+)
+
+// APIKey is the stored form of an auth.Key; see migrations/2.sql.
+type APIKey struct {
+	tableName struct{}  `pg:"api_keys,alias:api_key"`
+	ID        string    `pg:"id,pk"`
+	Name      string    `pg:"name,use_zero"`
+	Hash      string    `pg:"hash"`
+	Scopes    []string  `pg:"scopes,array"`
+	CreatedAt time.Time `pg:"created_at"`
+	RevokedAt time.Time `pg:"revoked_at"`
+}
+
+var _ auth.KeyStore = (*Postgres)(nil)
+
+func newAPIKey(key *auth.Key) *APIKey {
+	scopes := make([]string, len(key.Scopes))
+	for i, scope := range key.Scopes {
+		scopes[i] = string(scope)
+	}
+
+	return &APIKey{
+		ID:        key.ID,
+		Name:      key.Name,
+		Hash:      key.Hash,
+		Scopes:    scopes,
+		CreatedAt: key.CreatedAt,
+		RevokedAt: key.RevokedAt,
+	}
+}
+
+func (k *APIKey) key() *auth.Key {
+	scopes := make([]auth.Scope, len(k.Scopes))
+	for i, scope := range k.Scopes {
+		scopes[i] = auth.Scope(scope)
+	}
+
+	return &auth.Key{
+		ID:        k.ID,
+		Name:      k.Name,
+		Hash:      k.Hash,
+		Scopes:    scopes,
+		CreatedAt: k.CreatedAt,
+		RevokedAt: k.RevokedAt,
+	}
+}
+
+func (p *Postgres) CreateKey(ctx context.Context, key *auth.Key) error {
+	const op errors.Op = "storage/postgres.CreateKey"
+
+	if _, err := p.db.ModelContext(ctx, newAPIKey(key)).Insert(); err != nil {
+		if strings.Contains(err.Error(), "duplicate key value") {
+			return errors.E(op, ctx, errors.Duplicate, errors.Errorf("API key %s", key.ID))
+		}
+
+		return queryError(op, ctx, err)
+	}
+
+	return nil
+}
+
+func (p *Postgres) LookupKey(ctx context.Context, id string) (*auth.Key, error) {
+	const op errors.Op = "storage/postgres.LookupKey"
+
+	var key APIKey
+	if err := p.db.ModelContext(ctx, &key).Where("id = ?", id).Select(); err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.E(op, ctx, errors.NotFound, errors.Errorf("API key %s", id))
+		}
+
+		return nil, queryError(op, ctx, err)
+	}
+
+	return key.key(), nil
+}
+
+func (p *Postgres) ListKeys(ctx context.Context) ([]*auth.Key, error) {
+	const op errors.Op = "storage/postgres.ListKeys"
+
+	var rows []APIKey
+	if err := p.db.ModelContext(ctx, &rows).Order("created_at").Select(); err != nil {
+		return nil, queryError(op, ctx, err)
+	}
+
+	keys := make([]*auth.Key, len(rows))
+	for i := range rows {
+		keys[i] = rows[i].key()
+	}
+
+	return keys, nil
+}
+
+func (p *Postgres) RevokeKey(ctx context.Context, id string) error {
+	const op errors.Op = "storage/postgres.RevokeKey"
+
+	res, err := p.db.ModelContext(ctx, (*APIKey)(nil)).
+		Set("revoked_at = ?", time.Now().UTC()).
+		Where("id = ?", id).
+		Where("revoked_at IS NULL").
+		Update()
+	if err != nil {
+		return queryError(op, ctx, err)
+	}
+
+	if res.RowsAffected() == 0 {
+		return errors.E(op, ctx, errors.NotFound, errors.Errorf("API key %s", id))
+	}
+
+	return nil
+}
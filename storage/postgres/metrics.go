@@ -0,0 +1,72 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"github.com/go-pg/pg/v10"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PoolStats returns the connection pool stats of the database.
+func (p *Postgres) PoolStats() *pg.PoolStats {
+	return p.db.PoolStats()
+}
+
+var (
+	poolHitsDesc = prometheus.NewDesc("ledger_storage_pool_hits_total",
+		"Number of times a free connection was found in the pool.", nil, nil)
+	poolMissesDesc = prometheus.NewDesc("ledger_storage_pool_misses_total",
+		"Number of times a free connection was not found in the pool.", nil, nil)
+	poolTimeoutsDesc = prometheus.NewDesc("ledger_storage_pool_timeouts_total",
+		"Number of times waiting for a connection timed out.", nil, nil)
+	poolStaleDesc = prometheus.NewDesc("ledger_storage_pool_stale_connections_total",
+		"Number of stale connections removed from the pool.", nil, nil)
+	poolTotalDesc = prometheus.NewDesc("ledger_storage_pool_connections",
+		"Number of connections in the pool.", nil, nil)
+	poolIdleDesc = prometheus.NewDesc("ledger_storage_pool_idle_connections",
+		"Number of idle connections in the pool.", nil, nil)
+)
+
+// PoolCollector exports the connection pool stats of a Postgres storage.
+type PoolCollector struct {
+	p *Postgres
+}
+
+var _ prometheus.Collector = (*PoolCollector)(nil)
+
+// NewPoolCollector returns a collector reading the pool stats of p on
+// every scrape.
+func NewPoolCollector(p *Postgres) *PoolCollector {
+	return &PoolCollector{p: p}
+}
+
+func (c *PoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolHitsDesc
+	ch <- poolMissesDesc
+	ch <- poolTimeoutsDesc
+	ch <- poolStaleDesc
+	ch <- poolTotalDesc
+	ch <- poolIdleDesc
+}
+
+func (c *PoolCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.p.PoolStats()
+	ch <- prometheus.MustNewConstMetric(poolHitsDesc, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(poolMissesDesc, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(poolTimeoutsDesc, prometheus.CounterValue, float64(stats.Timeouts))
+	ch <- prometheus.MustNewConstMetric(poolStaleDesc, prometheus.CounterValue, float64(stats.StaleConns))
+	ch <- prometheus.MustNewConstMetric(poolTotalDesc, prometheus.GaugeValue, float64(stats.TotalConns))
+	ch <- prometheus.MustNewConstMetric(poolIdleDesc, prometheus.GaugeValue, float64(stats.IdleConns))
+}
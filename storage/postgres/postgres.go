@@ -16,6 +16,8 @@ package postgres
 
 import (
 	"context"
+	"io"
+	"net"
 	"runtime"
 	"strings"
 	"time"
@@ -28,7 +30,9 @@ import (
 )
 
 const (
-	DefaultURL = "postgres://localhost:5432/ledger"
+	// DefaultRetry is the default number of retries after a transient error.
+	DefaultRetry = 3
+	DefaultURL   = "postgres://localhost:5432/ledger"
 )
 
 type SecretToken struct {
@@ -58,6 +62,9 @@ func Connect(opt *pg.Options) (*Postgres, error) {
 	}
 
 	db := pg.Connect(opt)
+	// Hooks run in order and the first AfterQuery error skips the rest,
+	// so the tracing hook goes first to always end its span.
+	db.AddQueryHook(TracingHook{})
 	db.AddQueryHook(DebugHook{})
 
 	return &Postgres{db: db}, nil
@@ -72,16 +79,27 @@ func (p *Postgres) Insert(ctx context.Context, token ledger.Token) error {
 		return err
 	}
 
-	if err := p.db.Insert(&SecretToken{Data: token}); err != nil {
+	if _, err := p.db.ModelContext(ctx, &SecretToken{Data: token}).Insert(); err != nil {
 		if strings.Contains(err.Error(), "duplicate key value") {
-			return errors.E(op, token, errors.Duplicate)
+			return errors.E(op, ctx, token, errors.Duplicate)
 		}
 
 		if strings.Contains(err.Error(), "violates check constraint") {
-			return errors.E(op, token, errors.Invalid)
+			return errors.E(op, ctx, token, errors.Invalid)
 		}
 
-		return errors.E(op, token, errors.Internal, err)
+		// The token may have been committed before the connection
+		// dropped. Retrying would then report it as a duplicate, so the
+		// failure is not reported as Transient.
+		if isAmbiguous(err) {
+			return errors.E(op, ctx, token, errors.IO, err)
+		}
+
+		if isTransient(err) {
+			return errors.E(op, ctx, token, errors.Transient, err)
+		}
+
+		return errors.E(op, ctx, token, errors.Internal, err)
 	}
 
 	return nil
@@ -92,8 +110,78 @@ func (p *Postgres) Check(ctx context.Context) error {
 	const op errors.Op = "storage/postgres.Check"
 
 	if err := p.db.Ping(ctx); err != nil {
-		return errors.E(op, errors.Internal, err)
+		if isTransient(err) {
+			return errors.E(op, ctx, errors.Transient, err)
+		}
+
+		return errors.E(op, ctx, errors.Internal, err)
 	}
 
 	return nil
 }
+
+// Close closes the connection pool.
+func (p *Postgres) Close() error {
+	return p.db.Close()
+}
+
+// queryError classifies an error returned by a query.
+func queryError(op errors.Op, ctx context.Context, err error) error {
+	if isTransient(err) {
+		return errors.E(op, ctx, errors.Transient, err)
+	}
+
+	return errors.E(op, ctx, errors.Internal, err)
+}
+
+// transientCodes are the SQLSTATE codes and classes of errors that may
+// succeed if the statement is retried.
+var transientCodes = []string{
+	"08",    // connection_exception
+	"40001", // serialization_failure
+	"40P01", // deadlock_detected
+	"53",    // insufficient_resources
+	"57P01", // admin_shutdown
+	"57P02", // crash_shutdown
+	"57P03", // cannot_connect_now
+}
+
+// isTransient reports whether err is a network failure or a PostgreSQL
+// error that is worth retrying.
+func isTransient(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+
+	if pgErr, ok := err.(pg.Error); ok {
+		code := pgErr.Field('C')
+		for _, prefix := range transientCodes {
+			if strings.HasPrefix(code, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return strings.Contains(err.Error(), "connection pool timeout")
+}
+
+// isAmbiguous reports whether err is a network failure that may have
+// happened after the statement reached the server, so that whether it was
+// committed is unknown. Failures to connect are not ambiguous.
+func isAmbiguous(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	if _, ok := err.(net.Error); ok {
+		opErr, ok := err.(*net.OpError)
+		return !ok || opErr.Op != "dial"
+	}
+
+	return false
+}
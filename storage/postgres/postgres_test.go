@@ -0,0 +1,48 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsAmbiguous(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		ambiguous bool
+		transient bool
+	}{
+		{"eof", io.EOF, true, true},
+		{"unexpected eof", io.ErrUnexpectedEOF, true, true},
+		{"read", &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, true, true},
+		{"dial", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, false, true},
+		{"pool timeout", errors.New("pg: connection pool timeout"), false, true},
+		{"other", errors.New("pg: unexpected"), false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.ambiguous, isAmbiguous(tt.err))
+			assert.Equal(t, tt.transient, isTransient(tt.err))
+		})
+	}
+}
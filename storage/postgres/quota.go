@@ -0,0 +1,148 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/quota"
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+)
+
+// QuotaCounter is the stored form of a quota.Counter; see migrations/3.sql.
+type QuotaCounter struct {
+	tableName   struct{}  `pg:"quota_counters,alias:counter"`
+	Client      string    `pg:"client,pk"`
+	Period      string    `pg:"period,pk"`
+	WindowStart time.Time `pg:"window_start,pk"`
+	Used        int64     `pg:"used,use_zero"`
+}
+
+var _ quota.Store = (*Postgres)(nil)
+
+// Consume increments the counters of client in a transaction. Each counter
+// is incremented by a single upsert that fails to match when the limit
+// would be exceeded, so that concurrent replicas never overshoot.
+func (p *Postgres) Consume(ctx context.Context, client string, n int64, limits []quota.Limit) error {
+	const op errors.Op = "storage/postgres.Consume"
+
+	err := p.db.RunInTransaction(func(tx *pg.Tx) error {
+		for _, l := range limits {
+			if l.Period != quota.Total {
+				_, err := tx.ExecContext(ctx, `DELETE FROM quota_counters WHERE client = ? AND period = ? AND window_start < ?`,
+					client, l.Period, l.Start)
+				if err != nil {
+					return err
+				}
+			}
+
+			var used int64
+			_, err := tx.QueryOneContext(ctx, pg.Scan(&used), `
+				INSERT INTO quota_counters (client, period, window_start, used) VALUES (?0, ?1, ?2, ?3)
+				ON CONFLICT (client, period, window_start)
+				DO UPDATE SET used = quota_counters.used + EXCLUDED.used
+				WHERE quota_counters.used + EXCLUDED.used <= ?4
+				RETURNING used`, client, l.Period, l.Start, n, l.Max)
+			if err == pg.ErrNoRows || (err == nil && used > l.Max) {
+				// Returning an error rolls the transaction back.
+				return exceeded(ctx, tx, client, l)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if _, ok := err.(*errors.Error); ok {
+		return err
+	}
+	if err != nil {
+		return queryError(op, ctx, err)
+	}
+
+	return nil
+}
+
+// exceeded returns the error of a request over limit l.
+func exceeded(ctx context.Context, tx *pg.Tx, client string, l quota.Limit) error {
+	const op errors.Op = "storage/postgres.Consume"
+
+	counter := QuotaCounter{Client: client, Period: string(l.Period), WindowStart: l.Start}
+	if err := tx.ModelContext(ctx, &counter).WherePK().Select(); err != nil && err != pg.ErrNoRows {
+		return queryError(op, ctx, err)
+	}
+
+	return errors.E(op, ctx, errors.Exhausted, &quota.ExceededError{Limit: l, Used: counter.Used})
+}
+
+// Release decrements the counters of client in windows in a single
+// statement.
+func (p *Postgres) Release(ctx context.Context, client string, n int64, windows []quota.Window) error {
+	const op errors.Op = "storage/postgres.Release"
+
+	if len(windows) == 0 {
+		return nil
+	}
+
+	q := p.db.ModelContext(ctx, (*QuotaCounter)(nil)).
+		Set("used = greatest(used - ?, 0)", n).
+		Where("client = ?", client)
+	q = q.WhereGroup(func(q *orm.Query) (*orm.Query, error) {
+		for _, w := range windows {
+			q = q.WhereOr("period = ? AND window_start = ?", w.Period, w.Start)
+		}
+		return q, nil
+	})
+	if _, err := q.Update(); err != nil {
+		return queryError(op, ctx, err)
+	}
+
+	return nil
+}
+
+func (p *Postgres) Counters(ctx context.Context, windows []quota.Window) ([]quota.Counter, error) {
+	const op errors.Op = "storage/postgres.Counters"
+
+	if len(windows) == 0 {
+		return nil, nil
+	}
+
+	var rows []QuotaCounter
+	q := p.db.ModelContext(ctx, &rows)
+	q = q.WhereGroup(func(q *orm.Query) (*orm.Query, error) {
+		for _, w := range windows {
+			q = q.WhereOr("period = ? AND window_start = ?", w.Period, w.Start)
+		}
+		return q, nil
+	})
+	if err := q.Order("client", "period").Select(); err != nil {
+		return nil, queryError(op, ctx, err)
+	}
+
+	counters := make([]quota.Counter, len(rows))
+	for i, row := range rows {
+		counters[i] = quota.Counter{
+			Client: row.Client,
+			Window: quota.Window{Period: quota.Period(row.Period), Start: row.WindowStart},
+			Used:   row.Used,
+		}
+	}
+
+	return counters, nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"time"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/ledger"
+	"github.com/go-pg/pg/v10"
+)
+
+// TokenRecord is the stored form of a ledger.Record; see migrations/4.sql.
+// Tokens are inserted as SecretToken, leaving the dates to the database.
+type TokenRecord struct {
+	tableName struct{}     `pg:"secret_tokens,alias:tokens"`
+	Data      ledger.Token `pg:"data,pk"`
+	IssuedAt  time.Time    `pg:"issued_at"`
+	RevokedAt time.Time    `pg:"revoked_at"`
+}
+
+var _ ledger.Registry = (*Postgres)(nil)
+
+func (r *TokenRecord) record() *ledger.Record {
+	return &ledger.Record{
+		Token:     r.Data,
+		IssuedAt:  r.IssuedAt,
+		RevokedAt: r.RevokedAt,
+	}
+}
+
+func (p *Postgres) Lookup(ctx context.Context, token ledger.Token) (*ledger.Record, error) {
+	const op errors.Op = "storage/postgres.Lookup"
+
+	r := &TokenRecord{Data: token}
+	if err := p.db.ModelContext(ctx, r).WherePK().Select(); err != nil {
+		if err == pg.ErrNoRows {
+			return nil, errors.E(op, ctx, token, errors.NotFound)
+		}
+
+		return nil, queryError(op, ctx, err)
+	}
+
+	return r.record(), nil
+}
+
+func (p *Postgres) Revoke(ctx context.Context, token ledger.Token) (*ledger.Record, error) {
+	const op errors.Op = "storage/postgres.Revoke"
+
+	r := &TokenRecord{Data: token}
+	res, err := p.db.ModelContext(ctx, r).
+		Set("revoked_at = coalesce(revoked_at, now())").
+		WherePK().
+		Returning("*").
+		Update()
+	if err != nil {
+		return nil, queryError(op, ctx, err)
+	}
+	if res.RowsAffected() == 0 {
+		return nil, errors.E(op, ctx, token, errors.NotFound)
+	}
+
+	return r.record(), nil
+}
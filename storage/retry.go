@@ -0,0 +1,82 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/ledger"
+	"github.com/danielnegri/tokenapi-go/retry"
+)
+
+type retryStorage struct {
+	storage Storage
+	policy  *retry.Policy
+}
+
+// WithRetry returns a Storage that retries calls to s failing with a
+// Transient error according to the given policy. Insert is not idempotent:
+// storages must not report as Transient a failure that may have stored the
+// token.
+func WithRetry(s Storage, policy *retry.Policy) Storage {
+	return &retryStorage{storage: s, policy: policy}
+}
+
+func (s *retryStorage) Check(ctx context.Context) error {
+	return s.policy.Do(ctx, s.storage.Check, isTransient)
+}
+
+func (s *retryStorage) Insert(ctx context.Context, token ledger.Token) error {
+	return s.policy.Do(ctx, func(ctx context.Context) error {
+		return s.storage.Insert(ctx, token)
+	}, isTransient)
+}
+
+func isTransient(err error) bool {
+	return errors.Is(errors.Transient, err)
+}
+
+type retryRegistry struct {
+	registry ledger.Registry
+	policy   *retry.Policy
+}
+
+// RegistryWithRetry returns a Registry that retries calls to r failing with
+// a Transient error according to the given policy. Revoke keeps the first
+// revocation time, so it is safe to retry.
+func RegistryWithRetry(r ledger.Registry, policy *retry.Policy) ledger.Registry {
+	return &retryRegistry{registry: r, policy: policy}
+}
+
+func (r *retryRegistry) Lookup(ctx context.Context, token ledger.Token) (*ledger.Record, error) {
+	var record *ledger.Record
+	err := r.policy.Do(ctx, func(ctx context.Context) error {
+		var err error
+		record, err = r.registry.Lookup(ctx, token)
+		return err
+	}, isTransient)
+	return record, err
+}
+
+func (r *retryRegistry) Revoke(ctx context.Context, token ledger.Token) (*ledger.Record, error) {
+	var record *ledger.Record
+	err := r.policy.Do(ctx, func(ctx context.Context) error {
+		var err error
+		record, err = r.registry.Revoke(ctx, token)
+		return err
+	}, isTransient)
+	return record, err
+}
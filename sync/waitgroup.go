@@ -15,6 +15,7 @@
 package sync
 
 import (
+	"context"
 	"math"
 	"sync"
 )
@@ -56,6 +57,26 @@ func (s *WaitGroup) Add() {
 	s.wg.Add(1)
 }
 
+// AddContext is like Add but gives up when ctx is done before a goroutine
+// slot frees up, in which case it reports false and the counter is left
+// unchanged. A done ctx is never added, even when a slot is free.
+func (s *WaitGroup) AddContext(ctx context.Context) bool {
+	// select picks randomly among ready cases, so a free slot could
+	// otherwise win over a done context.
+	if ctx.Err() != nil {
+		return false
+	}
+
+	select {
+	case s.current <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	}
+
+	s.wg.Add(1)
+	return true
+}
+
 // Done decrements the WaitGroup counter.
 // See sync.WaitGroup documentation for more information.
 func (s *WaitGroup) Done() {
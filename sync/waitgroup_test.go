@@ -15,6 +15,7 @@
 package sync
 
 import (
+	"context"
 	"sync/atomic"
 	"testing"
 )
@@ -53,7 +54,7 @@ func TestThrottling(t *testing.T) {
 			defer swg.Done()
 			atomic.AddUint32(c, 1)
 			if len(swg.current) > 4 {
-				t.Fatalf("not the good amount of routines spawned.")
+				t.Errorf("not the good amount of routines spawned.")
 				return
 			}
 		}(&c)
@@ -80,3 +81,34 @@ func TestNoThrottling(t *testing.T) {
 		t.Fatalf("%d, not all routines have been executed.", c)
 	}
 }
+
+func TestAddContext(t *testing.T) {
+	swg := NewWaitGroup(1)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if !swg.AddContext(ctx) {
+		t.Fatalf("the first goroutine should have been added.")
+	}
+
+	cancel()
+	if swg.AddContext(ctx) {
+		t.Fatalf("no goroutine should be added once the context is done.")
+	}
+
+	swg.Done()
+	swg.Wait()
+}
+
+func TestAddContext_done(t *testing.T) {
+	swg := NewWaitGroup(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// A slot is free, but the context is already done.
+	for i := 0; i < 100; i++ {
+		if swg.AddContext(ctx) {
+			t.Fatalf("no goroutine should be added once the context is done.")
+		}
+	}
+	swg.Wait()
+}
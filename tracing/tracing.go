@@ -0,0 +1,172 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing sets up OpenTelemetry tracing for the Ledger service.
+// Spans propagate through W3C trace context headers and are exported to an
+// OTLP collector or written to a local file.
+package tracing
+
+import (
+	"os"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/ledger"
+	"github.com/danielnegri/tokenapi-go/version"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/propagation"
+	"go.opentelemetry.io/otel/api/standard"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/trace/stdout"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Exporters spans can be sent to.
+const (
+	ExporterNone = "none"
+	ExporterOTLP = "otlp"
+	ExporterFile = "file"
+)
+
+const (
+	// DefaultEndpoint is the address of the OTLP collector.
+	DefaultEndpoint = "localhost:55680"
+
+	// DefaultSampleRatio is the share of traces started by the service that
+	// are recorded. Traces started upstream follow the caller's decision.
+	DefaultSampleRatio = 1.0
+
+	instrumentationName = "github.com/danielnegri/tokenapi-go"
+)
+
+// Config configures where and how much the service traces.
+type Config struct {
+	// Exporter is one of ExporterNone, ExporterOTLP or ExporterFile. The
+	// default is ExporterNone, which still propagates trace context.
+	Exporter string
+
+	// Endpoint is the address of the OTLP collector. The default is
+	// DefaultEndpoint.
+	Endpoint string
+
+	// Insecure disables TLS towards the OTLP collector.
+	Insecure bool
+
+	// File is where ExporterFile appends spans, one JSON object per line.
+	File string
+
+	// SampleRatio is the share of new traces that are recorded, from 0 to
+	// 1. Nil means DefaultSampleRatio, so that 0 can turn sampling off.
+	SampleRatio *float64
+}
+
+func init() {
+	global.SetPropagators(propagation.New(
+		propagation.WithInjectors(trace.TraceContext{}),
+		propagation.WithExtractors(trace.TraceContext{}),
+	))
+}
+
+// Tracer returns the tracer of the Ledger service.
+func Tracer() trace.Tracer {
+	return global.Tracer(instrumentationName)
+}
+
+// Setup installs the global trace provider described by cfg. The returned
+// function flushes pending spans and releases the exporter.
+func Setup(cfg *Config) (func(), error) {
+	const op errors.Op = "tracing.Setup"
+	if cfg == nil || cfg.Exporter == "" || cfg.Exporter == ExporterNone {
+		return func() {}, nil
+	}
+
+	ratio := DefaultSampleRatio
+	if cfg.SampleRatio != nil {
+		ratio = *cfg.SampleRatio
+	}
+
+	var (
+		processor sdktrace.SpanProcessor
+		stop      func()
+	)
+
+	switch cfg.Exporter {
+	case ExporterOTLP:
+		endpoint := cfg.Endpoint
+		if endpoint == "" {
+			endpoint = DefaultEndpoint
+		}
+
+		exporterOpts := []otlp.ExporterOption{otlp.WithAddress(endpoint)}
+		if cfg.Insecure {
+			exporterOpts = append(exporterOpts, otlp.WithInsecure())
+		}
+
+		exporter, err := otlp.NewExporter(exporterOpts...)
+		if err != nil {
+			return nil, errors.E(op, errors.IO, err)
+		}
+
+		bsp, err := sdktrace.NewBatchSpanProcessor(exporter)
+		if err != nil {
+			_ = exporter.Stop()
+			return nil, errors.E(op, errors.Internal, err)
+		}
+
+		processor = bsp
+		stop = func() { _ = exporter.Stop() }
+	case ExporterFile:
+		if cfg.File == "" {
+			return nil, errors.E(op, errors.Invalid, "file exporter requires a file")
+		}
+
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, errors.E(op, errors.IO, err)
+		}
+
+		exporter, err := stdout.NewExporter(stdout.Options{Writer: f})
+		if err != nil {
+			_ = f.Close()
+			return nil, errors.E(op, errors.Internal, err)
+		}
+
+		processor = sdktrace.NewSimpleSpanProcessor(exporter)
+		stop = func() { _ = f.Close() }
+	default:
+		return nil, errors.E(op, errors.Invalid, errors.Errorf("unknown exporter %q", cfg.Exporter))
+	}
+
+	provider, err := sdktrace.NewProvider(
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.ProbabilitySampler(ratio)}),
+		sdktrace.WithResource(resource.New(
+			standard.ServiceNameKey.String(ledger.Description),
+			standard.ServiceVersionKey.String(version.Version),
+		)),
+	)
+	if err != nil {
+		stop()
+		return nil, errors.E(op, errors.Internal, err)
+	}
+
+	provider.RegisterSpanProcessor(processor)
+	global.SetTraceProvider(provider)
+
+	return func() {
+		// Unregistering the processor flushes the spans it still holds.
+		provider.UnregisterSpanProcessor(processor)
+		stop()
+	}, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 The Ledger Authors
+//
+// Licensed under the AGPL, Version 3.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.gnu.org/licenses/agpl-3.0.en.html
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/danielnegri/tokenapi-go/errors"
+	"github.com/danielnegri/tokenapi-go/net/httputil"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type exportedSpan struct {
+	Name        string
+	SpanContext struct {
+		TraceID string
+		SpanID  string
+	}
+	ParentSpanID string
+}
+
+func TestSetup_file(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "spans.json")
+	stop, err := Setup(&Config{Exporter: ExporterFile, File: file})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(httputil.TracingHandler(Tracer()))
+	router.GET("/work", func(c *gin.Context) {
+		_, span := Tracer().Start(c.Request.Context(), "work")
+		span.End()
+		c.Status(http.StatusNoContent)
+	})
+
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	req := httptest.NewRequest(http.MethodGet, "/work", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+spanID+"-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	stop()
+
+	f, err := os.Open(file)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+
+	spans := map[string]exportedSpan{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var span exportedSpan
+		if assert.NoError(t, json.Unmarshal(scanner.Bytes(), &span)) {
+			spans[span.Name] = span
+		}
+	}
+
+	server, work := spans["/work"], spans["work"]
+	assert.Equal(t, traceID, server.SpanContext.TraceID)
+	assert.Equal(t, spanID, server.ParentSpanID)
+	assert.Equal(t, traceID, work.SpanContext.TraceID)
+	assert.Equal(t, server.SpanContext.SpanID, work.ParentSpanID)
+}
+
+func TestSetup_sampleRatio(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A zero ratio records no new traces rather than falling back to the
+	// default.
+	file := filepath.Join(dir, "spans.json")
+	ratio := 0.0
+	stop, err := Setup(&Config{Exporter: ExporterFile, File: file, SampleRatio: &ratio})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, span := Tracer().Start(context.Background(), "work")
+	span.End()
+	stop()
+
+	b, err := ioutil.ReadFile(file)
+	if assert.NoError(t, err) {
+		assert.Empty(t, b)
+	}
+}
+
+func TestSetup_invalid(t *testing.T) {
+	stop, err := Setup(nil)
+	assert.NoError(t, err)
+	stop()
+
+	_, err = Setup(&Config{Exporter: ExporterFile})
+	assert.True(t, errors.Is(errors.Invalid, err))
+
+	_, err = Setup(&Config{Exporter: "zipkin"})
+	assert.True(t, errors.Is(errors.Invalid, err))
+}